@@ -0,0 +1,236 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+)
+
+// The ACL file has one rule on each line, the blank lines and the lines starting with "#" are skipped:
+//
+//	<allow|deny> <publish|subscribe|all> [user=<name>] [client=<id>] <topic>
+//
+// The topic is the rest of the line, so it may contain spaces, and it may contain wildcards.
+// %u and %c in the topic are replaced by the user name and the client id, a rule is skipped
+// if the user name or the client id it needs is empty or contains "/", "+" or "#".
+// A request matching a deny rule is denied even if an allow rule matches it too, and the
+// requests matching no allow rule are denied:
+//
+//	allow all client=sensor-1 sensors/%c/#
+//	allow subscribe user=admin $SYS/#
+//	allow all users/%u/#
+//	deny subscribe users/+/secret/#
+//
+// A topic filter of SUBSCRIBE is allowed only if the allow rule matches every topic the filter
+// may match, and it is denied if a deny rule matches any of them.
+
+// aclRule one rule of the ACL file
+type aclRule struct {
+	allow     bool
+	publish   bool
+	subscribe bool
+
+	// empty matches any user or client
+	user   string
+	client string
+
+	topic string
+}
+
+// ACL the topic access rules loaded from a file
+type ACL struct {
+	rules []aclRule
+}
+
+// LoadACLFile load the rules of the ACL file
+func LoadACLFile(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// ParseACL parse the rules, the error tells the line of the invalid rule
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseACLRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("acl line %d: %v", n, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// cutField split the first field of the line
+func cutField(line string) (string, string) {
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i:])
+	}
+	return line, ""
+}
+
+func parseACLRule(line string) (aclRule, error) {
+	var rule aclRule
+
+	action, line := cutField(line)
+	switch action {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q", action)
+	}
+
+	access, line := cutField(line)
+	switch access {
+	case "publish":
+		rule.publish = true
+	case "subscribe":
+		rule.subscribe = true
+	case "all":
+		rule.publish, rule.subscribe = true, true
+	default:
+		return rule, fmt.Errorf("unknown access %q", access)
+	}
+
+	for {
+		field, rest := cutField(line)
+		if strings.HasPrefix(field, "user=") {
+			rule.user = strings.TrimPrefix(field, "user=")
+		} else if strings.HasPrefix(field, "client=") {
+			rule.client = strings.TrimPrefix(field, "client=")
+		} else {
+			break
+		}
+		line = rest
+	}
+
+	if err := message.ValidTopicFilter([]byte(line)); err != nil {
+		return rule, fmt.Errorf("invalid topic %q", line)
+	}
+	rule.topic = line
+	return rule, nil
+}
+
+// pattern the topic of the rule for the client, false if the rule does not apply to it
+func (rule *aclRule) pattern(userName string, clientID string, access Access) (string, bool) {
+	if (access == AccessPublish && !rule.publish) || (access == AccessSubscribe && !rule.subscribe) {
+		return "", false
+	}
+	if (rule.user != "" && rule.user != userName) || (rule.client != "" && rule.client != clientID) {
+		return "", false
+	}
+
+	topic := rule.topic
+	for _, sub := range []struct{ key, value string }{{"%u", userName}, {"%c", clientID}} {
+		if !strings.Contains(topic, sub.key) {
+			continue
+		}
+		// a user name like "+" must not turn the rule into a wildcard
+		if sub.value == "" || strings.ContainsAny(sub.value, SEP+_WC) {
+			return "", false
+		}
+		topic = strings.Replace(topic, sub.key, sub.value, -1)
+	}
+	return topic, true
+}
+
+// Authorize implement Authorizer, a deny rule wins over the allow rules
+func (acl *ACL) Authorize(userName string, clientID string, access Access, topic string) bool {
+	levels := strings.Split(topic, SEP)
+	allowed := false
+	for i := range acl.rules {
+		rule := &acl.rules[i]
+		pattern, ok := rule.pattern(userName, clientID, access)
+		if !ok {
+			continue
+		}
+
+		filter := strings.Split(pattern, SEP)
+		var match bool
+		switch {
+		case access == AccessPublish:
+			match = matchTopic(levels, filter, strings.HasPrefix(topic, SYS))
+		case rule.allow:
+			match = coverFilter(filter, levels)
+		default:
+			match = overlapFilter(filter, levels)
+		}
+
+		if match && !rule.allow {
+			return false
+		}
+		allowed = allowed || match
+	}
+	return allowed
+}
+
+// coverFilter whether every topic matched by the filter is matched by the pattern too
+func coverFilter(pattern []string, filter []string) bool {
+	for i, level := range pattern {
+		// the wildcards at the first level do not match the topics starting with $
+		if i == 0 && (level == MWC || level == SWC) && strings.HasPrefix(filter[0], SYS) {
+			return false
+		}
+		if level == MWC {
+			return true
+		}
+		if i >= len(filter) || filter[i] == MWC {
+			return false
+		}
+		if level != SWC && level != filter[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(filter)
+}
+
+// overlapFilter whether any topic is matched by both the pattern and the filter
+func overlapFilter(pattern []string, filter []string) bool {
+	for i := 0; ; i++ {
+		if i == len(pattern) && i == len(filter) {
+			return true
+		}
+		// "sport/#" matches "sport" too
+		if i < len(pattern) && pattern[i] == MWC {
+			return i > 0 || !strings.HasPrefix(filter[0], SYS)
+		}
+		if i < len(filter) && filter[i] == MWC {
+			return i > 0 || !strings.HasPrefix(pattern[0], SYS)
+		}
+		if i == len(pattern) || i == len(filter) {
+			return false
+		}
+
+		a, b := pattern[i], filter[i]
+		switch {
+		case a == SWC && b == SWC:
+		case a == SWC:
+			if i == 0 && strings.HasPrefix(b, SYS) {
+				return false
+			}
+		case b == SWC:
+			if i == 0 && strings.HasPrefix(a, SYS) {
+				return false
+			}
+		case a != b:
+			return false
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testACL = `
+# sensors only touch their own topics
+allow all client=sensor-1 sensors/%c/#
+allow all users/%u/#
+deny  subscribe users/+/secret/#
+allow subscribe user=admin $SYS/#
+allow publish   user=admin retained messages/count
+allow subscribe public/#
+deny  publish   public/readonly
+`
+
+func TestACLAuthorize(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(testACL))
+	assert.NoError(t, err)
+
+	cases := []struct {
+		user   string
+		client string
+		access Access
+		topic  string
+		allow  bool
+	}{
+		{"", "sensor-1", AccessPublish, "sensors/sensor-1/temp", true},
+		{"", "sensor-2", AccessPublish, "sensors/sensor-2/temp", false},
+		{"", "sensor-1", AccessPublish, "sensors/sensor-2/temp", false},
+		{"bob", "c1", AccessPublish, "users/bob/inbox", true},
+		{"bob", "c1", AccessPublish, "users/alice/inbox", false},
+		{"bob", "c1", AccessSubscribe, "users/bob/inbox/#", true},
+		{"bob", "c1", AccessSubscribe, "users/bob/#", false},
+		{"bob", "c1", AccessSubscribe, "users/+/inbox", false},
+		{"bob", "c1", AccessSubscribe, "users/bob/secret/key", false},
+		{"bob", "c1", AccessSubscribe, "users/bob/+/key", false},
+		{"bob", "c1", AccessPublish, "users/bob/secret/key", true},
+		{"", "c1", AccessPublish, "users//inbox", false},
+		{"+", "c1", AccessSubscribe, "users/+/inbox", false},
+		{"admin", "c1", AccessSubscribe, "$SYS/broker/uptime", true},
+		{"admin", "c1", AccessPublish, "$SYS/broker/uptime", false},
+		{"admin", "c1", AccessPublish, "retained messages/count", true},
+		{"bob", "c1", AccessSubscribe, "$SYS/#", false},
+		{"bob", "c1", AccessSubscribe, "public/+", true},
+		{"bob", "c1", AccessSubscribe, "#", false},
+		{"bob", "c1", AccessPublish, "public/news", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allow, acl.Authorize(c.user, c.client, c.access, c.topic),
+			"%s %s of %s/%s", c.access, c.topic, c.user, c.client)
+	}
+}
+
+func TestACLFilters(t *testing.T) {
+	split := func(topic string) []string {
+		return strings.Split(topic, SEP)
+	}
+	assert.True(t, coverFilter(split("sport/#"), split("sport")))
+	assert.True(t, coverFilter(split("sport/+"), split("sport/+")))
+	assert.False(t, coverFilter(split("sport/+"), split("sport/#")))
+	assert.False(t, coverFilter(split("#"), split("$SYS/#")))
+	assert.True(t, coverFilter(split("#"), split("+/tennis")))
+
+	assert.True(t, overlapFilter(split("sport/#"), split("sport")))
+	assert.True(t, overlapFilter(split("sport/+/player1"), split("+/tennis/#")))
+	assert.False(t, overlapFilter(split("sport/+"), split("sport/tennis/player1")))
+	assert.False(t, overlapFilter(split("$SYS/#"), split("#")))
+	assert.False(t, overlapFilter(split("+/monitor"), split("$SYS/monitor")))
+}
+
+func TestLoadACLFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "acl")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl.conf")
+	assert.NoError(t, os.WriteFile(path, []byte(testACL), 0600))
+	acl, err := LoadACLFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, acl.rules, 7)
+
+	for _, line := range []string{"permit all a", "allow read a", "allow all sport/#/x", "allow all user=bob"} {
+		_, err := ParseACL(strings.NewReader("\n" + line))
+		assert.Error(t, err, line)
+		if err != nil {
+			assert.Contains(t, err.Error(), "line 2")
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// ErrStoreClosed the store is used after it is closed
+var ErrStoreClosed = errors.New("store is closed")
+
+// the file is compacted when it holds more replaced records than this and than the live ones
+const compactMinGarbage = 1024
+
+// the header of each record, the length and the crc32 of the json encoded record
+const recordHeaderLen = 8
+
+// the records larger than this are treated as broken
+const maxRecordLen = 1 << 30
+
+// logRecord one record of the file, the value is null when the key is deleted
+type logRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// appendLog a file of json values keyed by string, every put appends one record and the
+// latest record of a key wins. The file is replayed when it is opened, a record partly written
+// by a crash is discarded, then the file is rewritten with only the latest records, which is
+// also done when too many records are replaced. The records are not synced one by one,
+// so they survive a crash of the broker but not of the system. It is not locked, the stores lock it
+type appendLog struct {
+	path string
+	file *os.File
+
+	// the length of the complete records in the file, a record partly written by a failed put
+	// is cut off at it, or the replay would stop there and lose the following records
+	size int64
+
+	// the partial record can not be cut off, the later puts fail with it
+	err error
+
+	// the latest encoded record of each key
+	records map[string][]byte
+
+	// the number of the records in the file replaced or deleted by the following ones
+	garbage int
+}
+
+// openAppendLog open the file, it is created if it does not exist
+func openAppendLog(path string) (*appendLog, error) {
+	log := &appendLog{
+		path:    path,
+		records: make(map[string][]byte),
+	}
+	if err := log.replay(); err != nil {
+		return nil, err
+	}
+	if err := log.compact(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// replay read the records of the file, it stops at the first broken record
+func (log *appendLog) replay() error {
+	f, err := os.Open(log.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		data, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			glog.Warningf("discard the broken records of %s: %v", log.path, err)
+			return nil
+		}
+
+		var record logRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			glog.Warningf("discard the broken records of %s: %v", log.path, err)
+			return nil
+		}
+		log.apply(&record, data)
+	}
+}
+
+// apply keep the latest record of the key
+func (log *appendLog) apply(record *logRecord, data []byte) {
+	if _, ok := log.records[record.Key]; ok {
+		log.garbage++
+	}
+	if string(record.Value) == "null" {
+		delete(log.records, record.Key)
+		log.garbage++
+	} else {
+		log.records[record.Key] = data
+	}
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n > maxRecordLen {
+		return nil, errors.New("invalid record length")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return data, nil
+}
+
+func writeRecord(w io.Writer, data []byte) error {
+	buf := make([]byte, recordHeaderLen+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(data))
+	copy(buf[recordHeaderLen:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// compact rewrite the file with the latest records, the new file replaces the old one by rename
+func (log *appendLog) compact() error {
+	tmp := log.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, data := range log.records {
+		if err = writeRecord(w, data); err != nil {
+			break
+		}
+		size += int64(recordHeaderLen + len(data))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, log.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if log.file != nil {
+		log.file.Close()
+	}
+	log.file, err = os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND, 0600)
+	log.size = size
+	log.garbage = 0
+	return err
+}
+
+// put append the value of the key, a nil value deletes the key
+func (log *appendLog) put(key string, value interface{}) error {
+	if log.file == nil {
+		return ErrStoreClosed
+	}
+	if log.err != nil {
+		return log.err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&logRecord{Key: key, Value: raw})
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(log.file, data); err != nil {
+		log.undo()
+		return err
+	}
+	log.size += int64(recordHeaderLen + len(data))
+
+	log.apply(&logRecord{Key: key, Value: raw}, data)
+	if log.garbage > compactMinGarbage && log.garbage > len(log.records) {
+		return log.compact()
+	}
+	return nil
+}
+
+// undo cut off the record partly written by the failed put, like the one of a full disk,
+// the log is failed if it can not be done
+func (log *appendLog) undo() {
+	if err := log.file.Truncate(log.size); err != nil {
+		glog.Errorf("failed to cut off the partial record of %s: %v", log.path, err)
+		log.err = fmt.Errorf("the partial record of %s is not cut off: %v", log.path, err)
+	}
+}
+
+// delete append the deletion of the key if it exists
+func (log *appendLog) delete(key string) error {
+	if _, ok := log.records[key]; !ok {
+		return nil
+	}
+	return log.put(key, nil)
+}
+
+// list the latest records, decode them with decodeValue out of the lock
+func (log *appendLog) list() [][]byte {
+	records := make([][]byte, 0, len(log.records))
+	for _, data := range log.records {
+		records = append(records, data)
+	}
+	return records
+}
+
+// decodeValue decode the value of the record into v
+func decodeValue(data []byte, v interface{}) error {
+	var record logRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	return json.Unmarshal(record.Value, v)
+}
+
+func (log *appendLog) close() error {
+	if log.file == nil {
+		return nil
+	}
+	err := log.file.Sync()
+	if cerr := log.file.Close(); err == nil {
+		err = cerr
+	}
+	log.file = nil
+	return err
+}
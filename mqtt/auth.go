@@ -9,3 +9,34 @@ type NullAuth struct{}
 func (auth *NullAuth) Auth(userName string, password string) bool {
 	return true
 }
+
+// Access the kind of the request checked by the Authorizer
+type Access int
+
+const (
+	// AccessPublish publish to a topic name
+	AccessPublish Access = iota
+
+	// AccessSubscribe subscribe to a topic filter, the share name of a shared subscription is removed
+	AccessSubscribe
+)
+
+func (access Access) String() string {
+	if access == AccessSubscribe {
+		return "subscribe"
+	}
+	return "publish"
+}
+
+// Authorizer decide whether the client may publish to the topic or subscribe to the topic filter,
+// it is asked for every PUBLISH and every topic filter of SUBSCRIBE, so it should not block
+type Authorizer interface {
+	Authorize(userName string, clientID string, access Access, topic string) bool
+}
+
+// NullAuthorizer allow everything
+type NullAuthorizer struct{}
+
+func (auth *NullAuthorizer) Authorize(userName string, clientID string, access Access, topic string) bool {
+	return true
+}
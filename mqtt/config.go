@@ -3,12 +3,77 @@ package mqtt
 type ServerConfig struct {
 	Timeout int
 	Address string
+
+	// MaxPacketSize the maximum packet size the server accepts, 0 means the protocol limit
+	MaxPacketSize int
+
+	// RetryInterval seconds before an unacknowledged QoS 1 or QoS 2 message is redelivered, 0 means the default
+	RetryInterval int
+
+	// MaxInflight the maximum number of unacknowledged QoS 1 and QoS 2 messages sent to one client, 0 means the default
+	MaxInflight int
+
+	// MaxQueuedMessages and MaxQueuedBytes limit the messages queued on one session, 0 means no limit
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+
+	// QueuePolicy "drop-newest" or "drop-oldest", which message is dropped when the queue is full
+	QueuePolicy string
+
+	// SessionExpiryInterval seconds a persistent session is kept after the client disconnects,
+	// it also limits the Session Expiry Interval of MQTT 5.0 clients, 0 means never expire
+	SessionExpiryInterval int
+
+	// MaxKeepAlive the maximum keepalive seconds, a larger keepalive of MQTT 5.0 client is lowered to it
+	// and told by the Server Keep Alive of CONNACK, MQTT 3.1 and 3.1.1 clients with a larger keepalive
+	// or keepalive 0 are refused. 0 means no limit
+	MaxKeepAlive int
+
+	// DefaultKeepAlive the keepalive seconds of MQTT 5.0 clients connecting with keepalive 0, 0 turns it off
+	DefaultKeepAlive int
+
+	// SessionStore "memory" or "file", the file store keeps the persistent sessions in SessionStorePath
+	// so they are restored after the broker restarts
+	SessionStore     string
+	SessionStorePath string
+
+	// RetainedStore "memory" or "file", the file store keeps the retained messages in RetainedStorePath
+	RetainedStore     string
+	RetainedStorePath string
+
+	// SharedStrategy how the member of a shared subscription "$share/{ShareName}/{filter}" is chosen,
+	// "round-robin", "random", "sticky" (by the publishing client) or "least-inflight"
+	SharedStrategy string
+
+	// SysInterval the seconds between the updates of the retained $SYS/broker/... status topics, 0 turns them off
+	SysInterval int
+
+	// ACLFile the file of the topic access rules, see ParseACL, empty allows every client to publish
+	// and subscribe to any topic
+	ACLFile string
 }
 
 //LoadConfig load config
 func LoadConfig(fileName string) (*ServerConfig, error) {
 	return &ServerConfig{
-		Timeout: 1,
-		Address: ":8080",
+		Timeout:       1,
+		Address:       ":8080",
+		MaxPacketSize: 0,
+		RetryInterval: 20,
+		MaxInflight:   32,
+
+		MaxQueuedMessages: 1000,
+		MaxQueuedBytes:    0,
+		QueuePolicy:       "drop-newest",
+
+		SessionExpiryInterval: 0,
+		MaxKeepAlive:          0,
+		DefaultKeepAlive:      0,
+		SessionStore:          "memory",
+		SessionStorePath:      "sessions.db",
+		RetainedStore:         "memory",
+		RetainedStorePath:     "retained.db",
+		SharedStrategy:        "round-robin",
+		SysInterval:           10,
 	}, nil
 }
@@ -1,3 +1,29 @@
 package mqtt
 
-const MINI_SUPPORT_VERSION int = 0x4
+import "time"
+
+// the protocol levels accepted by the server, 3 is MQTT 3.1 (MQIsdp), 4 is MQTT 3.1.1 and 5 is MQTT 5.0
+const MINI_SUPPORT_VERSION int = 0x3
+const MAX_SUPPORT_VERSION int = 0x5
+
+// DefaultRetryInterval the unacknowledged QoS 1 and QoS 2 messages are redelivered after it
+const DefaultRetryInterval = 20 * time.Second
+
+// DefaultMaxInflight the default number of the unacknowledged QoS 1 and QoS 2 messages sent to one client
+const DefaultMaxInflight = 32
+
+// DefaultMaxQueuedMessages the default number of the messages queued on one session
+const DefaultMaxQueuedMessages = 1000
+
+// DefaultMaxOutbound the number of the messages waiting for the writer of one client besides the inflight window,
+// the QoS 0 messages are dropped when the queue is full
+const DefaultMaxOutbound = 1000
+
+// DefaultWriteTimeout the connection is closed if writing a packet to it blocks longer
+const DefaultWriteTimeout = 5 * time.Second
+
+// DefaultReapInterval the interval of checking the expired sessions
+const DefaultReapInterval = time.Minute
+
+// Version the version of the broker, published in $SYS/broker/version
+const Version = "0.1.0"
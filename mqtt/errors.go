@@ -8,4 +8,14 @@ var (
 	ErrDisconnect = errors.New("Disconnect")
 	ErrMsgFormat  = errors.New("WrongMsgFormat")
 	ErrMsgSize    = errors.New("WrongMsgSize")
+
+	// ErrPacketTooLarge the packet exceeds the maximum packet size of the server
+	ErrPacketTooLarge = errors.New("PacketTooLarge")
+
+	// ErrNotAuthorized MQTT 3.1 client subscribes to a topic filter it is not authorized to,
+	// it has no failure return code, so it is disconnected
+	ErrNotAuthorized = errors.New("NotAuthorized")
+
+	// ErrServerClosed the connection is established after the server is closed
+	ErrServerClosed = errors.New("ServerClosed")
 )
@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"github.com/golang/glog"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+)
+
+// frameKey the fields which change the encoded PUBLISH packet apart from the packet id,
+// MQTT 3.1 and 3.1.1 encode PUBLISH in the same way, only MQTT 5.0 adds the properties
+type frameKey struct {
+	v5     bool
+	qos    byte
+	retain bool
+}
+
+// frameCache encode one incoming PUBLISH at most once for each frameKey, the subscribers
+// with the same key share the frame. It is used by the goroutine processing the message only,
+// the frames are encoded before the incoming frame is released, so the message is not copied
+type frameCache struct {
+	msg    *message.PublishMessage
+	frames map[frameKey]*message.PublishFrame
+}
+
+func newFrameCache(msg *message.PublishMessage) *frameCache {
+	return &frameCache{
+		msg:    msg,
+		frames: make(map[frameKey]*message.PublishFrame, 2),
+	}
+}
+
+// get return the frame for the version and flags, the cache keeps the reference,
+// Retain it before handing it to another goroutine
+func (cache *frameCache) get(version byte, qos byte, retain bool) (*message.PublishFrame, error) {
+	key := frameKey{v5: version == message.Version5, qos: qos, retain: retain}
+	if frame, ok := cache.frames[key]; ok {
+		return frame, nil
+	}
+
+	// shallow copy, the topic, payload and properties are only read while encoding
+	out := *cache.msg
+	out.SetProtocolVersion(version)
+	out.SetDup(false)
+	out.SetRetain(retain)
+	if err := out.SetQos(qos); err != nil {
+		return nil, err
+	}
+
+	frame, err := message.NewPublishFrame(&out)
+	if err != nil {
+		return nil, err
+	}
+	cache.frames[key] = frame
+	return frame, nil
+}
+
+// release drop the references held by the cache
+func (cache *frameCache) release() {
+	for key, frame := range cache.frames {
+		frame.Release()
+		delete(cache.frames, key)
+	}
+}
+
+// convertFrame encode the message of the frame again for another protocol version, the qos, the retain
+// flag and the packet id are kept. The new frame is returned with one reference, the old one is not released
+func convertFrame(frame *message.PublishFrame, from byte, to byte) (*message.PublishFrame, error) {
+	pub := message.NewPublishMessage()
+	pub.SetProtocolVersion(from)
+	if _, err := pub.Decode(frame.Bytes()); err != nil {
+		return nil, err
+	}
+
+	frames := newFrameCache(pub)
+	defer frames.release()
+	out, err := frames.get(to, pub.Qos(), pub.IsRetain())
+	if err != nil {
+		return nil, err
+	}
+	out.Retain()
+	return out, nil
+}
+
+// deliver retain the message and publish it to the matching subscribers, the publisher is the client id
+// used by the sticky shared subscriptions, it is empty for the messages of the broker itself.
+// The qos of the outgoing message is the minimum of the incoming qos and the granted qos [MQTT-3.8.4-6]
+func deliver(topics *TopicsManager, retained RetainedStore, msg *message.PublishMessage, publisher string) error {
+	if msg.IsRetain() && retained != nil {
+		if err := retained.Retain(newRetainedMessage(msg)); err != nil {
+			glog.Errorf("(%v) failed to retain the message: %v", publisher, err)
+		}
+	}
+
+	topic := string(msg.Topic())
+	subs := topics.Route(topic, publisher)
+	if len(subs) == 0 {
+		return nil
+	}
+
+	frames := newFrameCache(msg)
+	defer frames.release()
+
+	// the messages are published by the goroutine processing the messages of the publisher one by one,
+	// each subscriber queues them for its writer, so it gets them in the order they are published
+	// [MQTT-4.6.0-6], and a slow subscriber does not block the publisher.
+	// MQTT-3.3.1-9, the retain flag is 0 when the message is sent because of an established subscription,
+	// unless MQTT 5.0 subscription asks for Retain As Published [MQTT-3.3.1-13]. Route skips the
+	// No Local subscriptions of the publisher
+	for _, sub := range subs {
+		qos := msg.Qos()
+		if sub.Qos < qos {
+			qos = sub.Qos
+		}
+		retain := sub.RetainAsPublished && msg.IsRetain()
+		frame, err := frames.get(sub.Sub.protocolVersion(), qos, retain)
+		if err != nil {
+			return err
+		}
+		sub.Sub.publish(frame, sub.Share)
+	}
+	return nil
+}
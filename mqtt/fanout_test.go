@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameCache(t *testing.T) {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("dashboards/cpu"))
+	msg.SetQos(message.QosAtLeastOnce)
+	msg.SetPacketID(7)
+	msg.SetRetain(true)
+	msg.SetPayload([]byte("42"))
+
+	cache := newFrameCache(msg)
+	f1, err := cache.get(message.Version311, msg.Qos(), false)
+	assert.NoError(t, err, "should not have error in encoding")
+	f2, _ := cache.get(message.Version31, msg.Qos(), false)
+	assert.True(t, f1 == f2, "MQTT 3.1 and 3.1.1 should share the frame")
+
+	f5, _ := cache.get(message.Version5, msg.Qos(), false)
+	assert.False(t, f1 == f5, "MQTT 5.0 should have its own frame")
+	assert.Equal(t, f1.Len()+1, f5.Len(), "MQTT 5.0 frame has the property length")
+
+	out, err := message.NewVersionMessage(f1.Bytes(), message.Version311)
+	assert.NoError(t, err, "shared frame should be a valid message")
+	pub := out.(*message.PublishMessage)
+	assert.False(t, pub.IsRetain(), "retain flag should be cleared")
+	assert.Equal(t, uint16(7), pub.PacketID())
+	assert.True(t, msg.IsRetain(), "incoming message should not be modified")
+
+	cache.release()
+	assert.Nil(t, f1.Bytes(), "frames should be released with the cache")
+}
+
+func TestDeliverSubscriptionOptions(t *testing.T) {
+	topics := NewTopicManager()
+	own := &chanSub{frames: make(chan []byte, 1)}
+	other := &chanSub{frames: make(chan []byte, 1)}
+	topics.Register("sport/#", "c1", message.QosAtMostOnce|subNoLocal, own)
+	topics.Register("sport/#", "c2", message.QosAtMostOnce|subRetainAsPublished, other)
+	assert.Equal(t, map[string]byte{"sport/#": subNoLocal}, topics.Subscriptions("c1"))
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetRetain(true)
+	msg.SetPayload([]byte("42"))
+	assert.NoError(t, deliver(topics, nil, msg, "c1"))
+	assert.Len(t, own.frames, 0, "No Local subscription should not get the own message")
+	out := message.NewPublishMessage()
+	_, err := out.Decode(<-other.frames)
+	assert.NoError(t, err)
+	assert.True(t, out.IsRetain(), "the retain flag should be kept for Retain As Published")
+
+	// another subscription of the publisher without No Local gets the message
+	topics.Register("sport/tennis", "c1", message.QosAtMostOnce, own)
+	assert.NoError(t, deliver(topics, nil, msg, "c1"))
+	assert.Len(t, own.frames, 1)
+	<-other.frames
+}
@@ -0,0 +1,156 @@
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// the remaining length is encoded with at most 4 bytes, so the maximum packet size is
+// 1 byte control flag + 4 bytes remaining length + 268435455 bytes
+const MaxPacketSize = 1 + 4 + 268435455
+
+const (
+	// size of bufio reader, it is large enough to hold the fixed header of most packets
+	frameReaderSize = 4096
+
+	// initial capacity of the pooled frame buffer
+	defaultFrameSize = 512
+
+	// the buffers larger than this are not put back into the pool,
+	// so one large message does not keep a large buffer forever
+	maxPooledFrameSize = 64 * 1024
+)
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return &Frame{buf: make([]byte, 0, defaultFrameSize)}
+	},
+}
+
+// Frame a complete MQTT control packet read from the connection, contains the fixed header.
+// The buffer is pooled, it must not be used after Release
+type Frame struct {
+	buf []byte
+}
+
+func getFrame(size int) *Frame {
+	frame := framePool.Get().(*Frame)
+	if cap(frame.buf) < size {
+		frame.buf = make([]byte, size)
+	}
+	frame.buf = frame.buf[:size]
+	return frame
+}
+
+// Bytes the bytes of the packet
+func (frame *Frame) Bytes() []byte {
+	return frame.buf
+}
+
+// Release put the buffer back into the pool
+func (frame *Frame) Release() {
+	if frame == nil || cap(frame.buf) > maxPooledFrameSize {
+		return
+	}
+	frame.buf = frame.buf[:0]
+	framePool.Put(frame)
+}
+
+// FrameReader read MQTT frames from the connection through a buffered reader,
+// so the fixed header is parsed without one syscall per byte.
+// The fixed header is only consumed when it is complete, and a partially read packet is kept
+// between calls, so a read timeout in the middle of a packet does not break the stream
+type FrameReader struct {
+	conn          *timeoutReader
+	reader        *bufio.Reader
+	maxPacketSize int
+
+	// the packet being read, and the number of bytes already read
+	pending *Frame
+	offset  int
+}
+
+// NewFrameReader create frame reader, maxPacketSize <= 0 means the protocol limit
+func NewFrameReader(conn netReader, maxPacketSize int) *FrameReader {
+	if maxPacketSize <= 0 || maxPacketSize > MaxPacketSize {
+		maxPacketSize = MaxPacketSize
+	}
+	r := &timeoutReader{conn: conn}
+	return &FrameReader{
+		conn:          r,
+		reader:        bufio.NewReaderSize(r, frameReaderSize),
+		maxPacketSize: maxPacketSize,
+	}
+}
+
+// SetReadTimeout set the deadline of each read from the connection, 0 means no deadline
+func (r *FrameReader) SetReadTimeout(d time.Duration) {
+	r.conn.d = d
+}
+
+// ReadFrame read the next complete packet
+func (r *FrameReader) ReadFrame() (*Frame, error) {
+	if r.pending == nil {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	frame := r.pending
+	for r.offset < len(frame.buf) {
+		n, err := r.reader.Read(frame.buf[r.offset:])
+		r.offset += n
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.pending, r.offset = nil, 0
+	return frame, nil
+}
+
+// readHeader parse the fixed header and allocate the frame for the whole packet
+// Check the remlen byte (1+) to see if the continuation bit is set.
+// 1 0 (0x00) 127 (0x7F)
+// 2 128 (0x80, 0x01) 16383 (0xFF, 0x7F)
+// 3 16384 (0x80, 0x80, 0x01) 2097151 (0xFF, 0xFF, 0x7F)
+// 4 2097152 (0x80, 0x80, 0x80, 0x01) 268435455 (0xFF, 0xFF, 0xFF, 0x7F)
+func (r *FrameReader) readHeader() error {
+	var remainLen, multiplier uint32 = 0, 1
+	headerLen := 0
+
+	for i := 1; headerLen == 0; i++ {
+		if i > 4 {
+			return ErrMsgFormat
+		}
+
+		header, err := r.reader.Peek(i + 1)
+		if err != nil {
+			return err
+		}
+
+		b := header[i]
+		remainLen += uint32(b&127) * multiplier
+		multiplier *= 128
+		if b&128 == 0 {
+			headerLen = i + 1
+		}
+	}
+
+	total := headerLen + int(remainLen)
+	if total > r.maxPacketSize {
+		return ErrPacketTooLarge
+	}
+
+	frame := getFrame(total)
+	n, err := io.ReadFull(r.reader, frame.buf[:headerLen])
+	if err != nil {
+		frame.Release()
+		return err
+	}
+
+	r.pending, r.offset = frame, n
+	return nil
+}
@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameReader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// the remaining length needs 2 bytes
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetPayload(make([]byte, 300))
+	buf := make([]byte, msg.Len())
+	msg.Encode(buf)
+
+	ping := []byte{0xc0, 0x00}
+
+	go func() {
+		client.Write(buf[:3])
+		time.Sleep(50 * time.Millisecond)
+		client.Write(buf[3:])
+		client.Write(ping)
+	}()
+
+	reader := NewFrameReader(server, 0)
+
+	// timeout in the middle of the packet, the partial packet is kept
+	reader.SetReadTimeout(20 * time.Millisecond)
+	_, err := reader.ReadFrame()
+	assert.True(t, IsTimeoutError(err), "should be timeout error")
+
+	reader.SetReadTimeout(time.Second)
+	frame, err := reader.ReadFrame()
+	assert.NoError(t, err, "should read the whole packet")
+	assert.Equal(t, frame.Bytes(), buf, "packet should be equal")
+	frame.Release()
+
+	frame, err = reader.ReadFrame()
+	assert.NoError(t, err, "should read ping packet")
+	assert.Equal(t, frame.Bytes(), ping, "packet should be equal")
+	frame.Release()
+}
+
+func TestFrameReaderMaxPacketSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte{0x30, 0x81, 0x01})
+
+	reader := NewFrameReader(server, 100)
+	reader.SetReadTimeout(time.Second)
+	_, err := reader.ReadFrame()
+	assert.Equal(t, err, ErrPacketTooLarge, "packet is larger than the limit")
+
+	go client.Write([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	reader = NewFrameReader(server, 0)
+	reader.SetReadTimeout(time.Second)
+	_, err = reader.ReadFrame()
+	assert.Equal(t, err, ErrMsgFormat, "remaining length has more than 4 bytes")
+}
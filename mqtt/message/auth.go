@@ -0,0 +1,35 @@
+package message
+
+// An AUTH packet is sent from Client to Server or Server to Client as part of an extended
+// authentication exchange, such as challenge / response authentication. It is only used in MQTT 5.0.
+// Variable header:
+//       Authenticate Reason Code: 1
+//       Properties, Authentication Method and Authentication Data are carried here
+// The Reason Code and Property Length can be omitted if the Reason Code is 0x00 (Success)
+// and there are no Properties. In this case the AUTH has a Remaining Length of 0.
+
+// AuthMessage struct for auth message
+type AuthMessage struct {
+	reasonMessage
+}
+
+// NewAuthMessage create new auth message
+func NewAuthMessage() *AuthMessage {
+	msg := &AuthMessage{}
+	msg.SetMessageType(AUTH)
+	msg.SetProtocolVersion(Version5)
+	return msg
+}
+
+// Verify verify message
+// It is a Protocol Error to send an AUTH packet with the Reason Code other than 0x00
+// without the Authentication Method
+func (msg *AuthMessage) Verify() error {
+	if err := msg.reasonMessage.Verify(); err != nil {
+		return err
+	}
+	if _, ok := msg.props.Data(PropAuthenticationMethod); !ok && msg.remainLen > 0 {
+		return ReasonProtocolError
+	}
+	return nil
+}
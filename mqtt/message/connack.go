@@ -6,11 +6,16 @@ import "errors"
 // variable header is separated into two parts:
 // Connect Acknowledge Flags 1
 // Connect Return code 1
+// Properties, only in MQTT 5.0, the return code is called Connect Reason Code in MQTT 5.0
 //
 
+// ConnAckCode the connect return code, it also implements error so the failure of
+// verifying connect message can be replied to the client directly
+type ConnAckCode byte
+
 const (
 	//ConnAccepted successful build connection
-	ConnAccepted = iota
+	ConnAccepted ConnAckCode = iota
 
 	//UnAcceptableVersion 0x01 Connection Refused, unacceptable protocol version
 	UnAcceptableVersion
@@ -24,18 +29,36 @@ const (
 	//WrongUserNameOrPass 0x04 Connection Refused, bad user name or password
 	WrongUserNameOrPass
 
-	//NotAuthorized 0x04 Connection Refused, bad user name or password
+	//NotAuthorized 0x05 Connection Refused, not authorized
 	NotAuthorized
 
 	// Reserved for future use
 	Reserved
 )
 
+var connAckCodeDesc = []string{
+	"Connection Accepted",
+	"Connection Refused, unacceptable protocol version",
+	"Connection Refused, identifier rejected",
+	"Connection Refused, Server unavailable",
+	"Connection Refused, bad user name or password",
+	"Connection Refused, not authorized",
+}
+
+// Error description of the return code
+func (code ConnAckCode) Error() string {
+	if code < Reserved {
+		return connAckCodeDesc[code]
+	}
+	return "Reserved for future use"
+}
+
 //ConnAckMessage connection ack
 type ConnAckMessage struct {
 	FixedHeader
 	flag    byte
 	retCode byte
+	props   Properties
 }
 
 // NewConnAckMessage create new conn message
@@ -58,56 +81,107 @@ func (ack *ConnAckMessage) SetSessionPresent(v bool) {
 	}
 }
 
+// ReturnCode return the connect return code
+func (ack *ConnAckMessage) ReturnCode() ConnAckCode {
+	return ConnAckCode(ack.retCode)
+}
+
+// SetReturnCode set the connect return code, it is translated into reason code for MQTT 5.0,
+// so the protocol version must be set before
+func (ack *ConnAckMessage) SetReturnCode(code ConnAckCode) {
+	if ack.isV5() {
+		ack.retCode = byte(code.ReasonCode())
+		return
+	}
+	ack.retCode = byte(code)
+}
+
+// ReasonCode return the MQTT 5.0 connect reason code
+func (ack *ConnAckMessage) ReasonCode() ReasonCode {
+	return ReasonCode(ack.retCode)
+}
+
+// SetReasonCode set the MQTT 5.0 connect reason code
+func (ack *ConnAckMessage) SetReasonCode(code ReasonCode) {
+	ack.retCode = byte(code)
+}
+
+// Properties return the MQTT 5.0 connack properties
+func (ack *ConnAckMessage) Properties() *Properties {
+	return &ack.props
+}
+
+// Len total message length
+func (ack *ConnAckMessage) Len() int {
+	return ack.MessageLen()
+}
+
 func (ack *ConnAckMessage) MessageLen() int {
 	bodyLen := 2
+	if ack.isV5() {
+		bodyLen += ack.props.Len()
+	}
 	ack.SetRemainLen(uint32(bodyLen))
 	msgLen := bodyLen + ack.headerLen()
 	return msgLen
 }
 
-func (ack *ConnAckMessage) Encode(buf []byte) (int, error) {
-
-	msgLen := ack.MessageLen()
-	if len(buf) < msgLen {
-		return 0, errors.New("wrong buffer size ")
-	}
+// Encode encode connack message into network bytes
+func (ack *ConnAckMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, ack.MessageLen())
+	ack.writeHeader(b)
 
-	index := 0
-	l, err := ack.encodeHeader(buf[index:])
-	if err != nil {
-		return 0, err
+	// the first byte is reserved in MQTT 3.1, there is no session present flag
+	if ack.version == Version31 {
+		b.putByte(0)
+	} else {
+		b.putByte(ack.flag)
 	}
-
-	index += l
-	l, err = ack.encodeMsg(buf[index:])
-	if err != nil {
-		return index, err
+	b.putByte(ack.retCode)
+	if ack.isV5() {
+		ack.props.write(b)
 	}
-	index += l
-	return index, nil
-}
-
-func (ack *ConnAckMessage) encodeMsg(buf []byte) (int, error) {
-	buf[0] = ack.flag
-	buf[1] = ack.retCode
-	return 2, nil
+	return b.pos, b.err
 }
 
+// Decode decode connack message
 func (ack *ConnAckMessage) Decode(buf []byte) (int, error) {
-	index := 0
-	l, err := ack.decodeHeader(buf)
-	if err != nil {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := ack.readHeader(b); err != nil {
 		return 0, err
 	}
-	index += l
-	if len(buf[index:]) < int(ack.remainLen) {
-		return index, errors.New("Invalid message: not have enough space to parse")
+
+	ack.flag = b.getByte()
+	ack.retCode = b.getByte()
+	ack.props.Reset()
+	if ack.isV5() {
+		ack.props.read(b)
 	}
-	ack.flag = buf[index]
-	index += 1
-	ack.retCode = buf[index]
-	return index, nil
+	return b.pos, b.err
 }
+
+// Verify verify message
+// Byte 1 is the "Connect Acknowledge Flags". Bits 7-1 are reserved and MUST be set to 0.
+// If a server sends a CONNACK packet containing a non-zero return code it MUST set Session Present to 0 [MQTT-3.2.2-4].
 func (ack *ConnAckMessage) Verify() error {
+	if err := ack.verifyFlag(); err != nil {
+		return err
+	}
+	if ack.flag&0xfe != 0 {
+		return ErrorReservedFlag
+	}
+	if ack.isV5() {
+		if err := verifyReasonCode(CONNACK, ack.ReasonCode()); err != nil {
+			return err
+		}
+		if err := ack.props.verify(CONNACK); err != nil {
+			return err
+		}
+	} else if ack.retCode >= byte(Reserved) {
+		return errors.New("invalid connect return code")
+	}
+	if ack.retCode != byte(ConnAccepted) && ack.IsSessionPresent() {
+		return errors.New("session present must be 0 for refused connection")
+	}
 	return nil
 }
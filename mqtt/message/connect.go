@@ -19,7 +19,10 @@ import (
 // Keep Alive:8-9
 //       Keep Alive MSB: 9
 //       Keep Alive LSB: 10
+// Properties: only in MQTT 5.0
 // Protocol Name: mqtt
+// Payload:
+//       Client Identifier, Will Properties (MQTT 5.0), Will Topic, Will Message, User Name, Password
 
 // ConnMessage struct for connect message
 type ConnMessage struct {
@@ -29,7 +32,9 @@ type ConnMessage struct {
 	ConnectFlag byte
 	KeepAlive   uint16
 
+	props       Properties
 	clientID    []byte
+	willProps   Properties
 	WillTopic   []byte
 	WillMessage []byte
 	UserName    []byte
@@ -40,7 +45,7 @@ type ConnMessage struct {
 func NewConnMessage() *ConnMessage {
 	conn := &ConnMessage{}
 	conn.SetMessageType(CONNECT)
-	conn.ProtoName = []byte("MQTT")
+	conn.ProtoName = []byte(ProtoName)
 	conn.ProtoLevel = 0x4
 
 	return conn
@@ -48,84 +53,36 @@ func NewConnMessage() *ConnMessage {
 
 // Encode encode connect message into network bytes
 func (msg *ConnMessage) Encode(dst []byte) (int, error) {
-	n, index := 0, 0
-	msgLen := msg.msgLen()
-	msg.remainLen = uint32(msgLen)
-	totalLen := msg.headerLen() + msgLen
-	if len(dst) < totalLen {
-		return 0, errors.New("not enough space to store message")
-	}
-
-	n, err := msg.encodeHeader(dst[index:])
-	if err != nil {
-		return index, err
-	}
-	index += n
-
-	n, err = msg.encodeMsg(dst[index:])
-	if err != nil {
-		return index, err
-	}
-	index += n
-	return index, nil
-
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	msg.encodeMsg(b)
+	return b.pos, b.err
 }
 
-func (msg *ConnMessage) encodeMsg(dest []byte) (int, error) {
-	n, index := 0, 0
-	n, err := writeLPBytes(dest[index:], msg.ProtoName)
-	if err != nil {
-		return index, err
-	}
-	index += n
-
-	dest[index] = msg.ProtoLevel
-	index++
-
-	dest[index] = msg.ConnectFlag
-	index++
-
-	writeUint16(dest[index:], msg.KeepAlive)
-	index += 2
-
-	//write client id
-	n, err = writeLPBytes(dest[index:], msg.clientID)
-	if err != nil {
-		return index, err
+// encodeMsg write the variable header and payload
+func (msg *ConnMessage) encodeMsg(b *Buffer) {
+	b.putLPBytes(msg.ProtoName)
+	b.putByte(msg.ProtoLevel)
+	b.putByte(msg.ConnectFlag)
+	b.putUint16(msg.KeepAlive)
+	if msg.isV5() {
+		msg.props.write(b)
 	}
-	index += n
 
+	b.putLPBytes(msg.clientID)
 	if msg.IsWill() {
-		n, err := writeLPBytes(dest[index:], msg.WillTopic)
-		if err != nil {
-			return index, err
-		}
-		index += n
-
-		n, err = writeLPBytes(dest[index:], msg.WillMessage)
-		if err != nil {
-			return index, err
+		if msg.isV5() {
+			msg.willProps.write(b)
 		}
-		index += n
+		b.putLPBytes(msg.WillTopic)
+		b.putLPBytes(msg.WillMessage)
 	}
-
 	if msg.IsUserFlag() {
-		n, err := writeLPBytes(dest[index:], msg.UserName)
-		if err != nil {
-			return index, err
-		}
-		index += n
+		b.putLPBytes(msg.UserName)
 	}
-
 	if msg.IsPasswordFlag() {
-		n, err = writeLPBytes(dest[index:], msg.PassWord)
-		if err != nil {
-			return index, err
-		}
-		index += n
+		b.putLPBytes(msg.PassWord)
 	}
-
-	return index, nil
 }
 
 // msgLen message length contain:
@@ -134,7 +91,10 @@ func (msg *ConnMessage) encodeMsg(dest []byte) (int, error) {
 func (msg *ConnMessage) msgLen() int {
 
 	// msg length for fixed part
-	msgLen := 10
+	msgLen := 6 + len(msg.ProtoName)
+	if msg.isV5() {
+		msgLen += msg.props.Len()
+	}
 	// client id
 	msgLen += 2
 	if msg.clientID != nil {
@@ -143,6 +103,9 @@ func (msg *ConnMessage) msgLen() int {
 
 	//will topic
 	if msg.IsWill() {
+		if msg.isV5() {
+			msgLen += msg.willProps.Len()
+		}
 		msgLen += 2
 		msgLen += len(msg.WillTopic)
 
@@ -163,94 +126,174 @@ func (msg *ConnMessage) msgLen() int {
 	return msgLen
 }
 
+// Len total message length
+func (msg *ConnMessage) Len() int {
+	msg.remainLen = uint32(msg.msgLen())
+	return msg.headerLen() + int(msg.remainLen)
+}
+
 // Verify verify message
-//
+// the errors which the spec requires to be answered with a CONNACK are returned as ConnAckCode,
+// for the others the server MUST close the network connection without sending a CONNACK
 func (msg *ConnMessage) Verify() error {
-	return errors.New("not implement")
-}
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
 
-// Version ConnectMessage version
-func (msg *ConnMessage) Version() byte {
-	return msg.ProtoLevel
-}
+	// If the protocol name is incorrect the Server MAY disconnect the Client [MQTT-3.1.2-1],
+	// MQTT 3.1 uses the protocol name MQIsdp with level 3
+	switch string(msg.ProtoName) {
+	case ProtoName:
+		// The Server MUST respond to the CONNECT Packet with a CONNACK return code 0x01
+		// if the Protocol Level is not supported by the Server [MQTT-3.1.2-2]
+		if msg.ProtoLevel != Version311 && msg.ProtoLevel != Version5 {
+			return UnAcceptableVersion
+		}
+	case ProtoNameV31:
+		if msg.ProtoLevel != Version31 {
+			return UnAcceptableVersion
+		}
+	default:
+		return errors.New("invalid protocol name")
+	}
 
-// Decode decode connect message
-func (msg *ConnMessage) Decode(buf []byte) (int, error) {
-	index := 0
-	n, err := msg.decodeHeader(buf)
-	if err != nil {
-		return 0, err
+	// The Server MUST validate that the reserved flag in the CONNECT Control Packet is set to zero
+	// and disconnect the Client if it is not zero [MQTT-3.1.2-3]
+	if msg.ConnectFlag&0x1 != 0 {
+		return ErrorReservedFlag
 	}
-	index += n
 
-	if msg.remainLen > uint32(len(buf[index:])) {
-		return 0, errors.New("wrong message content to decode")
+	if msg.IsWill() {
+		// If the Will Flag is set to 1, the value of Will QoS can be 0, 1 or 2.
+		// It MUST NOT be 3 [MQTT-3.1.2-14]
+		if msg.Qos() > QosExactlyOnce {
+			return ErrorInvalidQos
+		}
+		// the Will Topic is published to, so it is a topic name without wildcards [MQTT-3.1.3-10]
+		if err := ValidTopicName(msg.WillTopic); err != nil {
+			return err
+		}
+	} else if msg.Qos() != QosAtMostOnce || msg.IsWillRetain() {
+		// If the Will Flag is set to 0, then the Will QoS MUST be set to 0 [MQTT-3.1.2-13]
+		// and the Will Retain Flag MUST be set to 0 [MQTT-3.1.2-15]
+		return errors.New("will qos and will retain must be 0 without will flag")
 	}
-	n, err = msg.decodeMsg(buf[index:])
-	if err != nil {
-		return index, err
+
+	// If the User Name Flag is set to 0, the Password Flag MUST be set to 0 [MQTT-3.1.2-22],
+	// MQTT 5.0 allows a Password without a User Name
+	if !msg.isV5() && !msg.IsUserFlag() && msg.IsPasswordFlag() {
+		return errors.New("password flag is set without user name flag")
 	}
-	index += n
-	return index, nil
+
+	if msg.isV5() {
+		if err := msg.props.verify(CONNECT); err != nil {
+			return err
+		}
+		if err := msg.willProps.verify(willProperties); err != nil {
+			return err
+		}
+		// MQTT 5.0 allows a zero-byte ClientId with Clean Start set to 0, the server assigns one
+		if len(msg.clientID) > 0 && !msg.IsValidClientID(msg.clientID) {
+			return IdentifierRejected
+		}
+		return nil
+	}
+
+	// MQTT 3.1 client identifier must be between 1 and 23 characters long,
+	// otherwise the server responds with return code 0x02
+	if msg.ProtoLevel == Version31 {
+		if len(msg.clientID) == 0 || !msg.IsValidClientID(msg.clientID) {
+			return IdentifierRejected
+		}
+		return nil
+	}
+
+	// If the Client supplies a zero-byte ClientId with CleanSession set to 0, the Server
+	// MUST respond to the CONNECT Packet with a CONNACK return code 0x02 [MQTT-3.1.3-8].
+	// If the Server rejects the ClientId it MUST respond with return code 0x02 [MQTT-3.1.3-9]
+	if len(msg.clientID) == 0 {
+		if !msg.IsCleanSession() {
+			return IdentifierRejected
+		}
+	} else if !msg.IsValidClientID(msg.clientID) {
+		return IdentifierRejected
+	}
+
+	return nil
 }
 
-// decodeMsg decode the connection message
-// we have verify
-func (msg *ConnMessage) decodeMsg(buf []byte) (int, error) {
-	var err error
-	index, n := 0, 0
-	msg.ProtoName, n, err = readLPBytes(buf[index:])
-	if err != nil {
-		return n, err
+// Version ConnectMessage version
+func (msg *ConnMessage) Version() byte {
+	return msg.ProtoLevel
+}
+
+// SetVersion set the protocol level, the message is encoded with the format of the version,
+// the protocol name is MQIsdp for MQTT 3.1 and MQTT for others
+func (msg *ConnMessage) SetVersion(v byte) {
+	msg.ProtoLevel = v
+	msg.SetProtocolVersion(v)
+	if v == Version31 {
+		msg.ProtoName = []byte(ProtoNameV31)
+	} else {
+		msg.ProtoName = []byte(ProtoName)
 	}
+}
 
-	index += n
+// isV5 the CONNECT message carries its own protocol level
+func (msg *ConnMessage) isV5() bool {
+	return msg.ProtoLevel >= Version5
+}
 
-	msg.ProtoLevel = buf[index]
-	index++
+// Properties return the MQTT 5.0 connect properties
+func (msg *ConnMessage) Properties() *Properties {
+	return &msg.props
+}
 
-	msg.ConnectFlag = buf[index]
-	index++
+// WillProperties return the MQTT 5.0 will properties
+func (msg *ConnMessage) WillProperties() *Properties {
+	return &msg.willProps
+}
 
-	msg.KeepAlive = readUint16(buf[index:])
-	index += 2
+// Decode decode connect message
+func (msg *ConnMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+	msg.decodeMsg(b)
+	return b.pos, b.err
+}
 
-	msg.clientID, n, err = readLPBytes(buf[index:])
-	if err != nil {
-		return index, err
+// decodeMsg decode the connection message, the protocol level is read before the
+// properties, so the properties are only decoded for MQTT 5.0
+func (msg *ConnMessage) decodeMsg(b *Buffer) {
+	msg.ProtoName = b.getLPBytes()
+	msg.ProtoLevel = b.getByte()
+	msg.SetProtocolVersion(msg.ProtoLevel)
+	msg.ConnectFlag = b.getByte()
+	msg.KeepAlive = b.getUint16()
+
+	msg.props.Reset()
+	if msg.isV5() {
+		msg.props.read(b)
 	}
-	index += n
 
-	if msg.IsWill() {
-		msg.WillTopic, n, err = readLPBytes(buf[index:])
-		if err != nil {
-			return index, err
-		}
-		index += n
+	msg.clientID = b.getLPBytes()
 
-		msg.WillMessage, n, err = readLPBytes(buf[index:])
-		if err != nil {
-			return index, err
+	msg.willProps.Reset()
+	if msg.IsWill() {
+		if msg.isV5() {
+			msg.willProps.read(b)
 		}
-		index += n
+		msg.WillTopic = b.getLPBytes()
+		msg.WillMessage = b.getLPBytes()
 	}
-
 	if msg.IsUserFlag() {
-		msg.UserName, n, err = readLPBytes(buf[index:])
-		if err != nil {
-			return index, err
-		}
-		index += n
+		msg.UserName = b.getLPBytes()
 	}
-
 	if msg.IsPasswordFlag() {
-		msg.PassWord, n, err = readLPBytes(buf[index:])
-		if err != nil {
-			return index, err
-		}
-		index += n
+		msg.PassWord = b.getLPBytes()
 	}
-	return index, nil
 }
 
 // IsUserFlag whether the user flag is set
@@ -326,9 +369,9 @@ func (msg *ConnMessage) Qos() byte {
 //
 func (msg *ConnMessage) SetQos(qos byte) error {
 	if qos < QosAtMostOnce || qos > QosExactlyOnce {
-		return errors.New("Invalid Qos Level")
+		return ErrorInvalidQos
 	}
-	msg.ConnectFlag |= qos<<3 | (msg.ConnectFlag & 0xe7)
+	msg.ConnectFlag = qos<<3 | (msg.ConnectFlag & 0xe7)
 	return nil
 }
 
@@ -362,15 +405,21 @@ func (msg *ConnMessage) SetCleanSession(v bool) {
 
 // IsValidClientID verify the client id format
 // The ClientId MUST be a UTF-8 encoded string as defined in Section 1.5.3 [MQTT-3.1.3-4].
+// MQTT 3.1 does not restrict the characters, but the length must not exceed 23
 func (msg *ConnMessage) IsValidClientID(clientId []byte) bool {
 
-	if msg.Version() <= 0x3 {
-		return true
+	if msg.Version() <= Version31 {
+		return len(clientId) <= MaxClientIDLenV31
 	}
 
 	return ClientIdPattern.Match(clientId)
 }
 
+// ClientID return the client identifier
+func (msg *ConnMessage) ClientID() []byte {
+	return msg.clientID
+}
+
 // SetClientID set client and verify whether the clientid is right format
 func (msg *ConnMessage) SetClientID(clientId []byte) error {
 
@@ -381,9 +430,7 @@ func (msg *ConnMessage) SetClientID(clientId []byte) error {
 		return errors.New("error inject client id")
 	}
 
-	if msg.clientID == nil {
-		msg.clientID = make([]byte, len(clientId))
-	}
+	msg.clientID = make([]byte, len(clientId))
 	copy(msg.clientID, clientId)
 	return nil
 }
@@ -56,3 +56,70 @@ func TestConnectMessageEncoding(t *testing.T) {
 	assert.NoError(t, err, "should not return error")
 	assert.Equal(t, encodeLen, decodeLen, "message should be equal")
 }
+
+func TestConnectMessageVerify(t *testing.T) {
+	conn := NewConnMessage()
+	conn.SetClientID([]byte("surgemq"))
+	assert.NoError(t, conn.Verify(), "valid connect message")
+
+	conn.ProtoLevel = 0x6
+	assert.Equal(t, conn.Verify(), UnAcceptableVersion, "unsupported protocol level")
+	conn.ProtoLevel = 0x4
+
+	conn.ConnectFlag |= 0x1
+	assert.Equal(t, conn.Verify(), ErrorReservedFlag, "reserved flag must be 0")
+	conn.ConnectFlag &= 0xfe
+
+	conn.SetWillRetain(true)
+	assert.Error(t, conn.Verify(), "will retain without will flag")
+	conn.SetWill(true)
+	conn.WillTopic = []byte("will/+")
+	assert.Equal(t, ErrorInvalidTopic, conn.Verify(), "will topic must not contain wildcards")
+	conn.WillTopic = []byte("will")
+	assert.NoError(t, conn.Verify(), "will retain with will flag")
+
+	conn.SetPasswordFlag(true)
+	assert.Error(t, conn.Verify(), "password without user name")
+	conn.SetUserFlag(true)
+	assert.NoError(t, conn.Verify(), "password with user name")
+
+	conn.SetClientID([]byte{})
+	assert.Equal(t, conn.Verify(), IdentifierRejected, "empty client id requires clean session")
+	conn.SetCleanSession(true)
+	assert.NoError(t, conn.Verify(), "empty client id with clean session")
+}
+
+func TestConnectMessageVersion31(t *testing.T) {
+	conn := NewConnMessage()
+	conn.SetVersion(Version31)
+	assert.Equal(t, conn.ProtoName, []byte("MQIsdp"), "protocol name should be MQIsdp")
+
+	assert.Equal(t, conn.Verify(), IdentifierRejected, "client id is required in 3.1")
+
+	assert.NoError(t, conn.SetClientID([]byte("gateway/01:field")), "3.1 does not restrict characters")
+	assert.NoError(t, conn.Verify(), "valid 3.1 connect message")
+
+	assert.Error(t, conn.SetClientID([]byte("012345678901234567890123")), "24 bytes client id")
+	conn.clientID = []byte("012345678901234567890123")
+	assert.Equal(t, conn.Verify(), IdentifierRejected, "client id longer than 23 bytes")
+
+	conn.SetClientID([]byte("gateway"))
+	buf := make([]byte, conn.Len())
+	_, err := conn.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	conn2 := &ConnMessage{}
+	_, err = conn2.Decode(buf)
+	assert.NoError(t, err, "should not return error")
+	assert.NoError(t, conn2.Verify(), "decoded 3.1 message should be valid")
+
+	conn2.ProtoLevel = Version311
+	assert.Equal(t, conn2.Verify(), UnAcceptableVersion, "MQIsdp must be level 3")
+
+	// 3.1 suback has no failure return code
+	ack := NewSubAckMessage()
+	ack.SetProtocolVersion(Version31)
+	ack.SetPacketID(1)
+	ack.AddReturnCode(QosFailure)
+	assert.Error(t, ack.Verify(), "3.1 suback has no failure return code")
+}
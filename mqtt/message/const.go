@@ -18,7 +18,35 @@ const (
 	PINGREQ
 	PINGRESP
 	DISCONNECT
-	RESERVED2
+	// AUTH is only used by MQTT 5.0, it is reserved in 3.1.1
+	AUTH
+)
+
+// RESERVED2 the message type 15 is reserved before MQTT 5.0
+const RESERVED2 = AUTH
+
+// protocol level carried by the CONNECT message
+const (
+	// Version31 MQTT 3.1, protocol name is MQIsdp
+	Version31 byte = 0x3
+
+	// Version311 MQTT 3.1.1
+	Version311 byte = 0x4
+
+	// Version5 MQTT 5.0
+	Version5 byte = 0x5
+)
+
+// protocol name carried by the CONNECT message
+const (
+	// ProtoNameV31 protocol name of MQTT 3.1
+	ProtoNameV31 = "MQIsdp"
+
+	// ProtoName protocol name since MQTT 3.1.1
+	ProtoName = "MQTT"
+
+	// MaxClientIDLenV31 MQTT 3.1 client identifier must be 1 to 23 characters
+	MaxClientIDLenV31 = 23
 )
 
 const (
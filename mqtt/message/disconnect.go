@@ -0,0 +1,114 @@
+package message
+
+// The DISCONNECT Packet is the final Control Packet sent from the Client to the Server.
+// It indicates that the Client is disconnecting cleanly, the Server MUST discard
+// any Will Message associated with the current connection without publishing it
+// In MQTT 5.0 the DISCONNECT Packet can be sent by the Server too, it carries:
+// Variable header:
+//       Disconnect Reason Code: 1
+//       Properties
+// The Reason Code and Property Length can be omitted if the Reason Code is 0x00 and there are
+// no Properties. In this case the DISCONNECT has a Remaining Length of 0.
+
+// reasonMessage basic struct for the messages only carry reason code and properties
+type reasonMessage struct {
+	FixedHeader
+	reasonCode ReasonCode
+	props      Properties
+}
+
+// ReasonCode return the MQTT 5.0 reason code
+func (msg *reasonMessage) ReasonCode() ReasonCode {
+	return msg.reasonCode
+}
+
+// SetReasonCode set the MQTT 5.0 reason code
+func (msg *reasonMessage) SetReasonCode(code ReasonCode) {
+	msg.reasonCode = code
+}
+
+// Properties return the MQTT 5.0 properties
+func (msg *reasonMessage) Properties() *Properties {
+	return &msg.props
+}
+
+func (msg *reasonMessage) msgLen() int {
+	if !msg.isV5() || (msg.reasonCode == ReasonSuccess && msg.props.Empty()) {
+		return 0
+	}
+	if msg.props.Empty() {
+		return 1
+	}
+	return 1 + msg.props.Len()
+}
+
+// Len total message length
+func (msg *reasonMessage) Len() int {
+	msg.SetRemainLen(uint32(msg.msgLen()))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode message into network bytes
+func (msg *reasonMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	if msg.remainLen > 0 {
+		b.putByte(byte(msg.reasonCode))
+	}
+	if msg.remainLen > 1 {
+		msg.props.write(b)
+	}
+	return b.pos, b.err
+}
+
+// Decode decode message
+func (msg *reasonMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.reasonCode = ReasonSuccess
+	msg.props.Reset()
+	if !msg.isV5() {
+		b.getRest()
+		return b.pos, b.err
+	}
+
+	if b.Remain() > 0 {
+		msg.reasonCode = ReasonCode(b.getByte())
+	}
+	if b.Remain() > 0 {
+		msg.props.read(b)
+	}
+	return b.pos, b.err
+}
+
+// Verify verify message
+func (msg *reasonMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if !msg.isV5() {
+		if msg.remainLen != 0 {
+			return ErrorMalformed
+		}
+		return nil
+	}
+	if err := verifyReasonCode(msg.MessageType(), msg.reasonCode); err != nil {
+		return err
+	}
+	return msg.props.verify(msg.MessageType())
+}
+
+// DisconnectMessage struct for disconnect message
+type DisconnectMessage struct {
+	reasonMessage
+}
+
+// NewDisconnectMessage create new disconnect message
+func NewDisconnectMessage() *DisconnectMessage {
+	msg := &DisconnectMessage{}
+	msg.SetMessageType(DISCONNECT)
+	return msg
+}
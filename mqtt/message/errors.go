@@ -5,4 +5,22 @@ import "errors"
 var (
 	// ErrorInvalidTopic for invalid message topic
 	ErrorInvalidTopic = errors.New("Invalid topic name pattern ")
+
+	// ErrorBufferSize the destination buffer can not hold the encoded message
+	ErrorBufferSize = errors.New("not enough space to store message")
+
+	// ErrorMalformed the bytes can not be decoded into a message
+	ErrorMalformed = errors.New("malformed message")
+
+	// ErrorFixedHeaderFlag the flags in fixed header are not the value defined for the message type
+	ErrorFixedHeaderFlag = errors.New("invalid fixed header flags")
+
+	// ErrorReservedFlag reserved flag is set
+	ErrorReservedFlag = errors.New("reserved flag must be 0")
+
+	// ErrorPacketID packet identifier is required but zero
+	ErrorPacketID = errors.New("packet identifier must be non-zero")
+
+	// ErrorInvalidQos qos level is not 0, 1 or 2
+	ErrorInvalidQos = errors.New("Invalid Qos Level")
 )
@@ -18,9 +18,30 @@ import (
 // | ------------------------|----------|
 // | MQTT Control Packet type|Flags specific to each MQTT Control Packet type|
 // | Remaining Length                     |
+// the protocol version is not part of the fixed header, it is negotiated by the CONNECT message,
+// and decides how the variable header and payload are encoded
 type FixedHeader struct {
 	ControlFlag byte
 	remainLen   uint32
+	version     byte
+}
+
+// ProtocolVersion the protocol level used to encode and decode the message
+func (header *FixedHeader) ProtocolVersion() byte {
+	if header.version == 0 {
+		return Version311
+	}
+	return header.version
+}
+
+// SetProtocolVersion set the protocol level used to encode and decode the message
+func (header *FixedHeader) SetProtocolVersion(v byte) {
+	header.version = v
+}
+
+// isV5 whether the message is encoded with MQTT 5.0 format
+func (header *FixedHeader) isV5() bool {
+	return header.version >= Version5
 }
 
 // SetRemainLen set remain message length
@@ -34,33 +55,32 @@ func (header *FixedHeader) headerLen() int {
 
 }
 func (header *FixedHeader) encodeHeader(dest []byte) (int, error) {
-	if len(dest) < header.headerLen() {
-		return 0, errors.New("buff not have enough space=")
-	}
-	index := 0
-	dest[index] = header.ControlFlag
-	index++
-
-	l := writeVint(dest[index:], header.remainLen)
-	index += l
-	return index, nil
+	b := NewMessageBuffer(dest, len(dest))
+	header.writeHeader(b)
+	return b.pos, b.err
 }
 
 //decodeHeader decode message header=
 func (header *FixedHeader) decodeHeader(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	header.ControlFlag = b.getByte()
+	header.remainLen = b.getVint()
+	return b.pos, b.err
+}
 
-	if len(buf) < 1 {
-		return 0, errors.New("wrong message format")
-	}
-	header.ControlFlag = buf[0]
-	// messageType := header.ControlFlag >> 4
-	remainLen, l, err := readVint(buf[1:])
-	if err != nil {
-		return 0, err
-	}
+// writeHeader write the control flag and the remaining length
+func (header *FixedHeader) writeHeader(b *Buffer) {
+	b.putByte(header.ControlFlag)
+	b.putVint(header.remainLen)
+}
 
-	header.remainLen = uint32(remainLen)
-	return l + 1, nil
+// readHeader read the control flag and the remaining length,
+// the following reads of the buffer are limited to the remaining length
+func (header *FixedHeader) readHeader(b *Buffer) error {
+	header.ControlFlag = b.getByte()
+	header.remainLen = b.getVint()
+	b.limit(int(header.remainLen))
+	return b.err
 }
 
 // MessageType return the message type, like connect connectack
@@ -70,13 +90,49 @@ func (header *FixedHeader) MessageType() byte {
 
 // SetMessageType set message type
 func (header *FixedHeader) SetMessageType(t byte) error {
-	if t < CONNECT || t > DISCONNECT {
+	if t < CONNECT || t > AUTH {
 		return errors.New("Invalid message type")
 	}
 	header.ControlFlag = (header.ControlFlag & 0xf) | (t&0xf)<<4
 	return nil
 }
 
+// fixedFlags the flags of each message type, PUBLISH is not contained
+// because its flags are DUP, QoS and RETAIN
+var fixedFlags = [...]byte{
+	CONNECT:     0x0,
+	CONNACK:     0x0,
+	PUBACK:      0x0,
+	PUBREC:      0x0,
+	PUBREL:      0x2,
+	PUBCOMP:     0x0,
+	SUBSCRIBE:   0x2,
+	SUBACK:      0x0,
+	UNSUBSCRIBE: 0x2,
+	UNSUBACK:    0x0,
+	PINGREQ:     0x0,
+	PINGRESP:    0x0,
+	DISCONNECT:  0x0,
+	AUTH:        0x0,
+}
+
+// verifyFlag Where a flag bit is marked as "Reserved", it is reserved for future use and MUST be
+// set to the value listed [MQTT-2.2.2-1]. If invalid flags are received, the receiver MUST close
+// the Network Connection [MQTT-2.2.2-2].
+func (header *FixedHeader) verifyFlag() error {
+	t := header.MessageType()
+	if t == PUBLISH {
+		return nil
+	}
+	if t < CONNECT || t > AUTH || byte(header.Flag()) != fixedFlags[t] {
+		return ErrorFixedHeaderFlag
+	}
+	if t == AUTH && !header.isV5() {
+		return errors.New("AUTH message is only supported by MQTT 5.0")
+	}
+	return nil
+}
+
 // Flag return message flag
 func (header *FixedHeader) Flag() int {
 	return int(header.ControlFlag & 0xf)
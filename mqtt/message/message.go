@@ -5,6 +5,9 @@ import "errors"
 // Message interface for basic message operation
 type Message interface {
 	MessageType() byte
+	ProtocolVersion() byte
+	SetProtocolVersion(byte)
+	Len() int
 	Encode([]byte) (int, error)
 	Decode([]byte) (int, error)
 	Verify() error
@@ -17,6 +20,32 @@ func MessageType(t byte) (Message, error) {
 		return &ConnMessage{}, nil
 	case CONNACK:
 		return &ConnAckMessage{}, nil
+	case PUBLISH:
+		return &PublishMessage{}, nil
+	case PUBACK:
+		return &PubAckMessage{}, nil
+	case PUBREC:
+		return &PubRecMessage{}, nil
+	case PUBREL:
+		return &PubRelMessage{}, nil
+	case PUBCOMP:
+		return &PubCompMessage{}, nil
+	case SUBSCRIBE:
+		return &SubscribeMessage{}, nil
+	case SUBACK:
+		return &SubAckMessage{}, nil
+	case UNSUBSCRIBE:
+		return &UnsubscribeMessage{}, nil
+	case UNSUBACK:
+		return &UnsubAckMessage{}, nil
+	case PINGREQ:
+		return &PingReqMessage{}, nil
+	case PINGRESP:
+		return &PingRespMessage{}, nil
+	case DISCONNECT:
+		return &DisconnectMessage{}, nil
+	case AUTH:
+		return &AuthMessage{}, nil
 	default:
 		return nil, errors.New("invalid message type")
 	}
@@ -24,6 +53,12 @@ func MessageType(t byte) (Message, error) {
 
 // NewMessage build new message from bytes
 func NewMessage(b []byte) (Message, error) {
+	return NewVersionMessage(b, Version311)
+}
+
+// NewVersionMessage build new message from bytes with the protocol version negotiated by the connection,
+// the CONNECT message always carries its own protocol level
+func NewVersionMessage(b []byte, version byte) (Message, error) {
 	if b == nil || len(b) < 1 {
 		return nil, errors.New("wrong message format")
 	}
@@ -31,6 +66,7 @@ func NewMessage(b []byte) (Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	msg.SetProtocolVersion(version)
 
 	_, err = msg.Decode(b)
 	if err != nil {
@@ -1,5 +1,15 @@
 package message
 
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Buffer cursor over a byte slice, the messages are encoded and decoded through it.
+// buf is the underlying bytes, pos is the cursor, and l is the end of the region which
+// can be written or read. The first error is kept and the following operations do nothing,
+// so the error is only checked once after the whole message is encoded or decoded
 type Buffer struct {
 	buf []byte
 	pos int
@@ -9,13 +19,207 @@ type Buffer struct {
 
 //NewMessageBuffer create new message buffer
 func NewMessageBuffer(buf []byte, l int) *Buffer {
-	return &Buffer{
+	b := &Buffer{
 		buf: buf,
 		l:   l,
 		pos: 0,
 	}
+	if l > len(buf) {
+		b.err = ErrorBufferSize
+	}
+	return b
+}
+
+// Pos the number of bytes written or read
+func (buf *Buffer) Pos() int {
+	return buf.pos
+}
+
+// Err the first error of the operations
+func (buf *Buffer) Err() error {
+	return buf.err
+}
+
+// Remain the number of bytes can be written or read
+func (buf *Buffer) Remain() int {
+	return buf.l - buf.pos
+}
+
+// limit the following reads to n bytes, it is used after the remaining length is decoded
+func (buf *Buffer) limit(n int) {
+	if buf.err != nil {
+		return
+	}
+	if buf.pos+n > len(buf.buf) {
+		buf.err = ErrorMalformed
+		return
+	}
+	buf.l = buf.pos + n
+}
+
+func (buf *Buffer) writable(n int) bool {
+	if buf.err != nil {
+		return false
+	}
+	if buf.pos+n > buf.l {
+		buf.err = ErrorBufferSize
+		return false
+	}
+	return true
+}
+
+func (buf *Buffer) readable(n int) bool {
+	if buf.err != nil {
+		return false
+	}
+	if buf.pos+n > buf.l {
+		buf.err = ErrorMalformed
+		return false
+	}
+	return true
+}
+
+func (buf *Buffer) putByte(v byte) {
+	if buf.writable(1) {
+		buf.buf[buf.pos] = v
+		buf.pos++
+	}
 }
 
 func (buf *Buffer) putUint16(v uint16) {
-    
+	if buf.writable(2) {
+		binary.BigEndian.PutUint16(buf.buf[buf.pos:], v)
+		buf.pos += 2
+	}
+}
+
+func (buf *Buffer) putUint32(v uint32) {
+	if buf.writable(4) {
+		binary.BigEndian.PutUint32(buf.buf[buf.pos:], v)
+		buf.pos += 4
+	}
+}
+
+func (buf *Buffer) putVint(v uint32) {
+	if buf.writable(vintLen(v)) {
+		buf.pos += writeVint(buf.buf[buf.pos:], v)
+	}
+}
+
+func (buf *Buffer) putBytes(v []byte) {
+	if buf.writable(len(v)) {
+		buf.pos += copy(buf.buf[buf.pos:], v)
+	}
+}
+
+// putLPBytes write length prefixed bytes, it is used by UTF-8 string and binary data
+func (buf *Buffer) putLPBytes(v []byte) {
+	if len(v) > 65535 {
+		buf.err = ErrorMalformed
+		return
+	}
+	if buf.writable(2 + len(v)) {
+		binary.BigEndian.PutUint16(buf.buf[buf.pos:], uint16(len(v)))
+		buf.pos += 2 + copy(buf.buf[buf.pos+2:], v)
+	}
+}
+
+func (buf *Buffer) getByte() byte {
+	if !buf.readable(1) {
+		return 0
+	}
+	v := buf.buf[buf.pos]
+	buf.pos++
+	return v
+}
+
+func (buf *Buffer) getUint16() uint16 {
+	if !buf.readable(2) {
+		return 0
+	}
+	v := binary.BigEndian.Uint16(buf.buf[buf.pos:])
+	buf.pos += 2
+	return v
+}
+
+func (buf *Buffer) getUint32() uint32 {
+	if !buf.readable(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(buf.buf[buf.pos:])
+	buf.pos += 4
+	return v
+}
+
+func (buf *Buffer) getVint() uint32 {
+	if buf.err != nil {
+		return 0
+	}
+	v, n, err := readVint(buf.buf[buf.pos:buf.l])
+	if err != nil {
+		buf.err = err
+		return 0
+	}
+	buf.pos += n
+	return v
+}
+
+// getBytes the returned bytes refer to the underlying buffer
+func (buf *Buffer) getBytes(n int) []byte {
+	if !buf.readable(n) {
+		return nil
+	}
+	v := buf.buf[buf.pos : buf.pos+n : buf.pos+n]
+	buf.pos += n
+	return v
+}
+
+// getLPBytes read length prefixed bytes
+func (buf *Buffer) getLPBytes() []byte {
+	n := buf.getUint16()
+	return buf.getBytes(int(n))
+}
+
+// getRest read all the remaining bytes
+func (buf *Buffer) getRest() []byte {
+	return buf.getBytes(buf.Remain())
+}
+
+// the buffers larger than this are not put back into the pool
+const maxPooledBufferSize = 64 * 1024
+
+var encodePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// getBuffer get a pooled buffer which can hold l bytes
+func getBuffer(l int) *[]byte {
+	bp := encodePool.Get().(*[]byte)
+	if cap(*bp) < l {
+		*bp = make([]byte, l)
+	}
+	*bp = (*bp)[:l]
+	return bp
+}
+
+func putBuffer(bp *[]byte) {
+	if cap(*bp) <= maxPooledBufferSize {
+		encodePool.Put(bp)
+	}
+}
+
+// EncodeTo encode the message into a pooled buffer and write it to the writer,
+// the buffer is reused by the next call, so writing one message to many connections
+// does not allocate per connection
+func EncodeTo(msg Message, w io.Writer) (int, error) {
+	bp := getBuffer(msg.Len())
+	n, err := msg.Encode(*bp)
+	if err == nil {
+		n, err = w.Write((*bp)[:n])
+	}
+	putBuffer(bp)
+	return n, err
 }
@@ -0,0 +1,81 @@
+package message
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageBuffer(t *testing.T) {
+	buf := make([]byte, 14)
+	b := NewMessageBuffer(buf, len(buf))
+	b.putByte(0x30)
+	b.putVint(321)
+	b.putUint16(10)
+	b.putUint32(0x01020304)
+	b.putLPBytes([]byte("a/b"))
+	assert.NoError(t, b.Err(), "should not have error in writing")
+	assert.Equal(t, 14, b.Pos(), "write position should be right")
+
+	b.putUint16(1)
+	assert.Equal(t, ErrorBufferSize, b.Err(), "write over the end should fail")
+	b.putByte(1)
+	assert.Equal(t, 14, b.Pos(), "nothing should be written after error")
+
+	r := NewMessageBuffer(buf, 14)
+	assert.Equal(t, byte(0x30), r.getByte())
+	assert.Equal(t, uint32(321), r.getVint())
+	assert.Equal(t, uint16(10), r.getUint16())
+	assert.Equal(t, uint32(0x01020304), r.getUint32())
+	assert.Equal(t, []byte("a/b"), r.getLPBytes())
+	assert.NoError(t, r.Err(), "should not have error in reading")
+	assert.Equal(t, 0, r.Remain(), "all bytes should be read")
+
+	r.getByte()
+	assert.Equal(t, ErrorMalformed, r.Err(), "read over the end should fail")
+
+	r = NewMessageBuffer([]byte{0x00, 0x05, 'a'}, 3)
+	assert.Nil(t, r.getLPBytes(), "truncated string should not be returned")
+	assert.Equal(t, ErrorMalformed, r.Err(), "truncated string should fail")
+}
+
+func TestMessageBufferLimit(t *testing.T) {
+	// remaining length 2, but the following bytes belong to the next packet
+	msg := NewPubAckMessage()
+	n, err := msg.Decode([]byte{0x40, 0x02, 0x00, 0x07, 0xe0, 0x00})
+	assert.NoError(t, err, "should not have error in decoding")
+	assert.Equal(t, 4, n, "decode should stop at the remaining length")
+	assert.Equal(t, uint16(7), msg.PacketID())
+
+	_, err = msg.Decode([]byte{0x40, 0x02, 0x00})
+	assert.Error(t, err, "short packet should fail")
+
+	sub := NewSubscribeMessage()
+	_, err = sub.Decode([]byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'})
+	assert.Error(t, err, "topic without options should fail")
+}
+
+func TestEncodeTo(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(QosAtLeastOnce)
+	msg.SetPacketID(10)
+	msg.SetPayload([]byte("send me home"))
+
+	buf := make([]byte, msg.Len())
+	_, err := msg.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	var out bytes.Buffer
+	n, err := EncodeTo(msg, &out)
+	assert.NoError(t, err, "should not have error in writing")
+	assert.Equal(t, len(buf), n, "write length should be equal")
+	assert.Equal(t, buf, out.Bytes(), "written bytes should be equal")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		EncodeTo(msg, ioutil.Discard)
+	})
+	assert.Equal(t, float64(0), allocs, "encode to writer should not allocate")
+}
@@ -1,7 +1,80 @@
 package message
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestMessage(t *testing.T) {
+	ack := NewPubAckMessage()
+	ack.SetPacketID(12)
+	rec := NewPubRecMessage()
+	rec.SetPacketID(13)
+	rel := NewPubRelMessage()
+	rel.SetPacketID(14)
+	comp := NewPubCompMessage()
+	comp.SetPacketID(15)
+	unsubAck := NewUnsubAckMessage()
+	unsubAck.SetPacketID(16)
+
+	msgs := []Message{
+		NewConnAckMessage(),
+		ack,
+		rec,
+		rel,
+		comp,
+		unsubAck,
+		NewPingReqMessage(),
+		NewPingRespMessage(),
+		NewDisconnectMessage(),
+	}
+
+	for _, msg := range msgs {
+		buf := make([]byte, msg.Len())
+		encodeLen, err := msg.Encode(buf)
+		assert.NoError(t, err, "should not have error in encoding")
+
+		msg2, err := NewMessage(buf)
+		assert.NoError(t, err, "should not return error")
+		assert.Equal(t, msg2.MessageType(), msg.MessageType(), "message type should be equal")
+		assert.Equal(t, msg2.Len(), encodeLen, "message length should be equal")
+	}
+
+	msg, err := NewMessage([]byte{0x40, 0x02, 0x00, 0x0c})
+	assert.NoError(t, err, "should decode puback")
+	assert.Equal(t, msg.(*PubAckMessage).PacketID(), uint16(12), "packet id should be equal")
+
+	_, err = NewMessage([]byte{0xf0, 0x00})
+	assert.Error(t, err, "reserved message type should not be decoded")
+}
+
+func TestMessageVerify(t *testing.T) {
+	type Case struct {
+		b   []byte
+		err error
+	}
+
+	cases := []Case{
+		// pubrel flags must be 0010
+		{[]byte{0x60, 0x02, 0x00, 0x01}, ErrorFixedHeaderFlag},
+		{[]byte{0x62, 0x02, 0x00, 0x01}, nil},
+		// packet identifier must be non-zero
+		{[]byte{0x40, 0x02, 0x00, 0x00}, ErrorPacketID},
+		// pingreq has no variable header
+		{[]byte{0xc1, 0x00}, ErrorFixedHeaderFlag},
+		// qos 3 publish
+		{[]byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, ErrorInvalidQos},
+		// qos 1 publish without packet identifier
+		{[]byte{0x32, 0x05, 0x00, 0x01, 'a', 0x00, 0x00}, ErrorPacketID},
+		// subscribe with invalid requested qos
+		{[]byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03}, ErrorInvalidQos},
+		// connack reserved flags
+		{[]byte{0x20, 0x02, 0x02, 0x00}, ErrorReservedFlag},
+	}
 
+	for _, c := range cases {
+		_, err := NewMessage(c.b)
+		assert.Equal(t, err, c.err, "verify error should be equal")
+	}
 }
@@ -0,0 +1,67 @@
+package message
+
+// PINGREQ and PINGRESP only have the fixed header,
+// the remaining length is always 0
+
+// emptyMessage basic struct for the messages without variable header and payload
+type emptyMessage struct {
+	FixedHeader
+}
+
+// Len total message length
+func (msg *emptyMessage) Len() int {
+	msg.SetRemainLen(0)
+	return msg.headerLen()
+}
+
+// Encode encode message into network bytes
+func (msg *emptyMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	return b.pos, b.err
+}
+
+// Decode decode message
+func (msg *emptyMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+	b.getRest()
+	return b.pos, b.err
+}
+
+// Verify verify message
+func (msg *emptyMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if msg.remainLen != 0 {
+		return ErrorMalformed
+	}
+	return nil
+}
+
+// PingReqMessage is sent from a Client to the Server, to indicate the client is alive
+type PingReqMessage struct {
+	emptyMessage
+}
+
+// NewPingReqMessage create new pingreq message
+func NewPingReqMessage() *PingReqMessage {
+	msg := &PingReqMessage{}
+	msg.SetMessageType(PINGREQ)
+	return msg
+}
+
+// PingRespMessage is sent by the Server to the Client in response to a PINGREQ Packet
+type PingRespMessage struct {
+	emptyMessage
+}
+
+// NewPingRespMessage create new pingresp message
+func NewPingRespMessage() *PingRespMessage {
+	msg := &PingRespMessage{}
+	msg.SetMessageType(PINGRESP)
+	return msg
+}
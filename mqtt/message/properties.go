@@ -0,0 +1,361 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+// In MQTT 5.0 the last field in the Variable Header of the CONNECT, CONNACK, PUBLISH, PUBACK, PUBREC,
+// PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, and AUTH packet is a set of
+// Properties. In the CONNECT packet there is also an optional set of Properties in the Will Properties
+// field with the Payload.
+// The set of Properties is composed of a Property Length followed by the Properties.
+//       Property Length: Variable Byte Integer
+//       Property: Identifier (Variable Byte Integer) followed by the value
+
+// property identifiers
+const (
+	PropPayloadFormat                   byte = 0x01
+	PropMessageExpiry                   byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQos                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// data type of property value
+const (
+	propByte = iota
+	propUint16
+	propUint32
+	propVint
+	propString
+	propBinary
+	propStringPair
+)
+
+// willProperties the will properties are not carried by a packet type,
+// use the reserved type 0 to identify them
+const willProperties = RESERVED1
+
+// propertyDef data type of the property and the packets it may appear in
+type propertyDef struct {
+	kind    byte
+	packets []byte
+	// multi the property is allowed to be included more than once
+	multi bool
+}
+
+var propertyDefs = map[byte]propertyDef{
+	PropPayloadFormat:                   {propByte, []byte{PUBLISH, willProperties}, false},
+	PropMessageExpiry:                   {propUint32, []byte{PUBLISH, willProperties}, false},
+	PropContentType:                     {propString, []byte{PUBLISH, willProperties}, false},
+	PropResponseTopic:                   {propString, []byte{PUBLISH, willProperties}, false},
+	PropCorrelationData:                 {propBinary, []byte{PUBLISH, willProperties}, false},
+	PropSubscriptionIdentifier:          {propVint, []byte{PUBLISH, SUBSCRIBE}, true},
+	PropSessionExpiryInterval:           {propUint32, []byte{CONNECT, CONNACK, DISCONNECT}, false},
+	PropAssignedClientIdentifier:        {propString, []byte{CONNACK}, false},
+	PropServerKeepAlive:                 {propUint16, []byte{CONNACK}, false},
+	PropAuthenticationMethod:            {propString, []byte{CONNECT, CONNACK, AUTH}, false},
+	PropAuthenticationData:              {propBinary, []byte{CONNECT, CONNACK, AUTH}, false},
+	PropRequestProblemInformation:       {propByte, []byte{CONNECT}, false},
+	PropWillDelayInterval:               {propUint32, []byte{willProperties}, false},
+	PropRequestResponseInformation:      {propByte, []byte{CONNECT}, false},
+	PropResponseInformation:             {propString, []byte{CONNACK}, false},
+	PropServerReference:                 {propString, []byte{CONNACK, DISCONNECT}, false},
+	PropReasonString:                    {propString, []byte{CONNACK, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBACK, UNSUBACK, DISCONNECT, AUTH}, false},
+	PropReceiveMaximum:                  {propUint16, []byte{CONNECT, CONNACK}, false},
+	PropTopicAliasMaximum:               {propUint16, []byte{CONNECT, CONNACK}, false},
+	PropTopicAlias:                      {propUint16, []byte{PUBLISH}, false},
+	PropMaximumQos:                      {propByte, []byte{CONNACK}, false},
+	PropRetainAvailable:                 {propByte, []byte{CONNACK}, false},
+	PropUserProperty:                    {propStringPair, []byte{CONNECT, CONNACK, PUBLISH, willProperties, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK, DISCONNECT, AUTH}, true},
+	PropMaximumPacketSize:               {propUint32, []byte{CONNECT, CONNACK}, false},
+	PropWildcardSubscriptionAvailable:   {propByte, []byte{CONNACK}, false},
+	PropSubscriptionIdentifierAvailable: {propByte, []byte{CONNACK}, false},
+	PropSharedSubscriptionAvailable:     {propByte, []byte{CONNACK}, false},
+}
+
+// Property a single property, the value is stored according to the data type:
+// Byte, Two Byte Integer, Four Byte Integer and Variable Byte Integer are stored in Value,
+// UTF-8 Encoded String and Binary Data are stored in Data,
+// UTF-8 String Pair is stored in Data (name) and Pair (value)
+type Property struct {
+	ID    byte
+	Value uint32
+	Data  []byte
+	Pair  []byte
+}
+
+func (p *Property) valueLen() int {
+	switch propertyDefs[p.ID].kind {
+	case propByte:
+		return 1
+	case propUint16:
+		return 2
+	case propUint32:
+		return 4
+	case propVint:
+		return vintLen(p.Value)
+	case propString, propBinary:
+		return 2 + len(p.Data)
+	default:
+		return 4 + len(p.Data) + len(p.Pair)
+	}
+}
+
+// Properties the set of properties of a message
+type Properties struct {
+	list []Property
+}
+
+// Items return all the properties in order
+func (props *Properties) Items() []Property {
+	return props.list
+}
+
+// Empty whether there is no property
+func (props *Properties) Empty() bool {
+	return len(props.list) == 0
+}
+
+// Reset remove all the properties
+func (props *Properties) Reset() {
+	props.list = props.list[:0]
+}
+
+// Get return the first property with the identifier
+func (props *Properties) Get(id byte) (Property, bool) {
+	for _, p := range props.list {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Int return the integer value of the property
+func (props *Properties) Int(id byte) (uint32, bool) {
+	p, ok := props.Get(id)
+	return p.Value, ok
+}
+
+// Data return the string or binary value of the property
+func (props *Properties) Data(id byte) ([]byte, bool) {
+	p, ok := props.Get(id)
+	return p.Data, ok
+}
+
+// Add append a property, the properties which may appear more than once are not replaced
+func (props *Properties) Add(p Property) error {
+	def, ok := propertyDefs[p.ID]
+	if !ok {
+		return fmt.Errorf("unknown property identifier 0x%02x", p.ID)
+	}
+
+	if !def.multi {
+		for i := range props.list {
+			if props.list[i].ID == p.ID {
+				props.list[i] = p
+				return nil
+			}
+		}
+	}
+	props.list = append(props.list, p)
+	return nil
+}
+
+// SetInt set the integer property
+func (props *Properties) SetInt(id byte, v uint32) error {
+	return props.Add(Property{ID: id, Value: v})
+}
+
+// SetData set the string or binary property
+func (props *Properties) SetData(id byte, data []byte) error {
+	return props.Add(Property{ID: id, Data: data})
+}
+
+// AddUserProperty append a user property name value pair
+func (props *Properties) AddUserProperty(name []byte, value []byte) {
+	props.list = append(props.list, Property{ID: PropUserProperty, Data: name, Pair: value})
+}
+
+// Delete remove all the properties with the identifier
+func (props *Properties) Delete(id byte) {
+	list := props.list[:0]
+	for _, p := range props.list {
+		if p.ID != id {
+			list = append(list, p)
+		}
+	}
+	props.list = list
+}
+
+// copy deep copy the properties
+func (props *Properties) copy() Properties {
+	if len(props.list) == 0 {
+		return Properties{}
+	}
+	list := make([]Property, len(props.list))
+	for i, p := range props.list {
+		list[i] = Property{ID: p.ID, Value: p.Value}
+		if p.Data != nil {
+			list[i].Data = append([]byte(nil), p.Data...)
+		}
+		if p.Pair != nil {
+			list[i].Pair = append([]byte(nil), p.Pair...)
+		}
+	}
+	return Properties{list: list}
+}
+
+// propLen length of the properties without the property length field
+func (props *Properties) propLen() int {
+	l := 0
+	for i := range props.list {
+		l += 1 + props.list[i].valueLen()
+	}
+	return l
+}
+
+// Len length of the properties contains the property length field
+func (props *Properties) Len() int {
+	l := props.propLen()
+	return vintLen(uint32(l)) + l
+}
+
+func (props *Properties) encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, len(dst))
+	props.write(b)
+	return b.pos, b.err
+}
+
+func (props *Properties) decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	props.read(b)
+	return b.pos, b.err
+}
+
+// write the property length and the properties
+func (props *Properties) write(b *Buffer) {
+	b.putVint(uint32(props.propLen()))
+	for _, p := range props.list {
+		b.putByte(p.ID)
+
+		switch propertyDefs[p.ID].kind {
+		case propByte:
+			b.putByte(byte(p.Value))
+		case propUint16:
+			b.putUint16(uint16(p.Value))
+		case propUint32:
+			b.putUint32(p.Value)
+		case propVint:
+			b.putVint(p.Value)
+		case propString, propBinary:
+			b.putLPBytes(p.Data)
+		case propStringPair:
+			b.putLPBytes(p.Data)
+			b.putLPBytes(p.Pair)
+		}
+	}
+}
+
+// read the property length and the properties, the values refer to the buffer
+func (props *Properties) read(b *Buffer) {
+	l := int(b.getVint())
+	if b.err == nil && l > b.Remain() {
+		b.err = ErrorMalformed
+	}
+
+	props.list = props.list[:0]
+	end := b.pos + l
+	for b.err == nil && b.pos < end {
+		p := Property{ID: b.getByte()}
+
+		def, ok := propertyDefs[p.ID]
+		if !ok {
+			b.err = fmt.Errorf("unknown property identifier 0x%02x", p.ID)
+			return
+		}
+
+		switch def.kind {
+		case propByte:
+			p.Value = uint32(b.getByte())
+		case propUint16:
+			p.Value = uint32(b.getUint16())
+		case propUint32:
+			p.Value = b.getUint32()
+		case propVint:
+			p.Value = b.getVint()
+		case propString, propBinary:
+			p.Data = b.getLPBytes()
+		case propStringPair:
+			p.Data = b.getLPBytes()
+			p.Pair = b.getLPBytes()
+		}
+		props.list = append(props.list, p)
+	}
+
+	if b.err == nil && b.pos != end {
+		b.err = ErrorMalformed
+	}
+}
+
+// verify the properties can be carried by the packet type, and the properties which are not allowed
+// to appear more than once are not duplicated. It is a Protocol Error to include them more than once
+func (props *Properties) verify(t byte) error {
+	for i, p := range props.list {
+		def := propertyDefs[p.ID]
+
+		allowed := false
+		for _, pt := range def.packets {
+			if pt == t {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("property 0x%02x is not allowed in packet type %d", p.ID, t)
+		}
+
+		if !def.multi {
+			for _, q := range props.list[i+1:] {
+				if q.ID == p.ID {
+					return fmt.Errorf("property 0x%02x is included more than once", p.ID)
+				}
+			}
+		}
+
+		if p.ID == PropSubscriptionIdentifier && p.Value == 0 {
+			return errors.New("subscription identifier must not be 0")
+		}
+		if (p.ID == PropReceiveMaximum || p.ID == PropMaximumPacketSize) && p.Value == 0 {
+			return fmt.Errorf("property 0x%02x must not be 0", p.ID)
+		}
+		if def.kind == propByte && p.Value > 1 {
+			return fmt.Errorf("property 0x%02x must be 0 or 1", p.ID)
+		}
+	}
+	return nil
+}
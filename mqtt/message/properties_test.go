@@ -0,0 +1,110 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProperties(t *testing.T) {
+	props := &Properties{}
+	props.SetInt(PropSessionExpiryInterval, 3600)
+	props.SetInt(PropReceiveMaximum, 20)
+	props.SetData(PropAuthenticationMethod, []byte("SCRAM-SHA-1"))
+	props.AddUserProperty([]byte("region"), []byte("eu"))
+	props.AddUserProperty([]byte("region"), []byte("us"))
+	props.SetInt(PropReceiveMaximum, 10)
+
+	assert.Equal(t, len(props.Items()), 5, "receive maximum should be replaced")
+	assert.NoError(t, props.verify(CONNECT), "properties are allowed in connect")
+	assert.Error(t, props.verify(PUBLISH), "session expiry is not allowed in publish")
+
+	buf := make([]byte, props.Len())
+	n, err := props.encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+	assert.Equal(t, n, len(buf), "encode length should be equal")
+
+	props2 := &Properties{}
+	n, err = props2.decode(buf)
+	assert.NoError(t, err, "should not return error")
+	assert.Equal(t, n, len(buf), "decode length should be equal")
+	assert.Equal(t, props2.Items(), props.Items(), "properties should be equal")
+
+	v, ok := props2.Int(PropReceiveMaximum)
+	assert.True(t, ok, "receive maximum should exist")
+	assert.Equal(t, v, uint32(10), "receive maximum should be equal")
+
+	// subscription identifier is a variable byte integer
+	props.Reset()
+	props.SetInt(PropSubscriptionIdentifier, 268435455)
+	assert.Equal(t, props.Len(), 6, "property length 1, identifier 1, value 4")
+
+	// duplicated property
+	_, err = props2.decode([]byte{0x06, 0x21, 0x00, 0x01, 0x21, 0x00, 0x02})
+	assert.NoError(t, err, "should not return error")
+	assert.Error(t, props2.verify(CONNECT), "receive maximum included twice")
+
+	_, err = props2.decode([]byte{0x02, 0x7f, 0x00})
+	assert.Error(t, err, "unknown property identifier")
+}
+
+func TestVersion5Message(t *testing.T) {
+	conn := NewConnMessage()
+	conn.SetVersion(Version5)
+	conn.SetClientID([]byte("surgemq"))
+	conn.SetWill(true)
+	conn.WillTopic = []byte("will")
+	conn.WillMessage = []byte("send me home")
+	conn.Properties().SetInt(PropSessionExpiryInterval, 60)
+	conn.WillProperties().SetInt(PropWillDelayInterval, 5)
+
+	buf := make([]byte, conn.Len())
+	_, err := conn.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	msg, err := NewMessage(buf)
+	assert.NoError(t, err, "connect message carries its own version")
+	conn2 := msg.(*ConnMessage)
+	assert.Equal(t, conn2.ProtocolVersion(), Version5, "version should be 5")
+	v, _ := conn2.Properties().Int(PropSessionExpiryInterval)
+	assert.Equal(t, v, uint32(60), "session expiry should be equal")
+	v, _ = conn2.WillProperties().Int(PropWillDelayInterval)
+	assert.Equal(t, v, uint32(5), "will delay should be equal")
+	assert.Equal(t, conn2.WillMessage, []byte("send me home"), "will message should be equal")
+
+	// success ack without properties is short
+	ack := NewPubAckMessage()
+	ack.SetProtocolVersion(Version5)
+	ack.SetPacketID(1)
+	assert.Equal(t, ack.Len(), 4, "remaining length should be 2")
+	ack.SetReasonCode(ReasonNoMatchingSubscribers)
+	assert.Equal(t, ack.Len(), 5, "remaining length should be 3")
+	ack.Properties().SetData(PropReasonString, []byte("nobody"))
+
+	buf = make([]byte, ack.Len())
+	_, err = ack.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	msg, err = NewVersionMessage(buf, Version5)
+	assert.NoError(t, err, "should not return error")
+	assert.Equal(t, msg.(*PubAckMessage).ReasonCode(), ReasonNoMatchingSubscribers, "reason code should be equal")
+
+	// connack translates the return code
+	connAck := NewConnAckMessage()
+	connAck.SetProtocolVersion(Version5)
+	connAck.SetReturnCode(NotAuthorized)
+	assert.Equal(t, connAck.ReasonCode(), ReasonNotAuthorized, "reason code should be translated")
+
+	// auth is only allowed in MQTT 5.0
+	auth := NewAuthMessage()
+	auth.SetReasonCode(ReasonContinueAuthentication)
+	auth.Properties().SetData(PropAuthenticationMethod, []byte("SCRAM-SHA-1"))
+	buf = make([]byte, auth.Len())
+	_, err = auth.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	_, err = NewVersionMessage(buf, Version5)
+	assert.NoError(t, err, "should not return error")
+	_, err = NewVersionMessage(buf, Version311)
+	assert.Error(t, err, "auth is not supported before 5.0")
+}
@@ -0,0 +1,174 @@
+package message
+
+// PUBACK, PUBREC, PUBREL and PUBCOMP share the same structure:
+// Fixed header with remaining length 2
+// Variable header:
+//       Packet Identifier MSB: 1
+//       Packet Identifier LSB: 2
+//       Reason Code: 3, only in MQTT 5.0
+//       Properties, only in MQTT 5.0
+// No payload
+// the fixed header flags of PUBREL are 0010, others are 0000
+// In MQTT 5.0 the Reason Code and Property Length can be omitted if the Reason Code is 0x00 (Success)
+// and there are no Properties. In this case the packet has a Remaining Length of 2.
+
+// ackMessage basic struct for the messages only carry packet identifier
+type ackMessage struct {
+	FixedHeader
+	packetID   uint16
+	reasonCode ReasonCode
+	props      Properties
+}
+
+// PacketID return the packet identifier
+func (msg *ackMessage) PacketID() uint16 {
+	return msg.packetID
+}
+
+// SetPacketID set the packet identifier
+func (msg *ackMessage) SetPacketID(id uint16) {
+	msg.packetID = id
+}
+
+// ReasonCode return the MQTT 5.0 reason code
+func (msg *ackMessage) ReasonCode() ReasonCode {
+	return msg.reasonCode
+}
+
+// SetReasonCode set the MQTT 5.0 reason code
+func (msg *ackMessage) SetReasonCode(code ReasonCode) {
+	msg.reasonCode = code
+}
+
+// Properties return the MQTT 5.0 properties
+func (msg *ackMessage) Properties() *Properties {
+	return &msg.props
+}
+
+func (msg *ackMessage) msgLen() int {
+	if !msg.isV5() || (msg.reasonCode == ReasonSuccess && msg.props.Empty()) {
+		return 2
+	}
+	if msg.props.Empty() {
+		return 3
+	}
+	return 3 + msg.props.Len()
+}
+
+// Len total message length
+func (msg *ackMessage) Len() int {
+	msg.SetRemainLen(uint32(msg.msgLen()))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode ack message into network bytes
+func (msg *ackMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	b.putUint16(msg.packetID)
+	if msg.remainLen > 2 {
+		b.putByte(byte(msg.reasonCode))
+	}
+	if msg.remainLen > 3 {
+		msg.props.write(b)
+	}
+	return b.pos, b.err
+}
+
+// Decode decode ack message
+func (msg *ackMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.packetID = b.getUint16()
+	msg.reasonCode = ReasonSuccess
+	msg.props.Reset()
+	if !msg.isV5() {
+		b.getRest()
+		return b.pos, b.err
+	}
+
+	if b.Remain() > 0 {
+		msg.reasonCode = ReasonCode(b.getByte())
+	}
+	if b.Remain() > 0 {
+		msg.props.read(b)
+	}
+	return b.pos, b.err
+}
+
+// Verify verify message
+// SUBSCRIBE, UNSUBSCRIBE, and PUBLISH (in cases where QoS > 0) Control Packets MUST contain
+// a non-zero 16-bit Packet Identifier [MQTT-2.3.1-1], so do the acknowledgements
+func (msg *ackMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if msg.packetID == 0 {
+		return ErrorPacketID
+	}
+	if !msg.isV5() {
+		if msg.remainLen > 2 {
+			return ErrorMalformed
+		}
+		return nil
+	}
+	if err := verifyReasonCode(msg.MessageType(), msg.reasonCode); err != nil {
+		return err
+	}
+	return msg.props.verify(msg.MessageType())
+}
+
+// PubAckMessage the response to a PUBLISH Packet with QoS level 1
+type PubAckMessage struct {
+	ackMessage
+}
+
+// NewPubAckMessage create new puback message
+func NewPubAckMessage() *PubAckMessage {
+	msg := &PubAckMessage{}
+	msg.SetMessageType(PUBACK)
+	return msg
+}
+
+// PubRecMessage the response to a PUBLISH Packet with QoS 2.
+// It is the second packet of the QoS 2 protocol exchange.
+type PubRecMessage struct {
+	ackMessage
+}
+
+// NewPubRecMessage create new pubrec message
+func NewPubRecMessage() *PubRecMessage {
+	msg := &PubRecMessage{}
+	msg.SetMessageType(PUBREC)
+	return msg
+}
+
+// PubRelMessage the response to a PUBREC Packet.
+// It is the third packet of the QoS 2 protocol exchange.
+type PubRelMessage struct {
+	ackMessage
+}
+
+// NewPubRelMessage create new pubrel message
+func NewPubRelMessage() *PubRelMessage {
+	msg := &PubRelMessage{}
+	msg.SetMessageType(PUBREL)
+	msg.ControlFlag |= 0x02
+	return msg
+}
+
+// PubCompMessage the response to a PUBREL Packet.
+// It is the fourth and final packet of the QoS 2 protocol exchange.
+type PubCompMessage struct {
+	ackMessage
+}
+
+// NewPubCompMessage create new pubcomp message
+func NewPubCompMessage() *PubCompMessage {
+	msg := &PubCompMessage{}
+	msg.SetMessageType(PUBCOMP)
+	return msg
+}
@@ -0,0 +1,202 @@
+package message
+
+import "errors"
+
+// A PUBLISH Control Packet is sent from a Client to a Server or from Server to a Client
+// to transport an Application Message.
+// Fixed header flags:
+//       DUP flag: 3
+//       QoS level: 2-1
+//       RETAIN: 0
+// Variable header:
+//       Topic Name
+//       Packet Identifier, only present when QoS level is 1 or 2
+//       Properties, only present in MQTT 5.0
+// Payload:
+//       Application Message, the length is remaining length minus the variable header
+
+// PublishMessage struct for publish message
+type PublishMessage struct {
+	FixedHeader
+	topic    []byte
+	packetID uint16
+	props    Properties
+	payload  []byte
+}
+
+// NewPublishMessage create new publish message
+func NewPublishMessage() *PublishMessage {
+	msg := &PublishMessage{}
+	msg.SetMessageType(PUBLISH)
+	return msg
+}
+
+// Topic return the topic name of the message
+func (msg *PublishMessage) Topic() []byte {
+	return msg.topic
+}
+
+// SetTopic set the topic name
+func (msg *PublishMessage) SetTopic(topic []byte) {
+	msg.topic = topic
+}
+
+// PacketID return the packet identifier
+func (msg *PublishMessage) PacketID() uint16 {
+	return msg.packetID
+}
+
+// SetPacketID set the packet identifier, only encoded when qos > 0
+func (msg *PublishMessage) SetPacketID(id uint16) {
+	msg.packetID = id
+}
+
+// Properties return the MQTT 5.0 publish properties
+func (msg *PublishMessage) Properties() *Properties {
+	return &msg.props
+}
+
+// Payload return the application message
+func (msg *PublishMessage) Payload() []byte {
+	return msg.payload
+}
+
+// SetPayload set the application message
+func (msg *PublishMessage) SetPayload(payload []byte) {
+	msg.payload = payload
+}
+
+// IsDup whether this might be re-delivery of an earlier attempt to send the packet
+func (msg *PublishMessage) IsDup() bool {
+	return msg.ControlFlag&0x08 == 0x08
+}
+
+// SetDup set the dup flag
+func (msg *PublishMessage) SetDup(v bool) {
+	if v {
+		msg.ControlFlag |= 0x08
+	} else {
+		msg.ControlFlag &= 0xf7
+	}
+}
+
+// Qos get the message qos level
+func (msg *PublishMessage) Qos() byte {
+	return (msg.ControlFlag & 0x06) >> 1
+}
+
+// SetQos set message qos level
+func (msg *PublishMessage) SetQos(qos byte) error {
+	if qos > QosExactlyOnce {
+		return ErrorInvalidQos
+	}
+	msg.ControlFlag = (msg.ControlFlag & 0xf9) | qos<<1
+	return nil
+}
+
+// IsRetain whether the server should store the message for the topic
+func (msg *PublishMessage) IsRetain() bool {
+	return msg.ControlFlag&0x01 == 0x01
+}
+
+// SetRetain set the retain flag
+func (msg *PublishMessage) SetRetain(v bool) {
+	if v {
+		msg.ControlFlag |= 0x01
+	} else {
+		msg.ControlFlag &= 0xfe
+	}
+}
+
+// msgLen topic name, packet identifier and payload
+func (msg *PublishMessage) msgLen() int {
+	msgLen := 2 + len(msg.topic)
+	if msg.Qos() > QosAtMostOnce {
+		msgLen += 2
+	}
+	if msg.isV5() {
+		msgLen += msg.props.Len()
+	}
+	msgLen += len(msg.payload)
+	return msgLen
+}
+
+// Len total message length
+func (msg *PublishMessage) Len() int {
+	msg.SetRemainLen(uint32(msg.msgLen()))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode publish message into network bytes
+func (msg *PublishMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	b.putLPBytes(msg.topic)
+	if msg.Qos() > QosAtMostOnce {
+		b.putUint16(msg.packetID)
+	}
+	if msg.isV5() {
+		msg.props.write(b)
+	}
+	b.putBytes(msg.payload)
+	return b.pos, b.err
+}
+
+// Decode decode publish message
+func (msg *PublishMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.topic = b.getLPBytes()
+	if msg.Qos() > QosAtMostOnce {
+		msg.packetID = b.getUint16()
+	}
+	msg.props.Reset()
+	if msg.isV5() {
+		msg.props.read(b)
+	}
+	msg.payload = b.getRest()
+	return b.pos, b.err
+}
+
+// Copy deep copy the message, the decoded message refers to the buffer it is decoded from,
+// copy it before the message outlives the buffer
+func (msg *PublishMessage) Copy() *PublishMessage {
+	c := *msg
+	buf := make([]byte, len(msg.topic)+len(msg.payload))
+	c.topic = buf[:len(msg.topic):len(msg.topic)]
+	copy(c.topic, msg.topic)
+	c.payload = buf[len(msg.topic):]
+	copy(c.payload, msg.payload)
+	c.props = msg.props.copy()
+	return &c
+}
+
+// Verify verify message
+// A PUBLISH Packet MUST NOT have both QoS bits set to 1 [MQTT-3.3.1-4].
+// The DUP flag MUST be set to 0 for all QoS 0 messages [MQTT-3.3.1-2].
+// The Topic Name MUST be present as the first field in the PUBLISH Packet Variable header [MQTT-3.3.2-1].
+// The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters [MQTT-3.3.2-2].
+func (msg *PublishMessage) Verify() error {
+	if msg.Qos() > QosExactlyOnce {
+		return ErrorInvalidQos
+	}
+	if msg.Qos() == QosAtMostOnce && msg.IsDup() {
+		return errors.New("dup flag must be 0 for qos 0 message")
+	}
+	if msg.Qos() > QosAtMostOnce && msg.packetID == 0 {
+		return ErrorPacketID
+	}
+	if msg.isV5() {
+		// a zero length topic name is allowed when a topic alias is used
+		if _, ok := msg.props.Int(PropTopicAlias); !ok || len(msg.topic) > 0 {
+			if err := ValidTopicName(msg.topic); err != nil {
+				return err
+			}
+		}
+		return msg.props.verify(PUBLISH)
+	}
+	return ValidTopicName(msg.topic)
+}
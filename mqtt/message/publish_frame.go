@@ -0,0 +1,128 @@
+package message
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+// PublishFrame an encoded PUBLISH packet shared by the subscribers which receive the message
+// with the same protocol version and flags, so the message is encoded once however many
+// subscribers it is delivered to. The frame is immutable, the packet id is patched in a
+// pooled copy when it is written.
+// The buffer is pooled and reference counted, Retain it before handing it to another
+// goroutine and Release it when finished, the creator holds the first reference
+type PublishFrame struct {
+	bp       *[]byte
+	buf      []byte
+	packetID uint16
+
+	// offset of the packet id in buf, 0 for QoS 0 which has no packet id
+	idPos int
+	refs  int32
+}
+
+// NewPublishFrame encode the message with its current protocol version and flags
+func NewPublishFrame(msg *PublishMessage) (*PublishFrame, error) {
+	bp := getBuffer(msg.Len())
+	n, err := msg.Encode(*bp)
+	if err != nil {
+		putBuffer(bp)
+		return nil, err
+	}
+
+	frame := &PublishFrame{
+		bp:       bp,
+		buf:      (*bp)[:n],
+		packetID: msg.packetID,
+		refs:     1,
+	}
+	if msg.Qos() > QosAtMostOnce {
+		frame.idPos = msg.headerLen() + 2 + len(msg.topic)
+	}
+	return frame, nil
+}
+
+// LoadPublishFrame create the frame from an encoded PUBLISH packet, like the one saved by the
+// session store, the packet is copied so data can be reused
+func LoadPublishFrame(data []byte) (*PublishFrame, error) {
+	var header FixedHeader
+	b := NewMessageBuffer(data, len(data))
+	if err := header.readHeader(b); err != nil {
+		return nil, err
+	}
+	if header.MessageType() != PUBLISH {
+		return nil, ErrorMalformed
+	}
+	n := b.l
+
+	frame := &PublishFrame{refs: 1}
+	if qos := (header.ControlFlag >> 1) & 0x3; qos > QosAtMostOnce {
+		b.getLPBytes()
+		frame.idPos = b.pos
+		frame.packetID = b.getUint16()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	frame.bp = getBuffer(n)
+	frame.buf = (*frame.bp)[:n]
+	copy(frame.buf, data)
+	return frame, nil
+}
+
+// Bytes the encoded packet, it must not be modified
+func (frame *PublishFrame) Bytes() []byte {
+	return frame.buf
+}
+
+// Len the length of the encoded packet
+func (frame *PublishFrame) Len() int {
+	return len(frame.buf)
+}
+
+// Qos the qos of the encoded packet
+func (frame *PublishFrame) Qos() byte {
+	return (frame.buf[0] >> 1) & 0x3
+}
+
+// PacketID the packet id the message was encoded with
+func (frame *PublishFrame) PacketID() uint16 {
+	return frame.packetID
+}
+
+// Retain add one reference
+func (frame *PublishFrame) Retain() {
+	atomic.AddInt32(&frame.refs, 1)
+}
+
+// Release drop one reference, the buffer is put back into the pool after the last one
+func (frame *PublishFrame) Release() {
+	refs := atomic.AddInt32(&frame.refs, -1)
+	if refs == 0 {
+		putBuffer(frame.bp)
+		frame.bp, frame.buf = nil, nil
+	} else if refs < 0 {
+		panic("message: PublishFrame released too many times")
+	}
+}
+
+// WriteTo write the packet with the packet id in one call, the packet id and dup are ignored for QoS 0.
+// The frame is shared, so it is never patched in place, dup is set when the message is redelivered
+func (frame *PublishFrame) WriteTo(w io.Writer, packetID uint16, dup bool) (int, error) {
+	if frame.idPos == 0 || (packetID == frame.packetID && !dup) {
+		return w.Write(frame.buf)
+	}
+
+	bp := getBuffer(len(frame.buf))
+	buf := *bp
+	copy(buf, frame.buf)
+	binary.BigEndian.PutUint16(buf[frame.idPos:], packetID)
+	if dup {
+		buf[0] |= 0x08
+	}
+	n, err := w.Write(buf)
+	putBuffer(bp)
+	return n, err
+}
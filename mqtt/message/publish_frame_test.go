@@ -0,0 +1,92 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishFrame(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(QosAtLeastOnce)
+	msg.SetPacketID(10)
+	msg.SetPayload([]byte("send me home"))
+
+	frame, err := NewPublishFrame(msg)
+	assert.NoError(t, err, "should not have error in encoding")
+	assert.Equal(t, msg.Len(), frame.Len(), "frame length should be equal")
+	assert.Equal(t, QosAtLeastOnce, frame.Qos(), "qos should be QosAtLeastOnce")
+	shared := append([]byte(nil), frame.Bytes()...)
+
+	var out bytes.Buffer
+	n, err := frame.WriteTo(&out, 300, false)
+	assert.NoError(t, err, "should not have error in writing")
+	assert.Equal(t, frame.Len(), n, "write length should be equal")
+
+	decoded := NewPublishMessage()
+	_, err = decoded.Decode(out.Bytes())
+	assert.NoError(t, err, "should not have error in decoding")
+	assert.Equal(t, uint16(300), decoded.PacketID(), "packet id should be patched")
+	assert.Equal(t, msg.Payload(), decoded.Payload(), "payload should be equal")
+	assert.False(t, decoded.IsDup(), "dup should not be set")
+	assert.Equal(t, shared, frame.Bytes(), "shared frame should not be modified")
+
+	out.Reset()
+	frame.WriteTo(&out, 300, true)
+	decoded.Decode(out.Bytes())
+	assert.True(t, decoded.IsDup(), "dup should be set for redelivery")
+	assert.Equal(t, uint16(300), decoded.PacketID(), "packet id should be patched")
+	assert.Equal(t, shared, frame.Bytes(), "shared frame should not be modified")
+
+	frame.Retain()
+	frame.Release()
+	assert.NotNil(t, frame.Bytes(), "frame should be kept while referenced")
+	frame.Release()
+	assert.Nil(t, frame.Bytes(), "frame should be released after the last reference")
+	assert.Panics(t, frame.Release, "release too many times should panic")
+}
+
+func TestPublishFrameQos0(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetPayload([]byte("send me home"))
+
+	frame, err := NewPublishFrame(msg)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	var out bytes.Buffer
+	frame.WriteTo(&out, 300, true)
+	assert.Equal(t, frame.Bytes(), out.Bytes(), "qos 0 frame should be written as it is")
+	frame.Release()
+}
+
+func TestLoadPublishFrame(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(QosExactlyOnce)
+	msg.SetPacketID(10)
+	msg.SetPayload([]byte("send me home"))
+	frame, err := NewPublishFrame(msg)
+	assert.NoError(t, err)
+	defer frame.Release()
+
+	loaded, err := LoadPublishFrame(frame.Bytes())
+	assert.NoError(t, err, "should not have error in loading")
+	assert.Equal(t, frame.Bytes(), loaded.Bytes())
+	assert.Equal(t, uint16(10), loaded.PacketID())
+
+	var out bytes.Buffer
+	loaded.WriteTo(&out, 300, false)
+	decoded := NewPublishMessage()
+	_, err = decoded.Decode(out.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(300), decoded.PacketID(), "packet id should be patched")
+	loaded.Release()
+
+	_, err = LoadPublishFrame(frame.Bytes()[:5])
+	assert.Error(t, err, "truncated packet should not be loaded")
+	_, err = LoadPublishFrame([]byte{PINGREQ << 4, 0})
+	assert.Equal(t, ErrorMalformed, err)
+}
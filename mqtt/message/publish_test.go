@@ -0,0 +1,56 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishMessageFlag(t *testing.T) {
+	msg := NewPublishMessage()
+
+	msg.SetDup(true)
+	assert.Equal(t, msg.IsDup(), true, "dup flag should be true")
+	msg.SetDup(false)
+	assert.Equal(t, msg.IsDup(), false, "dup flag should be false")
+
+	msg.SetRetain(true)
+	assert.Equal(t, msg.IsRetain(), true, "retain flag should be true")
+
+	assert.NoError(t, msg.SetQos(QosExactlyOnce), "set qos should not return error")
+	assert.Equal(t, msg.Qos(), QosExactlyOnce, "qos should be QosExactlyOnce")
+	assert.NoError(t, msg.SetQos(QosAtLeastOnce), "set qos should not return error")
+	assert.Equal(t, msg.Qos(), QosAtLeastOnce, "qos should be QosAtLeastOnce")
+	assert.Error(t, msg.SetQos(3), "qos 3 is not allowed")
+
+	assert.Equal(t, msg.IsRetain(), true, "retain flag should not be changed by qos")
+	assert.Equal(t, msg.MessageType(), byte(PUBLISH), "message type should be publish")
+}
+
+func TestPublishMessageEncoding(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(QosAtLeastOnce)
+	msg.SetPacketID(10)
+	msg.SetPayload([]byte("send me home"))
+
+	buf := make([]byte, msg.Len())
+	encodeLen, err := msg.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+	assert.Equal(t, encodeLen, len(buf), "encode length should be equal")
+
+	msg2 := &PublishMessage{}
+	decodeLen, err := msg2.Decode(buf)
+	assert.NoError(t, err, "should not return error")
+	assert.Equal(t, encodeLen, decodeLen, "message length should be equal")
+	assert.Equal(t, msg2.Topic(), []byte("sport/tennis"), "topic should be equal")
+	assert.Equal(t, msg2.PacketID(), uint16(10), "packet id should be equal")
+	assert.Equal(t, msg2.Payload(), []byte("send me home"), "payload should be equal")
+
+	// qos 0 message does not carry packet identifier
+	msg.SetQos(QosAtMostOnce)
+	assert.Equal(t, msg.Len(), len(buf)-2, "qos 0 message should not contain packet id")
+
+	_, err = msg2.Decode(buf[:len(buf)-1])
+	assert.Error(t, err, "truncated message should not be decoded")
+}
@@ -0,0 +1,180 @@
+package message
+
+import "fmt"
+
+// ReasonCode MQTT 5.0 reason code, a one byte unsigned value that indicates the result of an operation.
+// Reason Codes less than 0x80 indicate successful completion of an operation,
+// Reason Code values of 0x80 or greater indicate failure.
+type ReasonCode byte
+
+const (
+	ReasonSuccess                     ReasonCode = 0x00
+	ReasonNormalDisconnection         ReasonCode = 0x00
+	ReasonGrantedQos0                 ReasonCode = 0x00
+	ReasonGrantedQos1                 ReasonCode = 0x01
+	ReasonGrantedQos2                 ReasonCode = 0x02
+	ReasonDisconnectWithWill          ReasonCode = 0x04
+	ReasonNoMatchingSubscribers       ReasonCode = 0x10
+	ReasonNoSubscriptionExisted       ReasonCode = 0x11
+	ReasonContinueAuthentication      ReasonCode = 0x18
+	ReasonReAuthenticate              ReasonCode = 0x19
+	ReasonUnspecifiedError            ReasonCode = 0x80
+	ReasonMalformedPacket             ReasonCode = 0x81
+	ReasonProtocolError               ReasonCode = 0x82
+	ReasonImplementationSpecificError ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion  ReasonCode = 0x84
+	ReasonClientIdentifierNotValid    ReasonCode = 0x85
+	ReasonBadUserNameOrPassword       ReasonCode = 0x86
+	ReasonNotAuthorized               ReasonCode = 0x87
+	ReasonServerUnavailable           ReasonCode = 0x88
+	ReasonServerBusy                  ReasonCode = 0x89
+	ReasonBanned                      ReasonCode = 0x8A
+	ReasonServerShuttingDown          ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod     ReasonCode = 0x8C
+	ReasonKeepAliveTimeout            ReasonCode = 0x8D
+	ReasonSessionTakenOver            ReasonCode = 0x8E
+	ReasonTopicFilterInvalid          ReasonCode = 0x8F
+	ReasonTopicNameInvalid            ReasonCode = 0x90
+	ReasonPacketIdentifierInUse       ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound    ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded      ReasonCode = 0x93
+	ReasonTopicAliasInvalid           ReasonCode = 0x94
+	ReasonPacketTooLarge              ReasonCode = 0x95
+	ReasonMessageRateTooHigh          ReasonCode = 0x96
+	ReasonQuotaExceeded               ReasonCode = 0x97
+	ReasonAdministrativeAction        ReasonCode = 0x98
+	ReasonPayloadFormatInvalid        ReasonCode = 0x99
+	ReasonRetainNotSupported          ReasonCode = 0x9A
+	ReasonQosNotSupported             ReasonCode = 0x9B
+	ReasonUseAnotherServer            ReasonCode = 0x9C
+	ReasonServerMoved                 ReasonCode = 0x9D
+	ReasonSharedSubNotSupported       ReasonCode = 0x9E
+	ReasonConnectionRateExceeded      ReasonCode = 0x9F
+	ReasonMaximumConnectTime          ReasonCode = 0xA0
+	ReasonSubIDNotSupported           ReasonCode = 0xA1
+	ReasonWildcardSubNotSupported     ReasonCode = 0xA2
+)
+
+var reasonCodeDesc = map[ReasonCode]string{
+	ReasonSuccess:                     "Success",
+	ReasonGrantedQos1:                 "Granted QoS 1",
+	ReasonGrantedQos2:                 "Granted QoS 2",
+	ReasonDisconnectWithWill:          "Disconnect with Will Message",
+	ReasonNoMatchingSubscribers:       "No matching subscribers",
+	ReasonNoSubscriptionExisted:       "No subscription existed",
+	ReasonContinueAuthentication:      "Continue authentication",
+	ReasonReAuthenticate:              "Re-authenticate",
+	ReasonUnspecifiedError:            "Unspecified error",
+	ReasonMalformedPacket:             "Malformed Packet",
+	ReasonProtocolError:               "Protocol Error",
+	ReasonImplementationSpecificError: "Implementation specific error",
+	ReasonUnsupportedProtocolVersion:  "Unsupported Protocol Version",
+	ReasonClientIdentifierNotValid:    "Client Identifier not valid",
+	ReasonBadUserNameOrPassword:       "Bad User Name or Password",
+	ReasonNotAuthorized:               "Not authorized",
+	ReasonServerUnavailable:           "Server unavailable",
+	ReasonServerBusy:                  "Server busy",
+	ReasonBanned:                      "Banned",
+	ReasonServerShuttingDown:          "Server shutting down",
+	ReasonBadAuthenticationMethod:     "Bad authentication method",
+	ReasonKeepAliveTimeout:            "Keep Alive timeout",
+	ReasonSessionTakenOver:            "Session taken over",
+	ReasonTopicFilterInvalid:          "Topic Filter invalid",
+	ReasonTopicNameInvalid:            "Topic Name invalid",
+	ReasonPacketIdentifierInUse:       "Packet Identifier in use",
+	ReasonPacketIdentifierNotFound:    "Packet Identifier not found",
+	ReasonReceiveMaximumExceeded:      "Receive Maximum exceeded",
+	ReasonTopicAliasInvalid:           "Topic Alias invalid",
+	ReasonPacketTooLarge:              "Packet too large",
+	ReasonMessageRateTooHigh:          "Message rate too high",
+	ReasonQuotaExceeded:               "Quota exceeded",
+	ReasonAdministrativeAction:        "Administrative action",
+	ReasonPayloadFormatInvalid:        "Payload format invalid",
+	ReasonRetainNotSupported:          "Retain not supported",
+	ReasonQosNotSupported:             "QoS not supported",
+	ReasonUseAnotherServer:            "Use another server",
+	ReasonServerMoved:                 "Server moved",
+	ReasonSharedSubNotSupported:       "Shared Subscriptions not supported",
+	ReasonConnectionRateExceeded:      "Connection rate exceeded",
+	ReasonMaximumConnectTime:          "Maximum connect time",
+	ReasonSubIDNotSupported:           "Subscription Identifiers not supported",
+	ReasonWildcardSubNotSupported:     "Wildcard Subscriptions not supported",
+}
+
+// Error description of the reason code
+func (code ReasonCode) Error() string {
+	if desc, ok := reasonCodeDesc[code]; ok {
+		return desc
+	}
+	return fmt.Sprintf("unknown reason code 0x%02x", byte(code))
+}
+
+// IsFailure Reason Code values of 0x80 or greater indicate failure
+func (code ReasonCode) IsFailure() bool {
+	return code >= 0x80
+}
+
+// ReasonCode translate the 3.1.1 connect return code into MQTT 5.0 CONNACK reason code
+func (code ConnAckCode) ReasonCode() ReasonCode {
+	switch code {
+	case ConnAccepted:
+		return ReasonSuccess
+	case UnAcceptableVersion:
+		return ReasonUnsupportedProtocolVersion
+	case IdentifierRejected:
+		return ReasonClientIdentifierNotValid
+	case ServiceUnavailable:
+		return ReasonServerUnavailable
+	case WrongUserNameOrPass:
+		return ReasonBadUserNameOrPassword
+	case NotAuthorized:
+		return ReasonNotAuthorized
+	default:
+		return ReasonUnspecifiedError
+	}
+}
+
+// reason codes which can be used in each packet type
+var validReasonCodes = map[byte][]ReasonCode{
+	CONNACK: {ReasonSuccess, ReasonUnspecifiedError, ReasonMalformedPacket, ReasonProtocolError,
+		ReasonImplementationSpecificError, ReasonUnsupportedProtocolVersion, ReasonClientIdentifierNotValid,
+		ReasonBadUserNameOrPassword, ReasonNotAuthorized, ReasonServerUnavailable, ReasonServerBusy,
+		ReasonBanned, ReasonBadAuthenticationMethod, ReasonTopicNameInvalid, ReasonPacketTooLarge,
+		ReasonQuotaExceeded, ReasonPayloadFormatInvalid, ReasonRetainNotSupported, ReasonQosNotSupported,
+		ReasonUseAnotherServer, ReasonServerMoved, ReasonConnectionRateExceeded},
+	PUBACK: {ReasonSuccess, ReasonNoMatchingSubscribers, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicNameInvalid,
+		ReasonPacketIdentifierInUse, ReasonQuotaExceeded, ReasonPayloadFormatInvalid},
+	PUBREC: {ReasonSuccess, ReasonNoMatchingSubscribers, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicNameInvalid,
+		ReasonPacketIdentifierInUse, ReasonQuotaExceeded, ReasonPayloadFormatInvalid},
+	PUBREL:  {ReasonSuccess, ReasonPacketIdentifierNotFound},
+	PUBCOMP: {ReasonSuccess, ReasonPacketIdentifierNotFound},
+	SUBACK: {ReasonGrantedQos0, ReasonGrantedQos1, ReasonGrantedQos2, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicFilterInvalid,
+		ReasonPacketIdentifierInUse, ReasonQuotaExceeded, ReasonSharedSubNotSupported,
+		ReasonSubIDNotSupported, ReasonWildcardSubNotSupported},
+	UNSUBACK: {ReasonSuccess, ReasonNoSubscriptionExisted, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicFilterInvalid,
+		ReasonPacketIdentifierInUse},
+	DISCONNECT: {ReasonNormalDisconnection, ReasonDisconnectWithWill, ReasonUnspecifiedError,
+		ReasonMalformedPacket, ReasonProtocolError, ReasonImplementationSpecificError, ReasonNotAuthorized,
+		ReasonServerBusy, ReasonServerShuttingDown, ReasonKeepAliveTimeout, ReasonSessionTakenOver,
+		ReasonTopicFilterInvalid, ReasonTopicNameInvalid, ReasonReceiveMaximumExceeded,
+		ReasonTopicAliasInvalid, ReasonPacketTooLarge, ReasonMessageRateTooHigh, ReasonQuotaExceeded,
+		ReasonAdministrativeAction, ReasonPayloadFormatInvalid, ReasonRetainNotSupported,
+		ReasonQosNotSupported, ReasonUseAnotherServer, ReasonServerMoved, ReasonSharedSubNotSupported,
+		ReasonConnectionRateExceeded, ReasonMaximumConnectTime, ReasonSubIDNotSupported,
+		ReasonWildcardSubNotSupported},
+	AUTH: {ReasonSuccess, ReasonContinueAuthentication, ReasonReAuthenticate},
+}
+
+// verifyReasonCode the sender MUST only use the reason codes defined for the packet type
+func verifyReasonCode(t byte, code ReasonCode) error {
+	for _, c := range validReasonCodes[t] {
+		if c == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid reason code 0x%02x", byte(code))
+}
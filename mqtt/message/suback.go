@@ -0,0 +1,119 @@
+package message
+
+import "errors"
+
+// A SUBACK Packet is sent by the Server to the Client to confirm receipt and processing of a SUBSCRIBE Packet.
+// Variable header:
+//       Packet Identifier from the SUBSCRIBE Packet that is being acknowledged: 2
+//       Properties, only in MQTT 5.0
+// Payload:
+//       a list of return codes, each corresponds to a Topic Filter in the SUBSCRIBE Packet
+//       0x00 - Success - Maximum QoS 0
+//       0x01 - Success - Maximum QoS 1
+//       0x02 - Success - Maximum QoS 2
+//       0x80 - Failure
+//       MQTT 5.0 adds more failure reason codes
+//       MQTT 3.1 only has the granted QoS, there is no failure return code
+
+// SubAckMessage struct for suback message
+type SubAckMessage struct {
+	FixedHeader
+	packetID    uint16
+	props       Properties
+	returnCodes []byte
+}
+
+// NewSubAckMessage create new suback message
+func NewSubAckMessage() *SubAckMessage {
+	msg := &SubAckMessage{}
+	msg.SetMessageType(SUBACK)
+	return msg
+}
+
+// PacketID return the packet identifier
+func (msg *SubAckMessage) PacketID() uint16 {
+	return msg.packetID
+}
+
+// SetPacketID set the packet identifier
+func (msg *SubAckMessage) SetPacketID(id uint16) {
+	msg.packetID = id
+}
+
+// Properties return the MQTT 5.0 properties
+func (msg *SubAckMessage) Properties() *Properties {
+	return &msg.props
+}
+
+// ReturnCodes return the return code list
+func (msg *SubAckMessage) ReturnCodes() []byte {
+	return msg.returnCodes
+}
+
+// AddReturnCode append return code for the next topic filter
+func (msg *SubAckMessage) AddReturnCode(code byte) {
+	msg.returnCodes = append(msg.returnCodes, code)
+}
+
+// Len total message length
+func (msg *SubAckMessage) Len() int {
+	msgLen := 2 + len(msg.returnCodes)
+	if msg.isV5() {
+		msgLen += msg.props.Len()
+	}
+	msg.SetRemainLen(uint32(msgLen))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode suback message into network bytes
+func (msg *SubAckMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	b.putUint16(msg.packetID)
+	if msg.isV5() {
+		msg.props.write(b)
+	}
+	b.putBytes(msg.returnCodes)
+	return b.pos, b.err
+}
+
+// Decode decode suback message
+func (msg *SubAckMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.packetID = b.getUint16()
+	msg.props.Reset()
+	if msg.isV5() {
+		msg.props.read(b)
+	}
+	msg.returnCodes = b.getRest()
+	return b.pos, b.err
+}
+
+// Verify verify message
+// SUBACK return codes other than 0x00, 0x01, 0x02 and 0x80 are reserved and MUST NOT be used [MQTT-3.9.3-2].
+func (msg *SubAckMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if msg.packetID == 0 {
+		return ErrorPacketID
+	}
+	if msg.isV5() {
+		for _, code := range msg.returnCodes {
+			if err := verifyReasonCode(SUBACK, ReasonCode(code)); err != nil {
+				return err
+			}
+		}
+		return msg.props.verify(SUBACK)
+	}
+	for _, code := range msg.returnCodes {
+		if code > QosExactlyOnce && (code != QosFailure || msg.version == Version31) {
+			return errors.New("invalid suback return code")
+		}
+	}
+	return nil
+}
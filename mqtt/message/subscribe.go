@@ -0,0 +1,179 @@
+package message
+
+import "errors"
+
+// The SUBSCRIBE Packet is sent from the Client to the Server to create one or more Subscriptions.
+// Fixed header flags: 0010
+// Variable header:
+//       Packet Identifier: 2
+//       Properties, only in MQTT 5.0
+// Payload:
+//       a list of Topic Filters indicating the Topics to which the Client wants to subscribe,
+//       each Topic Filter is followed by a byte called the Requested QoS.
+//       In MQTT 5.0 the byte is called Subscription Options:
+//       Retain Handling: 5-4
+//       Retain As Published: 3
+//       No Local: 2
+//       Maximum QoS: 1-0
+
+// SubscribeMessage struct for subscribe message
+type SubscribeMessage struct {
+	FixedHeader
+	packetID uint16
+	props    Properties
+	topics   [][]byte
+	options  []byte
+}
+
+// NewSubscribeMessage create new subscribe message
+func NewSubscribeMessage() *SubscribeMessage {
+	msg := &SubscribeMessage{}
+	msg.SetMessageType(SUBSCRIBE)
+	msg.ControlFlag |= 0x02
+	return msg
+}
+
+// PacketID return the packet identifier
+func (msg *SubscribeMessage) PacketID() uint16 {
+	return msg.packetID
+}
+
+// SetPacketID set the packet identifier
+func (msg *SubscribeMessage) SetPacketID(id uint16) {
+	msg.packetID = id
+}
+
+// Properties return the MQTT 5.0 properties
+func (msg *SubscribeMessage) Properties() *Properties {
+	return &msg.props
+}
+
+// Topics return the topic filters of the subscription
+func (msg *SubscribeMessage) Topics() [][]byte {
+	return msg.topics
+}
+
+// Qos return the requested qos list, in the same order with Topics
+func (msg *SubscribeMessage) Qos() []byte {
+	qos := make([]byte, len(msg.options))
+	for i, o := range msg.options {
+		qos[i] = o & 0x03
+	}
+	return qos
+}
+
+// Options return the subscription options list, in the same order with Topics
+func (msg *SubscribeMessage) Options() []byte {
+	return msg.options
+}
+
+// AddTopic add a topic filter with requested qos,
+// the qos is replaced if the topic filter already exists
+func (msg *SubscribeMessage) AddTopic(topic []byte, qos byte) error {
+	if qos > QosExactlyOnce {
+		return ErrorInvalidQos
+	}
+	return msg.AddTopicOptions(topic, qos)
+}
+
+// AddTopicOptions add a topic filter with MQTT 5.0 subscription options,
+// the options are replaced if the topic filter already exists
+func (msg *SubscribeMessage) AddTopicOptions(topic []byte, options byte) error {
+	for i, t := range msg.topics {
+		if string(t) == string(topic) {
+			msg.options[i] = options
+			return nil
+		}
+	}
+
+	msg.topics = append(msg.topics, topic)
+	msg.options = append(msg.options, options)
+	return nil
+}
+
+func (msg *SubscribeMessage) msgLen() int {
+	msgLen := 2
+	if msg.isV5() {
+		msgLen += msg.props.Len()
+	}
+	for _, t := range msg.topics {
+		msgLen += 2 + len(t) + 1
+	}
+	return msgLen
+}
+
+// Len total message length
+func (msg *SubscribeMessage) Len() int {
+	msg.SetRemainLen(uint32(msg.msgLen()))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode subscribe message into network bytes
+func (msg *SubscribeMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	b.putUint16(msg.packetID)
+	if msg.isV5() {
+		msg.props.write(b)
+	}
+	for i, t := range msg.topics {
+		b.putLPBytes(t)
+		b.putByte(msg.options[i])
+	}
+	return b.pos, b.err
+}
+
+// Decode decode subscribe message
+func (msg *SubscribeMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.packetID = b.getUint16()
+	msg.props.Reset()
+	if msg.isV5() {
+		msg.props.read(b)
+	}
+
+	msg.topics, msg.options = msg.topics[:0], msg.options[:0]
+	for b.err == nil && b.Remain() > 0 {
+		msg.topics = append(msg.topics, b.getLPBytes())
+		msg.options = append(msg.options, b.getByte())
+	}
+	return b.pos, b.err
+}
+
+// Verify verify message
+// Bits 3,2,1 and 0 of the fixed header of the SUBSCRIBE Control Packet are reserved and MUST be
+// set to 0,0,1 and 0 respectively [MQTT-3.8.1-1].
+// The payload of a SUBSCRIBE packet MUST contain at least one Topic Filter / QoS pair [MQTT-3.8.3-3].
+// The Server MUST treat a SUBSCRIBE packet as malformed if any of Reserved bits in the payload
+// are non-zero, or QoS is not 0,1 or 2 [MQTT-3-8.3-4].
+// In MQTT 5.0 bits 7 and 6 of the Subscription Options are reserved, and Retain Handling must not be 3.
+func (msg *SubscribeMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if msg.packetID == 0 {
+		return ErrorPacketID
+	}
+	if len(msg.topics) == 0 {
+		return errors.New("subscribe message must contain at least one topic filter")
+	}
+	for _, o := range msg.options {
+		if o&0x03 > QosExactlyOnce {
+			return ErrorInvalidQos
+		}
+		if !msg.isV5() && o&0xfc != 0 {
+			return ErrorReservedFlag
+		}
+		if msg.isV5() && (o&0xc0 != 0 || o&0x30 == 0x30) {
+			return ErrorReservedFlag
+		}
+	}
+	if msg.isV5() {
+		return msg.props.verify(SUBSCRIBE)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribeMessageEncoding(t *testing.T) {
+	msg := NewSubscribeMessage()
+	msg.SetPacketID(7)
+	msg.AddTopic([]byte("sport/tennis/#"), QosAtLeastOnce)
+	msg.AddTopic([]byte("sport/+/player1"), QosExactlyOnce)
+	msg.AddTopic([]byte("sport/tennis/#"), QosAtMostOnce)
+
+	assert.Equal(t, len(msg.Topics()), 2, "duplicated topic should be replaced")
+
+	buf := make([]byte, msg.Len())
+	encodeLen, err := msg.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+	assert.Equal(t, buf[0], byte(0x82), "subscribe flags should be 0010")
+
+	msg2 := &SubscribeMessage{}
+	decodeLen, err := msg2.Decode(buf)
+	assert.NoError(t, err, "should not return error")
+	assert.Equal(t, encodeLen, decodeLen, "message length should be equal")
+	assert.Equal(t, msg2.PacketID(), uint16(7), "packet id should be equal")
+	assert.Equal(t, msg2.Topics(), msg.Topics(), "topics should be equal")
+	assert.Equal(t, msg2.Qos(), []byte{QosAtMostOnce, QosExactlyOnce}, "qos should be equal")
+}
+
+func TestUnsubscribeMessageEncoding(t *testing.T) {
+	msg := NewUnsubscribeMessage()
+	msg.SetPacketID(8)
+	msg.AddTopic([]byte("sport/tennis/#"))
+	msg.AddTopic([]byte("/finance"))
+
+	buf := make([]byte, msg.Len())
+	_, err := msg.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+
+	msg2 := &UnsubscribeMessage{}
+	_, err = msg2.Decode(buf)
+	assert.NoError(t, err, "should not return error")
+	assert.Equal(t, msg2.PacketID(), uint16(8), "packet id should be equal")
+	assert.Equal(t, msg2.Topics(), msg.Topics(), "topics should be equal")
+}
+
+func TestSubAckMessageEncoding(t *testing.T) {
+	msg := NewSubAckMessage()
+	msg.SetPacketID(7)
+	msg.AddReturnCode(QosAtLeastOnce)
+	msg.AddReturnCode(QosFailure)
+
+	buf := make([]byte, msg.Len())
+	_, err := msg.Encode(buf)
+	assert.NoError(t, err, "should not have error in encoding")
+	assert.Equal(t, buf, []byte{0x90, 0x04, 0x00, 0x07, 0x01, 0x80}, "suback bytes should be equal")
+
+	msg2 := &SubAckMessage{}
+	_, err = msg2.Decode(buf)
+	assert.NoError(t, err, "should not return error")
+	assert.Equal(t, msg2.ReturnCodes(), []byte{QosAtLeastOnce, QosFailure}, "return codes should be equal")
+}
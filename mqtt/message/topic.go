@@ -0,0 +1,96 @@
+package message
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// Topic Names and Topic Filters are UTF-8 encoded strings:
+// All Topic Names and Topic Filters MUST be at least one character long [MQTT-4.7.3-1].
+// Topic Names and Topic Filters MUST NOT include the null character (Unicode U+0000) [MQTT-4.7.3-2].
+// Topic Names and Topic Filters are UTF-8 encoded strings, they MUST NOT encode to more than 65535 bytes [MQTT-4.7.3-3].
+// The character data MUST be well-formed UTF-8 and MUST NOT include the surrogates U+D800 to U+DFFF [MQTT-1.5.3-1].
+
+const (
+	topicSeparator      = '/'
+	multiLevelWildcard  = '#'
+	singleLevelWildcard = '+'
+
+	maxTopicLen = 65535
+
+	// SharePrefix the prefix of the shared subscription "$share/{ShareName}/{filter}"
+	SharePrefix = "$share/"
+)
+
+func validTopicString(topic []byte) bool {
+	if len(topic) == 0 || len(topic) > maxTopicLen {
+		return false
+	}
+	// utf8.Valid rejects the surrogates too
+	return utf8.Valid(topic) && bytes.IndexByte(topic, 0) < 0
+}
+
+// ValidTopicName verify the topic name of PUBLISH
+// The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters [MQTT-3.3.2-2].
+func ValidTopicName(topic []byte) error {
+	if !validTopicString(topic) {
+		return ErrorInvalidTopic
+	}
+	if bytes.IndexByte(topic, multiLevelWildcard) >= 0 || bytes.IndexByte(topic, singleLevelWildcard) >= 0 {
+		return ErrorInvalidTopic
+	}
+	return nil
+}
+
+// ValidTopicFilter verify the topic filter of SUBSCRIBE and UNSUBSCRIBE
+// The multi-level wildcard character MUST be specified either on its own or following a topic level separator.
+// In either case it MUST be the last character specified in the Topic Filter [MQTT-4.7.1-2].
+// The single-level wildcard can be used at any level in the Topic Filter, but it MUST occupy
+// an entire level of the filter [MQTT-4.7.1-3].
+func ValidTopicFilter(filter []byte) error {
+	if !validTopicString(filter) {
+		return ErrorInvalidTopic
+	}
+
+	for i, c := range filter {
+		switch c {
+		case multiLevelWildcard:
+			if i != len(filter)-1 || (i > 0 && filter[i-1] != topicSeparator) {
+				return ErrorInvalidTopic
+			}
+		case singleLevelWildcard:
+			if i > 0 && filter[i-1] != topicSeparator {
+				return ErrorInvalidTopic
+			}
+			if i < len(filter)-1 && filter[i+1] != topicSeparator {
+				return ErrorInvalidTopic
+			}
+		}
+	}
+
+	if bytes.HasPrefix(filter, []byte(SharePrefix)) {
+		if _, _, ok := SplitShared(filter); !ok {
+			return ErrorInvalidTopic
+		}
+	}
+	return nil
+}
+
+// SplitShared split the shared subscription into the share name and the topic filter, ok is false
+// if it is not a valid shared subscription. The ShareName MUST NOT contain "/", "+" or "#",
+// and it MUST be followed by "/" and a Topic Filter [MQTT-4.8.2-1] [MQTT-4.8.2-2]
+func SplitShared(filter []byte) (name []byte, topic []byte, ok bool) {
+	if !bytes.HasPrefix(filter, []byte(SharePrefix)) {
+		return nil, nil, false
+	}
+	rest := filter[len(SharePrefix):]
+	i := bytes.IndexByte(rest, topicSeparator)
+	if i <= 0 || i == len(rest)-1 {
+		return nil, nil, false
+	}
+	name, topic = rest[:i], rest[i+1:]
+	if bytes.ContainsAny(name, "+#") {
+		return nil, nil, false
+	}
+	return name, topic, true
+}
@@ -0,0 +1,60 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidTopicName(t *testing.T) {
+	valid := []string{"sport/tennis/player1", "/finance", "sport/", "/", "$SYS/broker", "spört"}
+	for _, topic := range valid {
+		assert.NoError(t, ValidTopicName([]byte(topic)), "%q should be valid", topic)
+	}
+
+	invalid := []string{"", "sport/+", "sport/#", "#", "sport\x00tennis", "\xff\xfe", "\xed\xa0\x80"}
+	for _, topic := range invalid {
+		assert.Equal(t, ErrorInvalidTopic, ValidTopicName([]byte(topic)), "%q should be invalid", topic)
+	}
+
+	assert.NoError(t, ValidTopicName(bytes.Repeat([]byte("a"), 65535)))
+	assert.Error(t, ValidTopicName(bytes.Repeat([]byte("a"), 65536)))
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	valid := []string{"#", "+", "sport/#", "sport/tennis/#", "+/tennis/#", "sport/+/player1", "+/+", "/+", "sport/tennis"}
+	for _, filter := range valid {
+		assert.NoError(t, ValidTopicFilter([]byte(filter)), "%q should be valid", filter)
+	}
+
+	invalid := []string{"", "sport/tennis#", "sport/tennis/#/ranking", "a/#/b", "sport+", "sport/+tennis", "##", "sport\x00", "\xc3"}
+	for _, filter := range invalid {
+		assert.Equal(t, ErrorInvalidTopic, ValidTopicFilter([]byte(filter)), "%q should be invalid", filter)
+	}
+}
+
+func TestPublishMessageTopic(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sport/+"))
+	assert.Equal(t, ErrorInvalidTopic, msg.Verify(), "wildcard is not allowed in topic name")
+
+	msg.SetTopic([]byte("sport/tennis"))
+	assert.NoError(t, msg.Verify())
+}
+
+func TestSharedTopicFilter(t *testing.T) {
+	name, filter, ok := SplitShared([]byte("$share/workers/sport/#"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("workers"), name)
+	assert.Equal(t, []byte("sport/#"), filter)
+
+	_, _, ok = SplitShared([]byte("sport/#"))
+	assert.False(t, ok, "not a shared subscription")
+
+	assert.NoError(t, ValidTopicFilter([]byte("$share/workers/+")))
+	invalid := []string{"$share/workers", "$share/workers/", "$share//sport", "$share/+/sport", "$share/a#/sport", "$share/workers/sport#"}
+	for _, filter := range invalid {
+		assert.Equal(t, ErrorInvalidTopic, ValidTopicFilter([]byte(filter)), "%q should be invalid", filter)
+	}
+}
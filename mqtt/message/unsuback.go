@@ -0,0 +1,115 @@
+package message
+
+// The UNSUBACK Packet is sent by the Server to the Client to confirm receipt of an UNSUBSCRIBE Packet.
+// Variable header:
+//       Packet Identifier of the UNSUBSCRIBE Packet that is being acknowledged: 2
+//       Properties, only in MQTT 5.0
+// Payload:
+//       No payload before MQTT 5.0, in MQTT 5.0 it contains a list of Reason Codes,
+//       each corresponds to a Topic Filter in the UNSUBSCRIBE packet
+
+// UnsubAckMessage struct for unsuback message
+type UnsubAckMessage struct {
+	FixedHeader
+	packetID    uint16
+	props       Properties
+	reasonCodes []byte
+}
+
+// NewUnsubAckMessage create new unsuback message
+func NewUnsubAckMessage() *UnsubAckMessage {
+	msg := &UnsubAckMessage{}
+	msg.SetMessageType(UNSUBACK)
+	return msg
+}
+
+// PacketID return the packet identifier
+func (msg *UnsubAckMessage) PacketID() uint16 {
+	return msg.packetID
+}
+
+// SetPacketID set the packet identifier
+func (msg *UnsubAckMessage) SetPacketID(id uint16) {
+	msg.packetID = id
+}
+
+// Properties return the MQTT 5.0 properties
+func (msg *UnsubAckMessage) Properties() *Properties {
+	return &msg.props
+}
+
+// ReasonCodes return the MQTT 5.0 reason code list
+func (msg *UnsubAckMessage) ReasonCodes() []byte {
+	return msg.reasonCodes
+}
+
+// AddReasonCode append reason code for the next topic filter, only encoded in MQTT 5.0
+func (msg *UnsubAckMessage) AddReasonCode(code ReasonCode) {
+	msg.reasonCodes = append(msg.reasonCodes, byte(code))
+}
+
+func (msg *UnsubAckMessage) msgLen() int {
+	if !msg.isV5() {
+		return 2
+	}
+	return 2 + msg.props.Len() + len(msg.reasonCodes)
+}
+
+// Len total message length
+func (msg *UnsubAckMessage) Len() int {
+	msg.SetRemainLen(uint32(msg.msgLen()))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode unsuback message into network bytes
+func (msg *UnsubAckMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	b.putUint16(msg.packetID)
+	if msg.isV5() {
+		msg.props.write(b)
+		b.putBytes(msg.reasonCodes)
+	}
+	return b.pos, b.err
+}
+
+// Decode decode unsuback message
+func (msg *UnsubAckMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.packetID = b.getUint16()
+	msg.props.Reset()
+	msg.reasonCodes = nil
+	if msg.isV5() {
+		msg.props.read(b)
+		msg.reasonCodes = b.getRest()
+	} else {
+		b.getRest()
+	}
+	return b.pos, b.err
+}
+
+// Verify verify message
+func (msg *UnsubAckMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if msg.packetID == 0 {
+		return ErrorPacketID
+	}
+	if !msg.isV5() {
+		if msg.remainLen > 2 {
+			return ErrorMalformed
+		}
+		return nil
+	}
+	for _, code := range msg.reasonCodes {
+		if err := verifyReasonCode(UNSUBACK, ReasonCode(code)); err != nil {
+			return err
+		}
+	}
+	return msg.props.verify(UNSUBACK)
+}
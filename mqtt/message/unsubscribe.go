@@ -0,0 +1,122 @@
+package message
+
+import "errors"
+
+// An UNSUBSCRIBE Packet is sent by the Client to the Server, to unsubscribe from topics.
+// Fixed header flags: 0010
+// Variable header:
+//       Packet Identifier: 2
+//       Properties, only in MQTT 5.0
+// Payload:
+//       the list of Topic Filters that the Client wishes to unsubscribe from
+
+// UnsubscribeMessage struct for unsubscribe message
+type UnsubscribeMessage struct {
+	FixedHeader
+	packetID uint16
+	props    Properties
+	topics   [][]byte
+}
+
+// NewUnsubscribeMessage create new unsubscribe message
+func NewUnsubscribeMessage() *UnsubscribeMessage {
+	msg := &UnsubscribeMessage{}
+	msg.SetMessageType(UNSUBSCRIBE)
+	msg.ControlFlag |= 0x02
+	return msg
+}
+
+// PacketID return the packet identifier
+func (msg *UnsubscribeMessage) PacketID() uint16 {
+	return msg.packetID
+}
+
+// SetPacketID set the packet identifier
+func (msg *UnsubscribeMessage) SetPacketID(id uint16) {
+	msg.packetID = id
+}
+
+// Properties return the MQTT 5.0 properties
+func (msg *UnsubscribeMessage) Properties() *Properties {
+	return &msg.props
+}
+
+// Topics return the topic filters to unsubscribe
+func (msg *UnsubscribeMessage) Topics() [][]byte {
+	return msg.topics
+}
+
+// AddTopic add a topic filter
+func (msg *UnsubscribeMessage) AddTopic(topic []byte) {
+	msg.topics = append(msg.topics, topic)
+}
+
+func (msg *UnsubscribeMessage) msgLen() int {
+	msgLen := 2
+	if msg.isV5() {
+		msgLen += msg.props.Len()
+	}
+	for _, t := range msg.topics {
+		msgLen += 2 + len(t)
+	}
+	return msgLen
+}
+
+// Len total message length
+func (msg *UnsubscribeMessage) Len() int {
+	msg.SetRemainLen(uint32(msg.msgLen()))
+	return msg.headerLen() + int(msg.remainLen)
+}
+
+// Encode encode unsubscribe message into network bytes
+func (msg *UnsubscribeMessage) Encode(dst []byte) (int, error) {
+	b := NewMessageBuffer(dst, msg.Len())
+	msg.writeHeader(b)
+	b.putUint16(msg.packetID)
+	if msg.isV5() {
+		msg.props.write(b)
+	}
+	for _, t := range msg.topics {
+		b.putLPBytes(t)
+	}
+	return b.pos, b.err
+}
+
+// Decode decode unsubscribe message
+func (msg *UnsubscribeMessage) Decode(buf []byte) (int, error) {
+	b := NewMessageBuffer(buf, len(buf))
+	if err := msg.readHeader(b); err != nil {
+		return 0, err
+	}
+
+	msg.packetID = b.getUint16()
+	msg.props.Reset()
+	if msg.isV5() {
+		msg.props.read(b)
+	}
+
+	msg.topics = msg.topics[:0]
+	for b.err == nil && b.Remain() > 0 {
+		msg.topics = append(msg.topics, b.getLPBytes())
+	}
+	return b.pos, b.err
+}
+
+// Verify verify message
+// Bits 3,2,1 and 0 of the fixed header are reserved and MUST be set to 0,0,1 and 0 [MQTT-3.10.1-1].
+// The Payload of an UNSUBSCRIBE packet MUST contain at least one Topic Filter [MQTT-3.10.3-2].
+func (msg *UnsubscribeMessage) Verify() error {
+	if err := msg.verifyFlag(); err != nil {
+		return err
+	}
+	if msg.packetID == 0 {
+		return ErrorPacketID
+	}
+	if len(msg.topics) == 0 {
+		return errors.New("unsubscribe message must contain at least one topic filter")
+	}
+	if msg.isV5() {
+		return msg.props.verify(UNSUBSCRIBE)
+	}
+	return nil
+}
@@ -23,46 +23,45 @@ func parseVariableLen(buf []byte) (int, int, error) {
 	return value, index, nil
 }
 
+// readVint read the variable byte integer, the least significant seven bits of each byte encode
+// the data, and the most significant bit is used to indicate that there are following bytes.
+// The maximum number of bytes in the Variable Byte Integer field is four.
 func readVint(buf []byte) (uint32, int, error) {
-	v, l := binary.Uvarint(buf)
-	return uint32(v), l, nil
-	/*var multiplier uint32 = 1
+	var multiplier uint32 = 1
 	var value uint32
-	index := 0
-	for _, b := range buf[:] {
-		index++
+	for index, b := range buf {
 		value += uint32(b&127) * multiplier
+		if b&128 == 0 {
+			return value, index + 1, nil
+		}
 		multiplier *= 128
-		if multiplier > 128*128*128 {
+		if index >= 3 {
 			return 0, 0, errors.New("malformed remain length")
 		}
-		if b&128 == 0 {
-			break
-		}
 	}
-	return value, index, nil*/
+	return 0, 0, errors.New("not enough bytes to decode remain length")
 }
 
-func writeVint(buf []byte, v uint32) int {
-
-	n := binary.PutUvarint(buf[:], uint64(v))
-	return n
+// ReadVint decode the variable byte integer, return the value and the number of bytes used
+func ReadVint(buf []byte) (uint32, int, error) {
+	return readVint(buf)
+}
 
-	/*
-		i := 0
-		for {
-			encodeByte := v % 128
-			v = v / 128
-			if v > 0 {
-				encodeByte = encodeByte | 0x80
-			}
-			buf[i] = byte(encodeByte)
-			i++
-			if v <= 0 {
-				break
-			}
+func writeVint(buf []byte, v uint32) int {
+	i := 0
+	for {
+		encodeByte := v % 128
+		v = v / 128
+		if v > 0 {
+			encodeByte = encodeByte | 0x80
+		}
+		buf[i] = byte(encodeByte)
+		i++
+		if v <= 0 {
+			break
 		}
-		return i*/
+	}
+	return i
 }
 
 func vintLen(v uint32) int {
@@ -78,12 +77,15 @@ func vintLen(v uint32) int {
 }
 
 func readLPBytes(msg []byte) ([]byte, int, error) {
+	if len(msg) < 2 {
+		return nil, 0, errors.New("buffer not contain enough bytes to decode")
+	}
 	length := binary.BigEndian.Uint16(msg[:2])
-	if len(msg) < int(length+2) {
+	if len(msg) < int(length)+2 {
 		return nil, 0, errors.New("buffer not contain enough bytes to decode")
 	}
 
-	return msg[2 : 2+length], int(length + 2), nil
+	return msg[2 : 2+int(length)], int(length) + 2, nil
 }
 
 func writeLPBytes(dest []byte, src []byte) (int, error) {
@@ -0,0 +1,245 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+)
+
+// RetainedMessage the last retained message of a topic
+type RetainedMessage struct {
+	Topic      string
+	Qos        byte
+	Payload    []byte
+	Properties []message.Property
+}
+
+// newRetainedMessage copy the PUBLISH message, it refers to the incoming frame which is released after processing
+func newRetainedMessage(msg *message.PublishMessage) *RetainedMessage {
+	retained := &RetainedMessage{
+		Topic:   string(msg.Topic()),
+		Qos:     msg.Qos(),
+		Payload: append([]byte(nil), msg.Payload()...),
+	}
+	for _, p := range msg.Properties().Items() {
+		p.Data = append([]byte(nil), p.Data...)
+		p.Pair = append([]byte(nil), p.Pair...)
+		retained.Properties = append(retained.Properties, p)
+	}
+	return retained
+}
+
+// publishMessage the PUBLISH message with the retain flag set, it is sent to the new subscriptions
+func (retained *RetainedMessage) publishMessage() *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(retained.Topic))
+	msg.SetQos(retained.Qos)
+	msg.SetPayload(retained.Payload)
+	msg.SetRetain(true)
+	for _, p := range retained.Properties {
+		msg.Properties().Add(p)
+	}
+	return msg
+}
+
+// RetainedStore keep the last retained message of each topic, it is indexed by the topic levels,
+// so the messages matching a topic filter with wildcards are found without scanning all of them
+type RetainedStore interface {
+	// Retain replace the retained message of the topic, the message with a zero-length payload
+	// removes it [MQTT-3.3.1-10]
+	Retain(msg *RetainedMessage) error
+
+	// Match return the retained messages whose topic matches the topic filter
+	Match(filter string) []*RetainedMessage
+
+	// Len the number of the retained messages
+	Len() int
+
+	Close() error
+}
+
+// retainedNode one level of the retained topics
+type retainedNode struct {
+	children map[string]*retainedNode
+	msg      *RetainedMessage
+}
+
+func newRetainedNode() *retainedNode {
+	return &retainedNode{children: make(map[string]*retainedNode)}
+}
+
+// insert return the replaced message
+func (node *retainedNode) insert(levels []string, msg *RetainedMessage) *RetainedMessage {
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			child = newRetainedNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	old := node.msg
+	node.msg = msg
+	return old
+}
+
+// remove return the removed message, the levels left without messages are removed
+func (node *retainedNode) remove(levels []string) *RetainedMessage {
+	if len(levels) == 0 {
+		old := node.msg
+		node.msg = nil
+		return old
+	}
+	child, ok := node.children[levels[0]]
+	if !ok {
+		return nil
+	}
+	old := child.remove(levels[1:])
+	if child.msg == nil && len(child.children) == 0 {
+		delete(node.children, levels[0])
+	}
+	return old
+}
+
+// match the topics starting with $ are not matched by the filters starting with a wildcard [MQTT-4.7.2-1]
+func (node *retainedNode) match(filter []string, i int, fn func(*RetainedMessage)) {
+	if i == len(filter) {
+		if node.msg != nil {
+			fn(node.msg)
+		}
+		return
+	}
+
+	switch filter[i] {
+	case MWC:
+		node.visit(i == 0, fn)
+	case SWC:
+		for name, child := range node.children {
+			if i == 0 && strings.HasPrefix(name, SYS) {
+				continue
+			}
+			child.match(filter, i+1, fn)
+		}
+	default:
+		if child, ok := node.children[filter[i]]; ok {
+			child.match(filter, i+1, fn)
+		}
+	}
+}
+
+// visit the message of the node and all the levels below, "sport/#" matches "sport" too
+func (node *retainedNode) visit(top bool, fn func(*RetainedMessage)) {
+	if node.msg != nil {
+		fn(node.msg)
+	}
+	for name, child := range node.children {
+		if top && strings.HasPrefix(name, SYS) {
+			continue
+		}
+		child.visit(false, fn)
+	}
+}
+
+// MemoryRetainedStore keep the retained messages in memory, they are lost when the broker exits
+type MemoryRetainedStore struct {
+	root *retainedNode
+	n    int
+	lock sync.RWMutex
+}
+
+func NewMemoryRetainedStore() *MemoryRetainedStore {
+	return &MemoryRetainedStore{root: newRetainedNode()}
+}
+
+func (store *MemoryRetainedStore) Retain(msg *RetainedMessage) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.retain(msg)
+	return nil
+}
+
+// retain update the index, it is called with the store locked
+func (store *MemoryRetainedStore) retain(msg *RetainedMessage) {
+	levels := strings.Split(msg.Topic, SEP)
+	if len(msg.Payload) == 0 {
+		if store.root.remove(levels) != nil {
+			store.n--
+		}
+	} else if store.root.insert(levels, msg) == nil {
+		store.n++
+	}
+}
+
+func (store *MemoryRetainedStore) Match(filter string) []*RetainedMessage {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	var msgs []*RetainedMessage
+	store.root.match(strings.Split(filter, SEP), 0, func(msg *RetainedMessage) {
+		msgs = append(msgs, msg)
+	})
+	return msgs
+}
+
+func (store *MemoryRetainedStore) Len() int {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.n
+}
+
+func (store *MemoryRetainedStore) Close() error {
+	return nil
+}
+
+// FileRetainedStore keep the retained messages in an append-only file and index them in memory,
+// the messages are loaded when the store is opened
+type FileRetainedStore struct {
+	MemoryRetainedStore
+	log *appendLog
+}
+
+// NewFileRetainedStore open the store of the file, the file is created if it does not exist
+func NewFileRetainedStore(path string) (*FileRetainedStore, error) {
+	log, err := openAppendLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileRetainedStore{
+		MemoryRetainedStore: MemoryRetainedStore{root: newRetainedNode()},
+		log:                 log,
+	}
+	for _, data := range log.list() {
+		var msg RetainedMessage
+		if err := decodeValue(data, &msg); err != nil {
+			log.close()
+			return nil, err
+		}
+		store.retain(&msg)
+	}
+	return store, nil
+}
+
+func (store *FileRetainedStore) Retain(msg *RetainedMessage) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var err error
+	if len(msg.Payload) == 0 {
+		err = store.log.delete(msg.Topic)
+	} else {
+		err = store.log.put(msg.Topic, msg)
+	}
+	if err != nil {
+		return err
+	}
+	store.retain(msg)
+	return nil
+}
+
+func (store *FileRetainedStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.log.close()
+}
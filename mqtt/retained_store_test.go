@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func matchTopics(store RetainedStore, filter string) []string {
+	topics := make([]string, 0)
+	for _, msg := range store.Match(filter) {
+		topics = append(topics, msg.Topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func testRetainedStore(t *testing.T, store RetainedStore) {
+	for _, topic := range []string{"sport", "sport/tennis/player1", "sport/tennis/player2", "finance", "$SYS/broker/uptime"} {
+		assert.NoError(t, store.Retain(&RetainedMessage{Topic: topic, Qos: 1, Payload: []byte(topic)}))
+	}
+	assert.NoError(t, store.Retain(&RetainedMessage{Topic: "sport", Payload: []byte("replaced")}))
+	assert.Equal(t, 5, store.Len())
+
+	assert.Equal(t, []string{"sport", "sport/tennis/player1", "sport/tennis/player2"}, matchTopics(store, "sport/#"))
+	assert.Equal(t, []string{"sport/tennis/player1", "sport/tennis/player2"}, matchTopics(store, "sport/+/+"))
+	assert.Equal(t, []string{"finance", "sport"}, matchTopics(store, "+"))
+	assert.Equal(t, []string{"finance", "sport", "sport/tennis/player1", "sport/tennis/player2"}, matchTopics(store, "#"))
+	assert.Equal(t, []string{"$SYS/broker/uptime"}, matchTopics(store, "$SYS/#"))
+	assert.Equal(t, []string{"sport/tennis/player1"}, matchTopics(store, "sport/tennis/player1"))
+	assert.Equal(t, []byte("replaced"), store.Match("sport")[0].Payload)
+
+	assert.NoError(t, store.Retain(&RetainedMessage{Topic: "sport/tennis/player1"}), "empty payload removes the message")
+	assert.NoError(t, store.Retain(&RetainedMessage{Topic: "sport/unknown"}))
+	assert.Equal(t, []string{"sport/tennis/player2"}, matchTopics(store, "sport/tennis/+"))
+	assert.Equal(t, 4, store.Len())
+}
+
+func TestMemoryRetainedStore(t *testing.T) {
+	store := NewMemoryRetainedStore()
+	testRetainedStore(t, store)
+
+	store.Retain(&RetainedMessage{Topic: "sport/tennis/player2"})
+	assert.Empty(t, store.root.children["sport"].children, "unused levels should be removed")
+}
+
+func TestFileRetainedStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retained")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "retained.db")
+
+	store, err := NewFileRetainedStore(path)
+	assert.NoError(t, err)
+	testRetainedStore(t, store)
+	assert.NoError(t, store.Close())
+	assert.Equal(t, ErrStoreClosed, store.Retain(&RetainedMessage{Topic: "sport", Payload: []byte("x")}))
+
+	store, err = NewFileRetainedStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, 4, store.Len(), "the retained messages should be loaded")
+	assert.Equal(t, []string{"sport", "sport/tennis/player2"}, matchTopics(store, "sport/#"))
+	assert.Equal(t, byte(1), store.Match("sport/tennis/player2")[0].Qos)
+}
+
+func TestRetainedMessage(t *testing.T) {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport"))
+	msg.SetQos(message.QosAtLeastOnce)
+	msg.SetPayload([]byte("score"))
+	msg.Properties().SetData(message.PropContentType, []byte("text/plain"))
+
+	retained := newRetainedMessage(msg)
+	msg.Payload()[0] = 'x'
+	assert.Equal(t, []byte("score"), retained.Payload, "payload should be copied")
+	assert.Equal(t, 1, len(retained.Properties))
+
+	out := retained.publishMessage()
+	assert.True(t, out.IsRetain())
+	assert.Equal(t, message.QosAtLeastOnce, out.Qos())
+	contentType, _ := out.Properties().Data(message.PropContentType)
+	assert.Equal(t, []byte("text/plain"), contentType)
+}
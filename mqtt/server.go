@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/surgemq/message"
+	"github.com/golang/glog"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 )
 
 // Server basic structure
@@ -15,13 +17,37 @@ type Server struct {
 	serviceId int64
 	address   string
 
+	// the sequence of the client ids assigned to the clients connecting with an empty one
+	clientSeq uint64
+
 	connectTimeout time.Duration
+	maxPacketSize  int
+	retryInterval  time.Duration
+	maxInflight    int
+
+	// the keepalive limit and the keepalive of the clients which do not set it, in seconds
+	maxKeepAlive     uint16
+	defaultKeepAlive uint16
+
+	// the maximum session expiry interval, 0 means the persistent sessions never expire
+	sessionExpiry time.Duration
+
+	// the traffic counters and the interval of publishing the $SYS topics, 0 turns them off
+	stats       *Stats
+	sysInterval time.Duration
 
 	authMgr  Authentication
+	authz    Authorizer
 	sessMgr  *SessionManager
 	topicMgr *TopicsManager
-
-	quit chan struct{}
+	retained RetainedStore
+
+	// quit is closed by Close, the listener is closed to stop accepting, and closing
+	// is held while a connection is established so Close sees all the services started
+	quit      chan struct{}
+	ln        net.Listener
+	closing   sync.RWMutex
+	closeOnce sync.Once
 }
 
 // NewServer create new server
@@ -30,16 +56,108 @@ func NewServer(config *ServerConfig) (*Server, error) {
 	server := &Server{
 		address:        config.Address,
 		connectTimeout: time.Duration(config.Timeout),
+		maxPacketSize:  config.MaxPacketSize,
+		retryInterval:  time.Duration(config.RetryInterval) * time.Second,
+		maxInflight:    config.MaxInflight,
+		sessionExpiry:  time.Duration(config.SessionExpiryInterval) * time.Second,
+		stats:          NewStats(),
+		sysInterval:    time.Duration(config.SysInterval) * time.Second,
+
+		maxKeepAlive:     uint16(config.MaxKeepAlive),
+		defaultKeepAlive: uint16(config.DefaultKeepAlive),
 
 		sessMgr:  NewSessionManager(),
 		topicMgr: NewTopicManager(),
 		authMgr:  &NullAuth{},
+		authz:    &NullAuthorizer{},
+
+		quit: make(chan struct{}),
+	}
+
+	policy, err := ParseQueuePolicy(config.QueuePolicy)
+	if err != nil {
+		return nil, err
+	}
+	server.sessMgr.SetQueueLimit(QueueLimit{
+		Messages: config.MaxQueuedMessages,
+		Bytes:    config.MaxQueuedBytes,
+		Policy:   policy,
+	})
+
+	strategy, err := ParseShareStrategy(config.SharedStrategy)
+	if err != nil {
+		return nil, err
+	}
+	server.topicMgr.SetShareStrategy(strategy)
+
+	if config.ACLFile != "" {
+		acl, err := LoadACLFile(config.ACLFile)
+		if err != nil {
+			return nil, err
+		}
+		server.authz = acl
+	}
 
-		quit: make(chan struct{}, 1),
+	store, err := NewSessionStore(config.SessionStore, config.SessionStorePath)
+	if err != nil {
+		return nil, err
+	}
+	server.sessMgr.SetStore(store)
+	if err := server.restoreSessions(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if server.retained, err = NewRetainedStore(config.RetainedStore, config.RetainedStorePath); err != nil {
+		store.Close()
+		return nil, err
 	}
 	return server, nil
 }
 
+// NewSessionStore create the session store of the kind, "memory" or "file"
+func NewSessionStore(kind string, path string) (SessionStore, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemorySessionStore(), nil
+	case "file":
+		return NewFileSessionStore(path)
+	}
+	return nil, fmt.Errorf("unknown session store %q", kind)
+}
+
+// NewRetainedStore create the retained message store of the kind, "memory" or "file"
+func NewRetainedStore(kind string, path string) (RetainedStore, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryRetainedStore(), nil
+	case "file":
+		return NewFileRetainedStore(path)
+	}
+	return nil, fmt.Errorf("unknown retained store %q", kind)
+}
+
+// restoreSessions add the sessions saved by the previous run with their subscriptions
+func (serv *Server) restoreSessions() error {
+	return serv.sessMgr.Restore(func(sess *Session, subs map[string]byte) {
+		for topic, options := range subs {
+			serv.topicMgr.Register(topic, sess.id, options, sess)
+		}
+	})
+}
+
+// saveSessions save the persistent sessions, the connected ones are saved with their current state
+func (serv *Server) saveSessions() {
+	for _, sess := range serv.sessMgr.List() {
+		if sess.IsCleanSession() {
+			continue
+		}
+		if err := serv.sessMgr.Save(sess, serv.topicMgr.Subscriptions(sess.id)); err != nil {
+			glog.Errorf("(%s) failed to save the session: %v", sess.id, err)
+		}
+	}
+}
+
 // Listen listen service
 func (serv *Server) Listen() error {
 	ln, err := net.Listen("tcp", serv.address)
@@ -48,9 +166,32 @@ func (serv *Server) Listen() error {
 	}
 	defer ln.Close()
 
-	serv.quit = make(chan struct{})
+	serv.closing.Lock()
+	serv.ln = ln
+	serv.closing.Unlock()
+	select {
+	case <-serv.quit:
+		return nil
+	default:
+	}
+
 	var tempDelay time.Duration // how long to sleep on accept failure
 
+	// the periodic loops stop when Listen returns
+	done := make(chan struct{})
+	defer close(done)
+
+	reaper := time.NewTicker(DefaultReapInterval)
+	defer reaper.Stop()
+	go serv.loopReapSessions(reaper.C, done)
+
+	if serv.sysInterval > 0 {
+		serv.publishSysTopics(time.Now())
+		sys := time.NewTicker(serv.sysInterval)
+		defer sys.Stop()
+		go serv.loopSysTopics(sys.C, done)
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -82,8 +223,59 @@ func (serv *Server) Listen() error {
 	}
 }
 
+// loopReapSessions remove the expired sessions until done is closed,
+// the stopped ticker does not close its channel
+func (serv *Server) loopReapSessions(c <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-c:
+			serv.reapSessions(now)
+		}
+	}
+}
+
+// reapSessions remove the expired sessions with their subscriptions and queued messages
+func (serv *Server) reapSessions(now time.Time) int {
+	return serv.sessMgr.Reap(now, func(id string, sess *Session) {
+		serv.topicMgr.Deregister(id)
+		sess.clear()
+	})
+}
+
+// SetAuthorizer replace the authorizer of the topic access, it is used by the new connections
+func (serv *Server) SetAuthorizer(authz Authorizer) {
+	serv.authz = authz
+}
+
+// Close stop accepting the connections and close the connected clients first, then the persistent
+// sessions are saved and the stores are closed, so no service changes them after they are closed
 func (serv *Server) Close() {
-	serv.quit <- struct{}{}
+	serv.closeOnce.Do(func() {
+		close(serv.quit)
+
+		// wait for the connections being established, the later ones see quit
+		serv.closing.Lock()
+		if serv.ln != nil {
+			serv.ln.Close()
+		}
+		serv.closing.Unlock()
+
+		for _, sess := range serv.sessMgr.List() {
+			if service := sess.current(); service != nil {
+				service.Close()
+			}
+		}
+
+		serv.saveSessions()
+		if err := serv.sessMgr.Close(); err != nil {
+			glog.Errorf("failed to close the session store: %v", err)
+		}
+		if err := serv.retained.Close(); err != nil {
+			glog.Errorf("failed to close the retained store: %v", err)
+		}
+	})
 }
 
 // 建立超时设置？ 如何应对用户连接却不发送conn消息的情况
@@ -96,18 +288,29 @@ func (serv *Server) Close() {
 // parse message
 func (serv *Server) handleConnection(conn net.Conn) error {
 
+	conn = serv.stats.conn(conn)
+
 	// ?? how to deal with this
 	connTimeout := time.Now().Add(time.Second * serv.connectTimeout)
 	conn.SetDeadline(connTimeout)
 
+	// the reader is handed over to the service, the packets sent right after CONNECT may be buffered
+	reader := NewFrameReader(conn, serv.maxPacketSize)
+	reader.SetReadTimeout(time.Second * serv.connectTimeout)
+
 	// read message
-	buf, err := ReadMessage(conn)
+	frame, err := reader.ReadFrame()
 	if err != nil {
+		conn.Close()
 		return err
 	}
+	serv.stats.received()
+
+	// the connect message refers to the frame, it lives as long as the connection, so it is not released
+	buf := frame.Bytes()
 
 	// parse connection message,has validated the msg
-	resp := message.NewConnackMessage()
+	resp := message.NewConnAckMessage()
 
 	// will return the following errors
 	//0x00 Connection Accepted
@@ -116,45 +319,124 @@ func (serv *Server) handleConnection(conn net.Conn) error {
 	//0x04 Connection Refused, bad user name or password
 	//0x05 Connection Refused, not authorized
 	req, err := serv.parseConnMsg(buf)
+
+	// reply with the protocol version of the client if it is supported
+	if req != nil && supportVersion(req.Version()) {
+		resp.SetProtocolVersion(req.Version())
+	}
+
 	if err != nil {
-		if cerr, ok := err.(message.ConnackCode); ok {
-			//glog.Debugf("request   message: %s\nresponse message: %s\nerror           : %v", mreq, resp, err)
+		if cerr, ok := err.(message.ConnAckCode); ok {
 			resp.SetReturnCode(cerr)
 			resp.SetSessionPresent(false)
 			WriteMessage(resp, conn)
 		}
+		conn.Close()
 		return err
 	}
 
+	// the enhanced authentication of MQTT 5.0 is not supported, the client asking for it is refused
+	if _, ok := req.Properties().Data(message.PropAuthenticationMethod); ok && req.Version() == message.Version5 {
+		resp.SetReasonCode(message.ReasonBadAuthenticationMethod)
+		WriteMessage(resp, conn)
+		conn.Close()
+		return message.ReasonBadAuthenticationMethod
+	}
+
 	//TODO, add auth process logic
 	//auth msg
-	if !serv.authMgr.Auth(string(req.Username()), string(req.Password())) {
-		resp.SetReturnCode(message.ErrNotAuthorized)
+	if !serv.authMgr.Auth(string(req.UserName), string(req.PassWord)) {
+		resp.SetReturnCode(message.NotAuthorized)
 		WriteMessage(resp, conn)
+		conn.Close()
 		return errors.New("user is not authorized ")
 	}
 
-	// 通知client，成功接收消息
-	WriteMessage(resp, conn)
+	// the service enforces the keepalive of the server
+	keepAlive, ok := serv.getKeepAlive(req, resp)
+	if !ok {
+		resp.SetReturnCode(message.IdentifierRejected)
+		WriteMessage(resp, conn)
+		conn.Close()
+		return fmt.Errorf("keepalive %d exceeds the maximum %d", req.KeepAlive, serv.maxKeepAlive)
+	}
+	req.KeepAlive = keepAlive
+
+	// Close waits for the connection being established, the service is started or refused
+	serv.closing.RLock()
+	defer serv.closing.RUnlock()
+	select {
+	case <-serv.quit:
+		resp.SetReturnCode(message.ServiceUnavailable)
+		WriteMessage(resp, conn)
+		conn.Close()
+		return ErrServerClosed
+	default:
+	}
+
+	// the client connecting with an empty id gets one, then it is taken over like any other
+	var unlock func()
+	if len(req.ClientID()) == 0 {
+		unlock = serv.assignClientID(req, resp)
+	} else {
+		unlock = serv.sessMgr.LockClient(string(req.ClientID()))
+	}
+	defer unlock()
+	serv.sessMgr.Takeover(string(req.ClientID()))
 
 	// TODO ?how to deal with this, when sesson get wrong, we should return id?
-	// write ack message
 	sess, err := serv.GetSession(req, resp)
 	if err != nil {
+		resp.SetReturnCode(message.ServiceUnavailable)
+		WriteMessage(resp, conn)
 		conn.Close()
 		return err
 	}
 
+	// the subscription identifiers are not supported, the client must not send them
+	if req.Version() == message.Version5 {
+		resp.Properties().SetInt(message.PropSubscriptionIdentifierAvailable, 0)
+	}
+
+	// 通知client，成功接收消息, the session present flag and the assigned client id are set by GetSession
+	WriteMessage(resp, conn)
+
+	// clear the deadline of the handshake
+	conn.SetDeadline(time.Time{})
+
 	// 递增serverid
-	atomic.AddInt64(&serv.serviceId, 1)
+	id := atomic.AddInt64(&serv.serviceId, 1)
 
 	// add into service loop
-	service := NewService(serv.serviceId, sess, conn, req, serv, serv.topicMgr)
+	service := NewService(id, sess, conn, reader, req, serv, serv.topicMgr)
 	service.Start()
 
 	return nil
 }
 
+// assignClientID assign a client id which no session uses to the client connecting with an empty one,
+// the session is clean [MQTT-3.1.3-7]. It returns with the id locked, so a client connecting with
+// the same id meanwhile is serialized with this one
+func (serv *Server) assignClientID(req *message.ConnMessage, resp *message.ConnAckMessage) func() {
+	for {
+		id := fmt.Sprintf("internalclient%d", atomic.AddUint64(&serv.clientSeq, 1))
+		unlock := serv.sessMgr.LockClient(id)
+		if _, err := serv.sessMgr.Get(id); err != ErrSessionNotFound {
+			unlock()
+			continue
+		}
+
+		req.SetClientID([]byte(id))
+		req.SetCleanSession(true)
+
+		// MQTT 5.0 server MUST return the Assigned Client Identifier in the CONNACK
+		if req.Version() >= message.Version5 {
+			resp.Properties().SetData(message.PropAssignedClientIdentifier, req.ClientID())
+		}
+		return unlock
+	}
+}
+
 // If CleanSession is set to 0, the server MUST resume communications with the
 // client based on state from the current session, as identified by the client
 // identifier. If there is no session associated with the client identifier the
@@ -164,26 +446,18 @@ func (serv *Server) handleConnection(conn net.Conn) error {
 // session and start a new one. This session lasts as long as the network c
 // onnection. State data associated with this session must not be reused in any
 // subsequent session.
-func (serv *Server) GetSession(req *message.ConnectMessage, resp *message.ConnackMessage) (*Session, error) {
+func (serv *Server) GetSession(req *message.ConnMessage, resp *message.ConnAckMessage) (*Session, error) {
 
 	var err error
 
-	// Check to see if the client supplied an ID, if not, generate one and set
-	// clean session.
-	// TODO
-
-	if len(req.ClientId()) == 0 {
-		req.SetClientId([]byte(fmt.Sprintf("internalclient %d", serv.serviceId)))
-		req.SetCleanSession(true)
-	}
-
-	cid := string(req.ClientId())
+	// the client id is assigned by assignClientID if the client does not supply one
+	cid := string(req.ClientID())
 
 	var session *Session
 
 	// If CleanSession is NOT set, check the session store for existing session.
 	// If found, return it.
-	if !req.CleanSession() {
+	if !req.IsCleanSession() {
 		if session, err = serv.sessMgr.Get(cid); err == nil {
 			resp.SetSessionPresent(true)
 
@@ -195,6 +469,13 @@ func (serv *Server) GetSession(req *message.ConnectMessage, resp *message.Connac
 
 	// If CleanSession, or no existing session found, then create a new one
 	if session == nil {
+		// the state of the previous session is discarded [MQTT-3.1.2-6]
+		if old, err := serv.sessMgr.Get(cid); err == nil {
+			serv.sessMgr.Remove(cid, old)
+			serv.topicMgr.Deregister(cid)
+			old.clear()
+		}
+
 		if session, err = serv.sessMgr.New(cid); err != nil {
 			return nil, err
 		}
@@ -205,17 +486,102 @@ func (serv *Server) GetSession(req *message.ConnectMessage, resp *message.Connac
 		}
 	}
 
+	session.setExpiry(serv.getSessionExpiry(req, resp))
 	return session, nil
 
 }
 
-func (serv *Server) parseConnMsg(buf []byte) (*message.ConnectMessage, error) {
+// getSessionExpiry the expiry interval of the session after the client disconnects, 0 means the session
+// ends with the connection and a negative value means it never expires.
+// MQTT 3.1.1 persistent sessions use the expiry interval of the server. MQTT 5.0 clients set the
+// Session Expiry Interval in CONNECT, 0xFFFFFFFF means never, it is limited by the expiry interval
+// of the server, which is returned in CONNACK when it is used instead [MQTT-3.2.2-19]
+func (serv *Server) getSessionExpiry(req *message.ConnMessage, resp *message.ConnAckMessage) time.Duration {
+	if req.Version() != message.Version5 {
+		if req.IsCleanSession() {
+			return 0
+		}
+		if serv.sessionExpiry > 0 {
+			return serv.sessionExpiry
+		}
+		return -1
+	}
 
-	connMessage := message.NewConnectMessage()
+	v, _ := req.Properties().Int(message.PropSessionExpiryInterval)
+	expiry, limited := limitSessionExpiry(v, serv.sessionExpiry)
+	if limited {
+		resp.Properties().SetInt(message.PropSessionExpiryInterval, uint32(expiry/time.Second))
+	}
+	return expiry
+}
+
+// limitSessionExpiry the expiry of the Session Expiry Interval limited by max, it returns true if max is used
+func limitSessionExpiry(v uint32, max time.Duration) (time.Duration, bool) {
+	expiry := time.Duration(v) * time.Second
+	if max > 0 && (v == 0xFFFFFFFF || expiry > max) {
+		return max, true
+	}
+	if v == 0xFFFFFFFF {
+		return -1, false
+	}
+	return expiry, false
+}
+
+// getKeepAlive the keepalive of the connection, MQTT 5.0 client gets the default if it turns the keepalive off
+// and the keepalive is limited by the maximum, it MUST use the Server Keep Alive of CONNACK [MQTT-3.2.2-21].
+// MQTT 3.1 and 3.1.1 clients can not be told, so their keepalive is not changed,
+// ok is false if it exceeds the maximum, then the client is refused like mosquitto does
+func (serv *Server) getKeepAlive(req *message.ConnMessage, resp *message.ConnAckMessage) (uint16, bool) {
+	if req.Version() != message.Version5 {
+		// 0 turns the keepalive off, which exceeds any maximum
+		if serv.maxKeepAlive > 0 && (req.KeepAlive == 0 || req.KeepAlive > serv.maxKeepAlive) {
+			return req.KeepAlive, false
+		}
+		return req.KeepAlive, true
+	}
+
+	keepAlive := req.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = serv.defaultKeepAlive
+	}
+	if serv.maxKeepAlive > 0 && (keepAlive == 0 || keepAlive > serv.maxKeepAlive) {
+		keepAlive = serv.maxKeepAlive
+	}
+	if keepAlive != req.KeepAlive {
+		resp.Properties().SetInt(message.PropServerKeepAlive, uint32(keepAlive))
+	}
+	return keepAlive, true
+}
+
+// After a Network Connection is established by a Client to a Server, the first Packet sent from
+// the Client to the Server MUST be a CONNECT Packet [MQTT-3.1.0-1].
+func (serv *Server) parseConnMsg(buf []byte) (*message.ConnMessage, error) {
+
+	if len(buf) == 0 || buf[0]>>4 != message.CONNECT {
+		return nil, errors.New("first packet must be connect message")
+	}
+
+	connMessage := message.NewConnMessage()
 	_, err := connMessage.Decode(buf)
 	if err != nil {
 		return nil, err
 	}
 
+	// The Server MUST respond to the CONNECT Packet with a CONNACK return code 0x01
+	// if the Protocol Level is not supported by the Server [MQTT-3.1.2-2]
+	if !supportVersion(connMessage.Version()) {
+		return connMessage, message.UnAcceptableVersion
+	}
+
+	// verify the message, the error may be ConnAckCode
+	if err := connMessage.Verify(); err != nil {
+		return connMessage, err
+	}
+
 	return connMessage, nil
 }
+
+// supportVersion the protocol version is negotiated per connection from the CONNECT protocol level
+func supportVersion(v byte) bool {
+	return int(v) >= MINI_SUPPORT_VERSION && int(v) <= MAX_SUPPORT_VERSION
+}
@@ -2,24 +2,27 @@ package mqtt
 
 import (
 	"bytes"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 	"github.com/stretchr/testify/assert"
-	"github.com/surgemq/message"
 )
 
 func TestReadConnectMessage(t *testing.T) {
-	msg := message.NewConnectMessage()
+	msg := message.NewConnMessage()
 	// Set the appropriate paramgeters
-	msg.SetWillQos(1)
-	msg.SetVersion(4)
+	msg.SetWill(true)
+	msg.SetQos(1)
 	msg.SetCleanSession(true)
-	msg.SetClientId([]byte("surgemq"))
-	msg.SetKeepAlive(10)
-	msg.SetWillTopic([]byte("will"))
-	msg.SetWillMessage([]byte("send me home"))
-	msg.SetUsername([]byte("surgemq"))
-	msg.SetPassword([]byte("verysecret"))
+	msg.SetClientID([]byte("surgemq"))
+	msg.KeepAlive = 10
+	msg.WillTopic = []byte("will")
+	msg.WillMessage = []byte("send me home")
+	msg.SetUser([]byte("surgemq"), []byte("verysecret"))
 
 	// Encode the message and get the io.Reader
 	byteMsg := make([]byte, 200)
@@ -32,15 +35,378 @@ func TestReadConnectMessage(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, buf)
 
-	msg2 := message.NewConnectMessage()
+	msg2 := message.NewConnMessage()
 	msg2.Decode(buf)
 
-	assert.Equal(t, msg2.WillQos(), uint8(1), "will qos should be 1")
+	assert.Equal(t, msg2.Qos(), uint8(1), "will qos should be 1")
 	assert.Equal(t, msg2.Version(), uint8(4), "version should be 4")
-	assert.Equal(t, msg2.CleanSession(), true, "clean session is set")
-	assert.Equal(t, msg2.ClientId(), []byte("surgemq"), "client id should be surgemq")
-	assert.Equal(t, msg2.Password(), []byte("verysecret"), "password should be equal")
-	assert.Equal(t, msg2.Username(), []byte("surgemq"), "user should be equal")
-	assert.Equal(t, msg2.WillMessage(), []byte("send me home"), "will message should be equal")
-	assert.Equal(t, msg2.WillTopic(), []byte("will"), "topic msg shoudl be equal")
+	assert.Equal(t, msg2.IsCleanSession(), true, "clean session is set")
+	assert.Equal(t, msg2.ClientID(), []byte("surgemq"), "client id should be surgemq")
+	assert.Equal(t, msg2.PassWord, []byte("verysecret"), "password should be equal")
+	assert.Equal(t, msg2.UserName, []byte("surgemq"), "user should be equal")
+	assert.Equal(t, msg2.WillMessage, []byte("send me home"), "will message should be equal")
+	assert.Equal(t, msg2.WillTopic, []byte("will"), "topic msg shoudl be equal")
+}
+
+func newTestConnMessage(id string, clean bool) *message.ConnMessage {
+	msg := message.NewConnMessage()
+	msg.SetClientID([]byte(id))
+	msg.SetCleanSession(clean)
+	return msg
+}
+
+func TestServerPersistentSession(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{})
+
+	resp := message.NewConnAckMessage()
+	sess, err := serv.GetSession(newTestConnMessage("c1", false), resp)
+	assert.NoError(t, err)
+	assert.False(t, resp.IsSessionPresent(), "new session should not be present")
+	serv.topicMgr.Register("sport/#", "c1", message.QosAtLeastOnce, sess)
+
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+	sess.track(frame, "")
+
+	resp = message.NewConnAckMessage()
+	resumed, err := serv.GetSession(newTestConnMessage("c1", false), resp)
+	assert.NoError(t, err)
+	assert.True(t, resp.IsSessionPresent(), "persistent session should be present")
+	assert.True(t, sess == resumed, "the session should be resumed")
+	assert.Equal(t, 1, resumed.inflightLen(), "inflight messages should be kept")
+	assert.Equal(t, 1, len(serv.topicMgr.Find("sport/tennis")), "subscriptions should be kept")
+
+	resp = message.NewConnAckMessage()
+	clean, err := serv.GetSession(newTestConnMessage("c1", true), resp)
+	assert.NoError(t, err)
+	assert.False(t, resp.IsSessionPresent(), "clean session should not be present")
+	assert.False(t, sess == clean, "the session should be discarded")
+	assert.Equal(t, 0, sess.inflightLen(), "inflight messages should be discarded")
+	assert.Equal(t, 0, len(serv.topicMgr.Find("sport/tennis")), "subscriptions should be discarded")
+}
+
+func TestServiceCloseSession(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{})
+
+	for _, clean := range []bool{false, true} {
+		req := newTestConnMessage("c1", clean)
+		sess, _ := serv.GetSession(req, message.NewConnAckMessage())
+		conn, client := net.Pipe()
+		service := NewService(1, sess, conn, NewFrameReader(conn, 0), req, serv, serv.topicMgr)
+		service.Start()
+		serv.topicMgr.Register("sport/#", "c1", message.QosAtLeastOnce, sess)
+
+		client.Close()
+		<-service.done
+
+		assert.Nil(t, sess.current(), "service should be detached")
+		_, err := serv.sessMgr.Get("c1")
+		assert.Equal(t, clean, err == ErrSessionNotFound, "only the clean session is removed")
+		assert.Equal(t, !clean, len(serv.topicMgr.Find("sport")) == 1, "only the clean session loses subscriptions")
+	}
+}
+
+// connectTestClient establish a connection through handleConnection and return the client side
+func connectTestClient(t *testing.T, serv *Server, req *message.ConnMessage) (net.Conn, *FrameReader, *message.ConnAckMessage) {
+	conn, client := net.Pipe()
+	go serv.handleConnection(conn)
+
+	_, err := WriteMessage(req, client)
+	assert.NoError(t, err, "should not have error in writing connect")
+
+	reader := NewFrameReader(client, 0)
+	frame, err := reader.ReadFrame()
+	assert.NoError(t, err, "should not have error in reading connack")
+	ack := message.NewConnAckMessage()
+	ack.SetProtocolVersion(req.Version())
+	_, err = ack.Decode(frame.Bytes())
+	assert.NoError(t, err, "should not have error in decoding connack")
+	return client, reader, ack
+}
+
+// waitOwner wait the service attached after the CONNACK is sent
+func waitOwner(serv *Server, id string, not *Service) *Service {
+	for i := 0; i < 100; i++ {
+		if owner := serv.sessMgr.Owner(id); owner != nil && owner != not {
+			return owner
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestServerTakeover(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{Timeout: 1})
+
+	req := newTestConnMessage("c1", false)
+	req.SetVersion(message.Version5)
+	req.Properties().SetInt(message.PropSessionExpiryInterval, 0xFFFFFFFF)
+	client1, reader1, ack := connectTestClient(t, serv, req)
+	defer client1.Close()
+	assert.Equal(t, message.ReasonSuccess, ack.ReasonCode())
+	first := waitOwner(serv, "c1", nil)
+	assert.NotNil(t, first, "the session should be owned by the service")
+
+	// the old connection is told the reason and closed
+	frames := make(chan *Frame, 2)
+	go func() {
+		for {
+			frame, err := reader1.ReadFrame()
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	client2, _, ack := connectTestClient(t, serv, newTestConnMessage("c1", false))
+	defer client2.Close()
+	assert.True(t, ack.IsSessionPresent(), "the session should be inherited")
+
+	frame, ok := <-frames
+	assert.True(t, ok, "should get disconnect message")
+	msg, err := message.NewVersionMessage(frame.Bytes(), message.Version5)
+	assert.NoError(t, err)
+	assert.Equal(t, message.ReasonSessionTakenOver, msg.(*message.DisconnectMessage).ReasonCode())
+	_, ok = <-frames
+	assert.False(t, ok, "old connection should be closed")
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("the old service should be closed before the new connection is accepted")
+	}
+
+	second := waitOwner(serv, "c1", first)
+	assert.NotNil(t, second)
+	assert.False(t, first == second, "the new service should own the session")
+	assert.Equal(t, 1, serv.sessMgr.Len())
+}
+
+func TestServerAssignClientID(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{Timeout: 1})
+
+	// a real client may use the id the server would assign
+	client, _, ack := connectTestClient(t, serv, newTestConnMessage("internalclient1", false))
+	defer client.Close()
+	assert.Equal(t, message.ConnAccepted, ack.ReturnCode())
+	owner := waitOwner(serv, "internalclient1", nil)
+	assert.NotNil(t, owner)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req := newTestConnMessage("", true)
+		req.SetVersion(message.Version5)
+		client, _, ack := connectTestClient(t, serv, req)
+		defer client.Close()
+		assert.Equal(t, message.ReasonSuccess, ack.ReasonCode())
+		id, ok := ack.Properties().Data(message.PropAssignedClientIdentifier)
+		assert.True(t, ok, "the assigned client id should be returned")
+		assert.NotEqual(t, "internalclient1", string(id), "the id of the real client should not be assigned")
+		ids[string(id)] = true
+	}
+	assert.Len(t, ids, 2, "the assigned ids should be unique")
+	assert.True(t, owner == serv.sessMgr.Owner("internalclient1"), "the real client should not be taken over")
+}
+
+func TestServerConnectV5(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{Timeout: 1})
+
+	req := newTestConnMessage("c1", true)
+	req.SetVersion(message.Version5)
+	client, _, ack := connectTestClient(t, serv, req)
+	defer client.Close()
+	assert.Equal(t, message.ReasonSuccess, ack.ReasonCode())
+	v, ok := ack.Properties().Int(message.PropSubscriptionIdentifierAvailable)
+	assert.True(t, ok, "CONNACK should tell the subscription identifiers are not available")
+	assert.Equal(t, uint32(0), v)
+
+	// the enhanced authentication is refused
+	req = newTestConnMessage("c2", true)
+	req.SetVersion(message.Version5)
+	req.Properties().SetData(message.PropAuthenticationMethod, []byte("SCRAM-SHA-1"))
+	client, _, ack = connectTestClient(t, serv, req)
+	defer client.Close()
+	assert.Equal(t, message.ReasonBadAuthenticationMethod, ack.ReasonCode())
+	_, err := client.Read(make([]byte, 1))
+	assert.Error(t, err, "the connection should be closed")
+	assert.Nil(t, serv.sessMgr.Owner("c2"))
+}
+
+func TestServerSessionExpiry(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{SessionExpiryInterval: 60})
+
+	req := newTestConnMessage("c1", false)
+	req.SetVersion(message.Version5)
+	req.Properties().SetInt(message.PropSessionExpiryInterval, 3600)
+	resp := message.NewConnAckMessage()
+	sess, err := serv.GetSession(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, sess.expiry, "expiry should be limited by the server")
+	v, ok := resp.Properties().Int(message.PropSessionExpiryInterval)
+	assert.True(t, ok, "the server expiry should be returned in connack")
+	assert.Equal(t, uint32(60), v)
+
+	req = newTestConnMessage("c2", false)
+	req.SetVersion(message.Version5)
+	req.Properties().SetInt(message.PropSessionExpiryInterval, 10)
+	resp = message.NewConnAckMessage()
+	short, _ := serv.GetSession(req, resp)
+	assert.Equal(t, 10*time.Second, short.expiry)
+	_, ok = resp.Properties().Int(message.PropSessionExpiryInterval)
+	assert.False(t, ok, "the client expiry is accepted")
+
+	old, _ := serv.GetSession(newTestConnMessage("c3", false), message.NewConnAckMessage())
+	assert.Equal(t, time.Minute, old.expiry, "MQTT 3.1.1 sessions use the server expiry")
+
+	serv.topicMgr.Register("sport/#", "c1", message.QosAtLeastOnce, sess)
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+	sess.publish(frame, "")
+	assert.Equal(t, 1, sess.pendingLen())
+
+	now := time.Now()
+	assert.Equal(t, 1, serv.reapSessions(now.Add(30*time.Second)), "only c2 should expire")
+	assert.Equal(t, 2, serv.sessMgr.Len())
+	assert.Equal(t, 2, serv.reapSessions(now.Add(2*time.Minute)))
+	assert.Equal(t, uint64(3), serv.sessMgr.Reclaimed())
+	assert.Equal(t, 0, serv.sessMgr.Len())
+	assert.Equal(t, 0, len(serv.topicMgr.Find("sport/tennis")), "subscriptions should be removed")
+	assert.Equal(t, 0, sess.pendingLen(), "queued messages should be removed")
+
+	// the loop stops with the listener, the ticker channel is never closed
+	c, done, stopped := make(chan time.Time), make(chan struct{}), make(chan struct{})
+	go func() {
+		serv.loopReapSessions(c, done)
+		close(stopped)
+	}()
+	c <- now
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the loop should stop when done is closed")
+	}
+}
+
+func TestServerRestoreSessions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := &ServerConfig{SessionStore: "file", SessionStorePath: filepath.Join(dir, "sessions.db")}
+
+	serv, err := NewServer(config)
+	assert.NoError(t, err)
+	req := newTestConnMessage("c1", false)
+	sess, _ := serv.GetSession(req, message.NewConnAckMessage())
+	serv.topicMgr.Register("sport/#", "c1", message.QosAtLeastOnce, sess)
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+	id := sess.track(frame, "")
+	sess.detach(nil)
+	sess.publish(frame, "")
+	clean, _ := serv.GetSession(newTestConnMessage("c2", true), message.NewConnAckMessage())
+	serv.topicMgr.Register("sport/#", "c2", message.QosAtLeastOnce, clean)
+	serv.Close()
+
+	serv, err = NewServer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, serv.sessMgr.Len(), "only the persistent session should be restored")
+	restored, err := serv.sessMgr.Get("c1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored.inflightLen(), "inflight messages should be restored")
+	assert.Equal(t, 1, restored.pendingLen(), "queued messages should be restored")
+	assert.True(t, restored.acknowledge(id, message.PUBACK), "the packet id should be kept")
+	assert.Equal(t, 1, len(serv.topicMgr.Find("sport/tennis")), "subscriptions should be restored")
+
+	resp := message.NewConnAckMessage()
+	resumed, _ := serv.GetSession(req, resp)
+	assert.True(t, resp.IsSessionPresent(), "the restored session should be resumed")
+	assert.True(t, restored == resumed)
+
+	serv.GetSession(newTestConnMessage("c1", true), message.NewConnAckMessage())
+	serv.Close()
+	serv, err = NewServer(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, serv.sessMgr.Len(), "the discarded session should be deleted from the store")
+	serv.Close()
+}
+
+func TestServerClose(t *testing.T) {
+	serv, err := NewServer(&ServerConfig{Address: "127.0.0.1:0", Timeout: 1})
+	assert.NoError(t, err)
+	listening := make(chan error, 1)
+	go func() {
+		listening <- serv.Listen()
+	}()
+
+	client, _, ack := connectTestClient(t, serv, newTestConnMessage("c1", false))
+	defer client.Close()
+	assert.Equal(t, message.ConnAccepted, ack.ReturnCode())
+	owner := waitOwner(serv, "c1", nil)
+	assert.NotNil(t, owner)
+
+	serv.Close()
+	select {
+	case <-owner.done:
+	default:
+		t.Fatal("the connected client should be closed before the stores")
+	}
+	select {
+	case err := <-listening:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Listen should return after the server is closed")
+	}
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err, "the connection should be closed")
+	sess, err := serv.sessMgr.Get("c1")
+	assert.NoError(t, err, "the persistent session should be kept")
+	assert.False(t, sess.connected())
+
+	client, _, ack = connectTestClient(t, serv, newTestConnMessage("c2", false))
+	defer client.Close()
+	assert.Equal(t, message.ServiceUnavailable, ack.ReturnCode(), "no connection is accepted after the server is closed")
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	serv, _ := NewServer(&ServerConfig{MaxKeepAlive: 60, DefaultKeepAlive: 30})
+
+	cases := []struct {
+		version   byte
+		keepAlive uint16
+		expected  uint16
+		told      bool
+		accepted  bool
+	}{
+		{message.Version311, 10, 10, false, true},
+		{message.Version311, 0, 0, false, false},
+		{message.Version311, 120, 120, false, false},
+		{message.Version5, 10, 10, false, true},
+		{message.Version5, 0, 30, true, true},
+		{message.Version5, 120, 60, true, true},
+	}
+	for _, c := range cases {
+		req := newTestConnMessage("c1", true)
+		req.SetVersion(c.version)
+		req.KeepAlive = c.keepAlive
+		resp := message.NewConnAckMessage()
+		keepAlive, ok := serv.getKeepAlive(req, resp)
+		assert.Equal(t, c.expected, keepAlive)
+		assert.Equal(t, c.accepted, ok, "keepalive of %v", c)
+
+		v, ok := resp.Properties().Int(message.PropServerKeepAlive)
+		assert.Equal(t, c.told, ok, "server keep alive of %v", c)
+		if ok {
+			assert.Equal(t, uint32(c.expected), v)
+		}
+	}
+
+	serv, _ = NewServer(&ServerConfig{Timeout: 1, MaxKeepAlive: 60})
+	req := newTestConnMessage("c1", false)
+	req.KeepAlive = 300
+	client, _, ack := connectTestClient(t, serv, req)
+	defer client.Close()
+	assert.Equal(t, message.IdentifierRejected, ack.ReturnCode(), "MQTT 3.1.1 client can not be told a lower keepalive")
+	assert.Equal(t, 0, serv.sessMgr.Len(), "the refused client should get no session")
 }
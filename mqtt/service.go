@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/surgemq/message"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 )
 
 var gsvcid uint64
@@ -21,81 +23,302 @@ type Service struct {
 	// incremented for every new service.
 	id int64
 
-	conn         net.Conn
-	readTimeout  time.Duration
-	writeTimeout time.Duration
+	conn        net.Conn
+	reader      *FrameReader
+	readTimeout time.Duration
 
-	// need to process,this
+	// the keepalive seconds negotiated by CONNECT, the connection is closed if no packet
+	// is received within readTimeout, one and a half times of it
 	keepAlive uint16
 
-	session *Session
-	topics  *TopicsManager
+	// protocol version negotiated by the CONNECT message
+	version byte
 
-	parseChan chan []byte
-	msgChan   chan message.Message
+	// the unacknowledged QoS 1 and QoS 2 messages are redelivered after the interval
+	retryInterval time.Duration
 
-	quit chan struct{}
+	// the limit of the Session Expiry Interval which MQTT 5.0 client may change by DISCONNECT
+	maxSessionExpiry time.Duration
+
+	session  *Session
+	sessions *SessionManager
+	topics   *TopicsManager
+	retained RetainedStore
+	stats    *Stats
+
+	// the Maximum Packet Size of MQTT 5.0 client, the larger packets are not sent to it, 0 means no limit
+	maxPacketSize uint32
+
+	// the user name of CONNECT, the topic access of it is checked by authz
+	userName string
+	authz    Authorizer
+
+	parseChan chan *Frame
+	msgChan   chan packet
+
+	// the messages published to the client wait here for the writer, so the publishers are not blocked
+	// by a slow client, and the client gets them in the order they are queued
+	outChan chan outbound
+
+	// the loops are tracked by wg, done is closed after they stop and the session is torn down
+	wg        sync.WaitGroup
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// packet the decoded message and the frame it refers to,
+// the frame is released after the message is processed
+type packet struct {
+	msg   message.Message
+	frame *Frame
+}
+
+// outbound a message queued for the writer with the packet id of the session,
+// frame is nil for PUBREL of the QoS 2 message which is received by the client
+type outbound struct {
+	packetID uint16
+	frame    *message.PublishFrame
+	dup      bool
 }
 
 // NewService 创建新的
 // 是否有必要将消息处理分为几个channel， 这样做有什么好处?
-func NewService(id int64, session *Session, conn net.Conn, connMsg *message.ConnectMessage,
+func NewService(id int64, session *Session, conn net.Conn, reader *FrameReader, connMsg *message.ConnMessage,
 	server *Server, topics *TopicsManager) (service *Service) {
 
+	retryInterval := DefaultRetryInterval
+	if server != nil && server.retryInterval > 0 {
+		retryInterval = server.retryInterval
+	}
+
+	// the inflight window is limited by the Receive Maximum of MQTT 5.0 client too
+	maxInflight := DefaultMaxInflight
+	if server != nil && server.maxInflight > 0 {
+		maxInflight = server.maxInflight
+	}
+	if max, ok := connMsg.Properties().Int(message.PropReceiveMaximum); ok && connMsg.Version() == message.Version5 && int(max) < maxInflight {
+		maxInflight = int(max)
+	}
+	session.setMaxInflight(maxInflight)
+
+	var sessions *SessionManager
+	var retained RetainedStore
+	var stats *Stats
+	var authz Authorizer
+	var maxSessionExpiry time.Duration
+	if server != nil {
+		authz = server.authz
+		sessions = server.sessMgr
+		retained = server.retained
+		stats = server.stats
+		maxSessionExpiry = server.sessionExpiry
+	}
+
+	var maxPacketSize uint32
+	if connMsg.Version() == message.Version5 {
+		maxPacketSize, _ = connMsg.Properties().Int(message.PropMaximumPacketSize)
+	}
+
 	return &Service{
-		id:           id,
-		conn:         conn,
-		writeTimeout: time.Duration(1) * time.Second,
-		readTimeout:  time.Duration(1) * time.Second,
+		id:          id,
+		conn:        timeoutConn{Conn: conn, d: DefaultWriteTimeout},
+		reader:      reader,
+		readTimeout: keepAliveTimeout(connMsg.KeepAlive),
 
-		keepAlive: connMsg.KeepAlive(),
+		keepAlive: connMsg.KeepAlive,
+		version:   connMsg.Version(),
 		session:   session,
-
-		parseChan: make(chan []byte),
-		msgChan:   make(chan message.Message),
+		sessions:  sessions,
+		retained:  retained,
+		stats:     stats,
+		userName:  string(connMsg.UserName),
+		authz:     authz,
+
+		retryInterval:    retryInterval,
+		maxSessionExpiry: maxSessionExpiry,
+		maxPacketSize:    maxPacketSize,
+
+		parseChan: make(chan *Frame),
+		msgChan:   make(chan packet),
+		outChan:   make(chan outbound, maxInflight+DefaultMaxOutbound),
 		topics:    topics,
 		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 
 }
 
+// keepAliveTimeout the server disconnects the client which sends no packet within one and a half
+// times the keepalive [MQTT-3.1.2-24], 0 turns off the keepalive
+func keepAliveTimeout(keepAlive uint16) time.Duration {
+	return time.Duration(keepAlive) * time.Second * 3 / 2
+}
+
+// cid the client id, the subscriptions are kept by it
 func (service *Service) cid() string {
-	return fmt.Sprintf("%d", service.id)
+	return service.session.id
 }
 
 // Start 开始服务
 // TODO how to deal with this situation
 func (service *Service) Start() error {
+	// the read, parse, process, write and retry loops
+	service.wg.Add(5)
+	go service.loopWriteMsg()
 	go service.loopReadMsg()
 	go service.loopParseMsg()
 	go service.loopProcessMsg()
 
+	service.session.attach(service)
+
+	// the messages not acknowledged before the client reconnects are redelivered first
+	service.session.redeliver(0, service.resend)
+	service.sendPending()
+	go service.loopRetry()
+
 	return nil
 }
 
-// Close 继续服务
+// Close the only teardown path of the connection, it is called on DISCONNECT, read and protocol errors,
+// keepalive timeout and takeover. The socket is closed and the loops stop on quit, the will is published
+// unless DISCONNECT discarded it. The persistent session is kept with its subscriptions and messages for
+// the next connection, the clean session is discarded with its subscriptions. It returns after the loops
+// stop and the session is torn down, so it must not be called on the loops, they call shutdown instead
 func (service *Service) Close() {
-	close(service.quit)
+	service.shutdown()
+	<-service.done
+}
+
+// shutdown close the socket and stop the loops without waiting for them, the session is torn down
+// after all of them return. It can be called more than once
+func (service *Service) shutdown() {
+	service.closeOnce.Do(func() {
+		service.conn.Close()
+		close(service.quit)
+		go func() {
+			service.wg.Wait()
+			service.teardown()
+			close(service.done)
+		}()
+	})
+}
+
+// teardown publish the will and keep or discard the session, no loop is running
+func (service *Service) teardown() {
+	// the connection is closed without DISCONNECT, or DISCONNECT asks for the will [MQTT-3.1.2-8],
+	// the will topic is authorized like a PUBLISH
+	will := service.session.takeWill()
+	if will != nil && service.authorize(AccessPublish, string(will.Topic())) {
+		if err := service.forward(will); err != nil {
+			glog.Errorf("(%v) failed to publish the will message: %v", service.cid(), err)
+		}
+	}
+	service.session.detach(service)
+	service.drain()
+	service.rerouteShared()
+	if service.session.IsCleanSession() {
+		if service.sessions == nil || service.sessions.Remove(service.cid(), service.session) {
+			service.topics.Deregister(service.cid())
+			service.session.clear()
+		}
+	} else {
+		service.saveSession()
+	}
+}
+
+// rerouteShared deliver the QoS 1 messages of the shared subscriptions which are not acknowledged,
+// and the ones still pending, to the other members of the groups. The member may be disconnected
+// before acknowledging them, so the message is not lost with a clean session or delayed until it reconnects
+func (service *Service) rerouteShared() {
+	n := service.session.takeShared(func(share string, frame *message.PublishFrame) bool {
+		sub, ok := service.topics.PickShared(share, service.cid())
+		if !ok {
+			return false
+		}
+		// the frame carries the packet id of the publisher copied by frameCache.get, it is
+		// meaningless here, the session of the member writes its own packet id when sending it
+		pub := message.NewPublishMessage()
+		pub.SetProtocolVersion(service.version)
+		if _, err := pub.Decode(frame.Bytes()); err != nil {
+			glog.Errorf("(%v) failed to decode the shared message: %v", service.cid(), err)
+			return false
+		}
+
+		qos := pub.Qos()
+		if sub.Qos < qos {
+			qos = sub.Qos
+		}
+		frames := newFrameCache(pub)
+		defer frames.release()
+		f, err := frames.get(sub.Sub.protocolVersion(), qos, false)
+		if err != nil {
+			glog.Errorf("(%v) failed to encode the shared message: %v", service.cid(), err)
+			return false
+		}
+		sub.Sub.publish(f, share)
+		return true
+	})
+	if n > 0 {
+		glog.Infof("(%v) deliver %d messages of the shared subscriptions to other members", service.cid(), n)
+	}
 }
 
-func (service *Service) readMessage() ([]byte, error) {
+// processDisconnect close the connection, the will message is discarded when the client disconnects
+// normally [MQTT-3.14.4-3], MQTT 5.0 client can ask for the will with the reason code 0x04.
+// MQTT 5.0 client may change the Session Expiry Interval, but not from 0 [MQTT-3.14.2-2]
+func (service *Service) processDisconnect(msg *message.DisconnectMessage) error {
+	if v, ok := msg.Properties().Int(message.PropSessionExpiryInterval); ok && service.version == message.Version5 {
+		if service.session.IsCleanSession() && v != 0 {
+			return message.ReasonProtocolError
+		}
+		expiry, _ := limitSessionExpiry(v, service.maxSessionExpiry)
+		service.session.setExpiry(expiry)
+	}
+
+	if msg.ReasonCode() != message.ReasonDisconnectWithWill {
+		service.session.takeWill()
+	}
+	service.shutdown()
+	return nil
+}
 
-	reader := timeoutReader{
-		d:    service.readTimeout * time.Second,
-		conn: service.conn,
+// saveSession save the persistent session to the store, so the subscriptions and the
+// messages not delivered yet are restored after the broker restarts
+func (service *Service) saveSession() {
+	if service.sessions == nil || service.session.IsCleanSession() {
+		return
 	}
+	if err := service.sessions.Save(service.session, service.topics.Subscriptions(service.cid())); err != nil {
+		glog.Errorf("(%v) failed to save the session: %v", service.cid(), err)
+	}
+}
+
+// takeover close the connection because a new connection with the same client id is established,
+// MQTT 5.0 client is told the reason with DISCONNECT. It returns after the service is closed,
+// so the new connection inherits the session without racing with the goroutines of this one
+func (service *Service) takeover() {
+	if service.version == message.Version5 {
+		// the old client may not be reading, the write deadline keeps the new connection from waiting too long
+		resp := message.NewDisconnectMessage()
+		resp.SetReasonCode(message.ReasonSessionTakenOver)
+		service.writeMessage(resp)
+	}
+	service.Close()
+}
+
+func (service *Service) readMessage() (*Frame, error) {
+
+	service.reader.SetReadTimeout(service.readTimeout)
 
 	// 读取消息，在读取消息失败的情况下，需要关闭连接，并关闭service？
-	mesageBytes, err := ReadMessage(reader)
-	return mesageBytes, err
+	return service.reader.ReadFrame()
 }
 
 // TODO，如果写失败的情况下，需要判断是否是临时错误?,是否需要关闭通道
 func (service *Service) writeMessage(msg message.Message) (int, error) {
 
-	//if err := service.conn.SetWriteDeadline(time.Now().Add(service.writeTimeout * time.Second)); err != nil {
-	//	return 0, err
-	//}
+	msg.SetProtocolVersion(service.version)
 	n, err := WriteMessage(msg, service.conn)
 	if err != nil {
 		glog.Errorf("error in write msg %v %v ", n, err)
@@ -104,49 +327,145 @@ func (service *Service) writeMessage(msg message.Message) (int, error) {
 	return n, nil
 }
 
-func (service *Service) loopOne() error {
+// disconnect close the connection because of the protocol error, the read loop fails and stops the service.
+// MQTT 5.0 clients are told the reason with DISCONNECT first
+func (service *Service) disconnect(err error) {
+	if service.version == message.Version5 {
+		// the connection is closed anyway, the write deadline keeps it from waiting for a client which is not reading
+		resp := message.NewDisconnectMessage()
+		resp.SetReasonCode(message.ReasonMalformedPacket)
+		if code, ok := err.(message.ReasonCode); ok {
+			resp.SetReasonCode(code)
+		} else if err == message.ErrorInvalidTopic {
+			resp.SetReasonCode(message.ReasonTopicNameInvalid)
+		}
+		service.writeMessage(resp)
+	}
+	service.shutdown()
+}
 
+// loopRetry redeliver the messages which are not acknowledged in the retry interval.
+// MQTT 5.0 only allows redelivery when the client reconnects [MQTT-4.4.0-1]
+func (service *Service) loopRetry() {
+	defer service.wg.Done()
+	if service.version == message.Version5 {
+		return
+	}
+
+	ticker := time.NewTicker(service.retryInterval)
+	defer ticker.Stop()
 	for {
-		// for quit
 		select {
 		case <-service.quit:
-			return nil
-		default:
+			return
+		case <-ticker.C:
+			service.session.redeliver(service.retryInterval, service.resend)
 		}
+	}
+}
 
-		msgBytes, err := service.readMessage()
-		if err != nil {
-			// TODO if error, we need? close the channel
-			// 在不是timeout error的情况下，我们需要关闭连接和其他loop
-			if !IsTimeoutError(err) {
-				glog.Errorf("receive closed msg %v", err)
-				service.conn.Close()
-
-				// TODO 是否需要再考虑考虑
-				// close other channel
-				service.Close()
-				return err
-			}
-			continue
-		}
+// send queue the message which gets its packet id
+func (service *Service) send(packetID uint16, frame *message.PublishFrame) {
+	service.queue(outbound{packetID: packetID, frame: frame})
+}
 
-		msg, err := service.parseMsg(msgBytes)
-		if err != nil {
-			glog.Errorf("error in parse msg %v", err)
-			return err
+// sendPending send the queued messages while the inflight window is not full
+func (service *Service) sendPending() {
+	for service.session.dequeue(service.send) {
+	}
+}
+
+// resend write the unacknowledged message again with the DUP flag set [MQTT-3.3.1-1],
+// PUBREL is sent again for the QoS 2 message which has been received by the client
+func (service *Service) resend(packetID uint16, frame *message.PublishFrame) {
+	service.queue(outbound{packetID: packetID, frame: frame, dup: true})
+}
+
+// queue hand the message to the writer, the frame is retained until it is written. A full queue means
+// the client does not keep up, the QoS 0 message is dropped, and the connection is closed for the QoS 1
+// and QoS 2 messages, they are kept in flight by the session and redelivered when the client reconnects
+func (service *Service) queue(out outbound) {
+	if out.frame != nil {
+		out.frame.Retain()
+	}
+	select {
+	case service.outChan <- out:
+		return
+	default:
+	}
+
+	if out.frame != nil {
+		out.frame.Release()
+		if out.frame.Qos() == message.QosAtMostOnce {
+			glog.Warningf("(%v) the outbound queue is full, drop the QoS 0 message", service.cid())
+			return
 		}
+	}
+	glog.Errorf("(%v) the outbound queue is full, close the connection", service.cid())
+	service.shutdown()
+}
 
-		err = service.processMsg(msg)
-		if err != nil {
-			glog.Errorf("error in process message %v %v", msg, err)
-			return err
+// drain release the messages left in the queue after the writer stops
+func (service *Service) drain() {
+	for {
+		select {
+		case out := <-service.outChan:
+			if out.frame != nil {
+				out.frame.Release()
+			}
+		default:
+			return
 		}
+	}
+}
 
+// loopWriteMsg write the queued messages one by one, a client which is not reading blocks
+// its own writer until the write deadline, then the connection is closed
+func (service *Service) loopWriteMsg() {
+	defer service.wg.Done()
+	for {
+		select {
+		case <-service.quit:
+			return
+		case out := <-service.outChan:
+			if err := service.write(out); err != nil {
+				// the packet may be written partly, the connection can not be used any more
+				glog.Errorf("(%v) error in write msg: %v", service.cid(), err)
+				service.shutdown()
+				return
+			}
+		}
 	}
+}
 
+// write the queued message and release its frame
+func (service *Service) write(out outbound) error {
+	if out.frame == nil {
+		rel := message.NewPubRelMessage()
+		rel.SetPacketID(out.packetID)
+		_, err := service.writeMessage(rel)
+		return err
+	}
+	// the packet larger than the client allows is discarded as if it is sent and acknowledged [MQTT-3.1.2-25]
+	if service.maxPacketSize > 0 && uint32(out.frame.Len()) > service.maxPacketSize {
+		glog.Warningf("(%v) discard the message of %d bytes exceeding the maximum packet size", service.cid(), out.frame.Len())
+		ack := byte(message.PUBACK)
+		if out.frame.Qos() == message.QosExactlyOnce {
+			ack = message.PUBREC
+		}
+		out.frame.Release()
+		if out.packetID != 0 {
+			service.acknowledge(out.packetID, ack)
+		}
+		return nil
+	}
+	_, err := out.frame.WriteTo(service.conn, out.packetID, out.dup)
+	out.frame.Release()
+	return err
 }
 
 func (service *Service) loopReadMsg() error {
+	defer service.wg.Done()
 	for {
 		// for quit
 		select {
@@ -155,59 +474,75 @@ func (service *Service) loopReadMsg() error {
 		default:
 		}
 
-		mesageBytes, err := service.readMessage()
+		frame, err := service.readMessage()
 		if err != nil {
-
-			// TODO  if error, we need? close the channel
-			// 在不是timeout error的情况下，我们需要关闭连接和其他loop
-			if !IsTimeoutError(err) {
-				fmt.Printf("receive closed msg %v \n", err)
-				service.conn.Close()
-
-				// close other channel
-				service.Close()
+			// the read deadline is the keepalive timeout, the will is published as the connection is lost
+			if IsTimeoutError(err) {
+				glog.Errorf("(%v) keepalive timeout", service.cid())
+				service.disconnect(message.ReasonKeepAliveTimeout)
 				return nil
 			}
-			continue
+			glog.Errorf("(%v) the connection is closed: %v", service.cid(), err)
+
+			// close other channel
+			service.shutdown()
+			return nil
+		}
+		if service.stats != nil {
+			service.stats.received()
 		}
 
-		service.parseChan <- mesageBytes
+		select {
+		case service.parseChan <- frame:
+		case <-service.quit:
+			frame.Release()
+			return nil
+		}
 	}
 }
 
 func (service *Service) loopParseMsg() error {
+	defer service.wg.Done()
 
 	for {
 		select {
 		case <-service.quit:
 			return nil
-		case msgBytes := <-service.parseChan:
+		case frame := <-service.parseChan:
 			//
-			msg, err := service.parseMsg(msgBytes)
+			msg, err := service.parseMsg(frame.Bytes())
 			if err != nil {
+				frame.Release()
 				fmt.Printf("error in parse msg %v\n", err)
+				service.disconnect(err)
 				return err
 			}
-			service.msgChan <- msg
+			select {
+			case service.msgChan <- packet{msg: msg, frame: frame}:
+			case <-service.quit:
+				frame.Release()
+				return nil
+			}
 		}
 	}
-	return nil
 }
 
 func (service *Service) loopProcessMsg() error {
+	defer service.wg.Done()
 	for {
 		select {
 		case <-service.quit:
 			return nil
-		case msg := <-service.msgChan:
-			err := service.processMsg(msg)
+		case p := <-service.msgChan:
+			err := service.processMsg(p.msg)
+			p.frame.Release()
 			if err != nil {
-				fmt.Printf("error in process message %v %v\n", msg, err)
+				fmt.Printf("error in process message %v %v\n", p.msg, err)
+				service.disconnect(err)
 				return err
 			}
 		}
 	}
-	return nil
 }
 
 func (service *Service) parseMsg(msgBytes []byte) (message.Message, error) {
@@ -215,67 +550,304 @@ func (service *Service) parseMsg(msgBytes []byte) (message.Message, error) {
 		return nil, errors.New("wrong msg")
 	}
 
-	// Extract the type from the first byte
-	t := message.MessageType(msgBytes[0] >> 4)
-
-	// Create a new message
-	msg, err := t.New()
-	if err != nil {
-		return nil, err
-	}
-
-	// Decode it from the bufio.Reader
-	_, err = msg.Decode(msgBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	return msg, nil
+	// create the message according to the type in first byte, decode and verify it
+	return message.NewVersionMessage(msgBytes, service.version)
 }
 
 func (service *Service) processMsg(msg message.Message) error {
 
 	switch ins := msg.(type) {
 	case *message.PublishMessage:
-		service.processPublish(ins)
+		return service.processPublish(ins)
 	case *message.SubscribeMessage:
-		service.processSubscribeMessage(ins)
+		return service.processSubscribeMessage(ins)
 	case *message.UnsubscribeMessage:
+		return service.processUnsubscribe(ins)
+	case *message.PubAckMessage:
+		service.acknowledge(ins.PacketID(), message.PUBACK)
+	case *message.PubRecMessage:
+		return service.processPubRec(ins)
+	case *message.PubRelMessage:
+		return service.processPubRel(ins)
+	case *message.PubCompMessage:
+		service.acknowledge(ins.PacketID(), message.PUBCOMP)
+	case *message.DisconnectMessage:
+		return service.processDisconnect(ins)
+	case *message.PingReqMessage:
+		_, err := service.writeMessage(message.NewPingRespMessage())
+		return err
 	default:
-		return fmt.Errorf("(%v) invalid message type %v", service.cid(), msg.Name())
+		return fmt.Errorf("(%v) invalid message type %v", service.cid(), msg.MessageType())
 	}
 	return nil
 }
 
+// processUnsubscribe remove the topic filters of the session and reply UNSUBACK,
+// UNSUBACK is sent even if no topic filters are matched [MQTT-3.10.4-5]
 func (service *Service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
-	return nil
+	resp := message.NewUnsubAckMessage()
+	resp.SetPacketID(msg.PacketID())
+
+	for _, topic := range msg.Topics() {
+		if service.topics.Unregister(string(topic), service.cid()) {
+			resp.AddReasonCode(message.ReasonSuccess)
+		} else {
+			resp.AddReasonCode(message.ReasonNoSubscriptionExisted)
+		}
+	}
+	service.saveSession()
+
+	_, err := service.writeMessage(resp)
+	return err
 }
 
-//
+// the message is encoded once for each protocol version and qos, the frames are shared by the subscribers.
+// The QoS 1 message is acknowledged with PUBACK after it is handed over to the subscribers.
+// The QoS 2 message is forwarded when it is received first, the packet id is kept on the session until
+// PUBREL, so the duplicates are only answered with PUBREC and not forwarded again
 func (service *Service) processPublish(msg *message.PublishMessage) error {
 
-	topic := string(msg.Topic())
-	subs := service.topics.Find(topic)
-	for _, sub := range subs {
-		go sub.publish(msg)
+	// CONNACK has no Topic Alias Maximum, so the server accepts no topic alias, the alias would
+	// also leave the topic empty. So the forwarded and the retained messages never carry one
+	if _, ok := msg.Properties().Int(message.PropTopicAlias); ok && service.version == message.Version5 {
+		return message.ReasonTopicAliasInvalid
+	}
+
+	// the message denied by the authorizer is dropped, the client is acknowledged anyway,
+	// MQTT 5.0 client is told by the reason code, then no PUBREL follows PUBREC
+	allowed := service.authorize(AccessPublish, string(msg.Topic()))
+
+	switch msg.Qos() {
+	case message.QosAtMostOnce:
+		if !allowed {
+			return nil
+		}
+		return service.forward(msg)
+
+	case message.QosAtLeastOnce:
+		ack := message.NewPubAckMessage()
+		ack.SetPacketID(msg.PacketID())
+		if !allowed {
+			ack.SetReasonCode(message.ReasonNotAuthorized)
+		} else if err := service.forward(msg); err != nil {
+			return err
+		}
+		_, err := service.writeMessage(ack)
+		return err
+
+	default:
+		rec := message.NewPubRecMessage()
+		rec.SetPacketID(msg.PacketID())
+		if !allowed && service.version == message.Version5 {
+			rec.SetReasonCode(message.ReasonNotAuthorized)
+		} else if service.session.receive(msg.PacketID()) && allowed {
+			if err := service.forward(msg); err != nil {
+				service.session.complete(msg.PacketID())
+				return err
+			}
+		}
+		_, err := service.writeMessage(rec)
+		return err
 	}
-	return nil
 }
 
-// implement
-func (service *Service) publish(msg *message.PublishMessage) error {
+// acknowledge the outbound message is finished, the window is freed for the pending messages.
+// The acknowledgement of an unknown packet id, or not matching the qos of the message, is ignored
+func (service *Service) acknowledge(packetID uint16, ack byte) {
+	if !service.session.acknowledge(packetID, ack) {
+		glog.Warningf("(%v) ignore the acknowledgement 0x%x of the packet id %d", service.cid(), ack, packetID)
+		return
+	}
+	service.sendPending()
+}
 
-	n, err := service.writeMessage(msg)
-	if err != nil {
-		fmt.Printf("error in write msg %v %v ", n, err)
+// processPubRel the publisher releases the QoS 2 message, reply PUBCOMP
+func (service *Service) processPubRel(msg *message.PubRelMessage) error {
+	comp := message.NewPubCompMessage()
+	comp.SetPacketID(msg.PacketID())
+	if !service.session.complete(msg.PacketID()) {
+		comp.SetReasonCode(message.ReasonPacketIdentifierNotFound)
+	}
+	_, err := service.writeMessage(comp)
+	return err
+}
+
+// processPubRec the subscriber receives the QoS 2 message, reply PUBREL.
+// In MQTT 5.0 a PUBREC with a failure reason code ends the flow without PUBREL
+func (service *Service) processPubRec(msg *message.PubRecMessage) error {
+	if msg.ReasonCode().IsFailure() {
+		service.acknowledge(msg.PacketID(), message.PUBREC)
+		return nil
 	}
 
+	rel := message.NewPubRelMessage()
+	rel.SetPacketID(msg.PacketID())
+	if !service.session.release(msg.PacketID()) {
+		rel.SetReasonCode(message.ReasonPacketIdentifierNotFound)
+	}
+	_, err := service.writeMessage(rel)
 	return err
 }
 
+// authorize check the topic access of the client, everything is allowed without the authorizer,
+// the denied PUBLISH messages are counted
+func (service *Service) authorize(access Access, topic string) bool {
+	if service.authz == nil || service.authz.Authorize(service.userName, service.cid(), access, topic) {
+		return true
+	}
+	glog.Warningf("(%v) %s %q is not authorized", service.cid(), access, topic)
+	if access == AccessPublish && service.stats != nil {
+		service.stats.denied()
+	}
+	return false
+}
+
+// forward publish the message to the matching subscribers
+func (service *Service) forward(msg *message.PublishMessage) error {
+	return deliver(service.topics, service.retained, msg, service.cid())
+}
+
+func (service *Service) protocolVersion() byte {
+	return service.version
+}
+
+// implement
+// the frame is shared by all the subscribers, the QoS 1 and QoS 2 messages get the packet id of
+// the session and are kept until they are acknowledged, a failed write is redelivered later.
+// The messages exceeding the inflight window are queued on the session and sent after acknowledgements.
+// The message is queued for the writer, so the publisher does not wait for the client
+func (service *Service) publish(frame *message.PublishFrame, share string) error {
+
+	var packetID uint16
+	if frame.Qos() > message.QosAtMostOnce {
+		if packetID = service.session.track(frame, share); packetID == 0 {
+			return nil
+		}
+	} else if service.session.follow(frame, share) {
+		return nil
+	}
+	service.queue(outbound{packetID: packetID, frame: frame})
+	return nil
+}
+
+// processSubscribeMessage register the valid topic filters and reply SUBACK with one return code
+// for each filter in order, the invalid filters get the failure return code 0x80.
+// MQTT 3.1 has no failure return code, so the client is disconnected instead.
+// The retained messages matching the new subscriptions are sent after SUBACK
 func (service *Service) processSubscribeMessage(msg *message.SubscribeMessage) error {
-	for _, topic := range msg.Topics() {
-		service.topics.Register(string(topic), service.cid(), service)
+	resp := message.NewSubAckMessage()
+	resp.SetPacketID(msg.PacketID())
+
+	// CONNACK tells the subscription identifiers are not available
+	if _, ok := msg.Properties().Int(message.PropSubscriptionIdentifier); ok && service.version == message.Version5 {
+		return message.ReasonSubIDNotSupported
+	}
+
+	var retained []subscription
+	subscribed := service.topics.Subscriptions(service.cid())
+
+	for i, topic := range msg.Topics() {
+		if err := message.ValidTopicFilter(topic); err != nil {
+			if service.version == message.Version31 {
+				return err
+			}
+			glog.Errorf("(%v) invalid topic filter %q", service.cid(), topic)
+			if service.version == message.Version5 {
+				resp.AddReturnCode(byte(message.ReasonTopicFilterInvalid))
+			} else {
+				resp.AddReturnCode(message.QosFailure)
+			}
+			continue
+		}
+
+		// the share name is not a part of the topic access
+		if _, filter := splitShared(string(topic)); !service.authorize(AccessSubscribe, filter) {
+			if service.version == message.Version31 {
+				return ErrNotAuthorized
+			}
+			if service.version == message.Version5 {
+				resp.AddReturnCode(byte(message.ReasonNotAuthorized))
+			} else {
+				resp.AddReturnCode(message.QosFailure)
+			}
+			continue
+		}
+
+		qos := msg.Qos()[i]
+		_, exists := subscribed[string(topic)]
+		// the retained messages are not sent for the shared subscriptions
+		shared := strings.HasPrefix(string(topic), message.SharePrefix)
+		if !shared && wantRetained(service.version, msg.Options()[i], exists) {
+			retained = append(retained, subscription{filter: string(topic), qos: qos})
+		}
+
+		// MQTT 5.0 keeps No Local and Retain As Published with the subscription,
+		// No Local is not allowed on a shared subscription [MQTT-3.8.3-4]
+		options := qos
+		if service.version == message.Version5 {
+			options = msg.Options()[i] & subOptions
+			if shared && options&subNoLocal != 0 {
+				return message.ReasonProtocolError
+			}
+		}
+		service.topics.Register(string(topic), service.cid(), options, service.session)
+		resp.AddReturnCode(qos)
+	}
+	service.saveSession()
+
+	if _, err := service.writeMessage(resp); err != nil {
+		return err
+	}
+	for _, sub := range retained {
+		if err := service.sendRetained(sub.filter, sub.qos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscription a topic filter with the granted qos
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+// wantRetained whether the retained messages are sent for the subscription, MQTT 5.0 decides it by
+// the Retain Handling option: 0 always, 1 only for a new subscription, 2 never
+func wantRetained(version byte, options byte, exists bool) bool {
+	if version != message.Version5 {
+		return true
+	}
+	switch (options >> 4) & 0x3 {
+	case 0:
+		return true
+	case 1:
+		return !exists
+	}
+	return false
+}
+
+// sendRetained send the retained messages matching the topic filter with RETAIN set [MQTT-3.3.1-6],
+// the qos is the minimum of the message and the subscription
+func (service *Service) sendRetained(filter string, qos byte) error {
+	if service.retained == nil {
+		return nil
+	}
+	for _, retained := range service.retained.Match(filter) {
+		msgQos := retained.Qos
+		if qos < msgQos {
+			msgQos = qos
+		}
+
+		frames := newFrameCache(retained.publishMessage())
+		frame, err := frames.get(service.version, msgQos, true)
+		if err == nil {
+			err = service.session.publish(frame, "")
+		}
+		frames.release()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,589 @@
+package mqtt
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestService create a service over one end of a pipe, the other end is returned as the client
+func newTestService(id string, version byte) (*Service, *FrameReader, net.Conn) {
+	server, client := net.Pipe()
+	connMsg := message.NewConnMessage()
+	connMsg.SetVersion(version)
+	session := newSession(id)
+	session.Init(connMsg)
+	service := NewService(1, session, server, NewFrameReader(server, 0), connMsg, nil, NewTopicManager())
+	session.attach(service)
+
+	// the published messages are written by the writer
+	service.wg.Add(1)
+	go service.loopWriteMsg()
+	return service, NewFrameReader(client, 0), client
+}
+
+func readTestMessage(t *testing.T, reader *FrameReader, version byte) message.Message {
+	frame, err := reader.ReadFrame()
+	assert.NoError(t, err, "should not have error in reading")
+	msg, err := message.NewVersionMessage(frame.Bytes(), version)
+	assert.NoError(t, err, "should not have error in decoding")
+	return msg
+}
+
+func TestServiceSubscribe(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version311)
+	defer client.Close()
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketID(5)
+	msg.AddTopic([]byte("sport/#"), message.QosAtLeastOnce)
+	msg.AddTopic([]byte("sport/tennis#"), message.QosAtMostOnce)
+	msg.AddTopic([]byte("a/#/b"), message.QosAtMostOnce)
+	msg.AddTopic([]byte("finance/+"), message.QosExactlyOnce)
+
+	go func() {
+		assert.NoError(t, service.processMsg(msg))
+	}()
+
+	ack := readTestMessage(t, reader, message.Version311).(*message.SubAckMessage)
+	assert.Equal(t, uint16(5), ack.PacketID())
+	assert.Equal(t, []byte{0x01, 0x80, 0x80, 0x02}, ack.ReturnCodes())
+	assert.Equal(t, 1, len(service.topics.Find("sport")))
+	assert.Equal(t, 1, len(service.topics.Find("finance/stock")))
+	assert.Equal(t, 0, len(service.topics.Find("a/x/b")))
+}
+
+func TestServiceSubscribeV31(t *testing.T) {
+	service, _, client := newTestService("c1", message.Version31)
+	defer client.Close()
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketID(5)
+	msg.AddTopic([]byte("a/#/b"), message.QosAtMostOnce)
+	assert.Equal(t, message.ErrorInvalidTopic, service.processMsg(msg), "MQTT 3.1 client should be disconnected")
+}
+
+func TestServiceUnsubscribe(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version5)
+	defer client.Close()
+
+	service.topics.Register("sport/#", service.cid(), message.QosAtMostOnce, service.session)
+	service.topics.Register("finance/+", service.cid(), message.QosAtMostOnce, service.session)
+
+	msg := message.NewUnsubscribeMessage()
+	msg.SetPacketID(6)
+	msg.AddTopic([]byte("sport/#"))
+	msg.AddTopic([]byte("sport/tennis"))
+
+	go func() {
+		assert.NoError(t, service.processMsg(msg))
+	}()
+
+	ack := readTestMessage(t, reader, message.Version5).(*message.UnsubAckMessage)
+	assert.Equal(t, uint16(6), ack.PacketID())
+	assert.Equal(t, []byte{byte(message.ReasonSuccess), byte(message.ReasonNoSubscriptionExisted)}, ack.ReasonCodes())
+	assert.Equal(t, 0, len(service.topics.Find("sport/tennis")))
+	assert.Equal(t, 1, len(service.topics.Find("finance/stock")))
+}
+
+func TestServicePublishQos1(t *testing.T) {
+	publisher, pubReader, pubClient := newTestService("c1", message.Version311)
+	defer pubClient.Close()
+
+	subscriber, subReader, subClient := newTestService("c2", message.Version311)
+	defer subClient.Close()
+	subscriber.topics = publisher.topics
+	publisher.topics.Register("sport/#", subscriber.cid(), message.QosAtLeastOnce, subscriber.session)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(message.QosAtLeastOnce)
+	msg.SetPacketID(9)
+	msg.SetPayload([]byte("send me home"))
+
+	go func() {
+		assert.NoError(t, publisher.processMsg(msg))
+	}()
+
+	// the message is forwarded before PUBACK
+	out := readTestMessage(t, subReader, message.Version311).(*message.PublishMessage)
+	assert.Equal(t, message.QosAtLeastOnce, out.Qos())
+
+	ack := readTestMessage(t, pubReader, message.Version311).(*message.PubAckMessage)
+	assert.Equal(t, uint16(9), ack.PacketID(), "publisher should get PUBACK")
+	assert.False(t, out.IsDup())
+	assert.Equal(t, 1, subscriber.session.inflightLen(), "message should be kept until PUBACK")
+
+	// redelivered with DUP after timeout
+	go subscriber.session.redeliver(0, subscriber.resend)
+	dup := readTestMessage(t, subReader, message.Version311).(*message.PublishMessage)
+	assert.True(t, dup.IsDup(), "redelivered message should have DUP set")
+	assert.Equal(t, out.PacketID(), dup.PacketID(), "redelivered message should have the same packet id")
+
+	puback := message.NewPubAckMessage()
+	puback.SetPacketID(out.PacketID())
+	assert.NoError(t, subscriber.processMsg(puback))
+	assert.Equal(t, 0, subscriber.session.inflightLen(), "message should be removed after PUBACK")
+}
+
+func TestServicePublishQos2(t *testing.T) {
+	publisher, pubReader, pubClient := newTestService("c1", message.Version311)
+	defer pubClient.Close()
+
+	subscriber, subReader, subClient := newTestService("c2", message.Version311)
+	defer subClient.Close()
+	subscriber.topics = publisher.topics
+	publisher.topics.Register("sport/#", subscriber.cid(), message.QosExactlyOnce, subscriber.session)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(message.QosExactlyOnce)
+	msg.SetPacketID(9)
+	msg.SetPayload([]byte("send me home"))
+
+	go func() {
+		assert.NoError(t, publisher.processMsg(msg))
+	}()
+	out := readTestMessage(t, subReader, message.Version311).(*message.PublishMessage)
+	assert.Equal(t, message.QosExactlyOnce, out.Qos())
+	rec := readTestMessage(t, pubReader, message.Version311).(*message.PubRecMessage)
+	assert.Equal(t, uint16(9), rec.PacketID(), "publisher should get PUBREC")
+
+	// the duplicate is answered with PUBREC only
+	msg.SetDup(true)
+	go func() {
+		assert.NoError(t, publisher.processMsg(msg))
+	}()
+	readTestMessage(t, pubReader, message.Version311)
+
+	rel := message.NewPubRelMessage()
+	rel.SetPacketID(9)
+	go func() {
+		assert.NoError(t, publisher.processMsg(rel))
+	}()
+	comp := readTestMessage(t, pubReader, message.Version311).(*message.PubCompMessage)
+	assert.Equal(t, uint16(9), comp.PacketID(), "publisher should get PUBCOMP")
+
+	// the subscriber side
+	subRec := message.NewPubRecMessage()
+	subRec.SetPacketID(out.PacketID())
+	go func() {
+		assert.NoError(t, subscriber.processMsg(subRec))
+	}()
+	subRel := readTestMessage(t, subReader, message.Version311).(*message.PubRelMessage)
+	assert.Equal(t, out.PacketID(), subRel.PacketID(), "subscriber should get PUBREL")
+
+	subComp := message.NewPubCompMessage()
+	subComp.SetPacketID(out.PacketID())
+	assert.NoError(t, subscriber.processMsg(subComp))
+	assert.Equal(t, 0, subscriber.session.inflightLen(), "message should be removed after PUBCOMP")
+
+	// no more message is forwarded to the subscriber
+	subReader.SetReadTimeout(50 * time.Millisecond)
+	_, err := subReader.ReadFrame()
+	assert.True(t, IsTimeoutError(err), "duplicate should not be forwarded")
+}
+
+// chanSub a subscriber which hands the published messages over the channel
+type chanSub struct {
+	frames chan []byte
+}
+
+func (sub *chanSub) protocolVersion() byte {
+	return message.Version311
+}
+
+func (sub *chanSub) publish(frame *message.PublishFrame, share string) error {
+	sub.frames <- append([]byte(nil), frame.Bytes()...)
+	return nil
+}
+
+func TestServiceWill(t *testing.T) {
+	cases := []struct {
+		disconnect *message.DisconnectMessage
+		published  bool
+	}{
+		{nil, true},
+		{message.NewDisconnectMessage(), false},
+		{func() *message.DisconnectMessage {
+			msg := message.NewDisconnectMessage()
+			msg.SetReasonCode(message.ReasonDisconnectWithWill)
+			return msg
+		}(), true},
+	}
+
+	for _, c := range cases {
+		service, _, client := newTestService("c1", message.Version5)
+		connMsg := message.NewConnMessage()
+		connMsg.SetVersion(message.Version5)
+		connMsg.SetWill(true)
+		connMsg.SetQos(message.QosAtLeastOnce)
+		connMsg.WillTopic = []byte("last/will")
+		connMsg.WillMessage = []byte("gone")
+		connMsg.WillProperties().SetInt(message.PropWillDelayInterval, 10)
+		connMsg.WillProperties().SetData(message.PropContentType, []byte("text/plain"))
+		service.session.Update(connMsg)
+
+		sub := &chanSub{frames: make(chan []byte, 1)}
+		service.topics.Register("last/#", "c2", message.QosExactlyOnce, sub)
+
+		if c.disconnect != nil {
+			assert.NoError(t, service.processMsg(c.disconnect))
+		}
+		service.Close()
+		client.Close()
+
+		select {
+		case buf := <-sub.frames:
+			assert.True(t, c.published, "the will should not be published after DISCONNECT")
+			will := message.NewPublishMessage()
+			_, err := will.Decode(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("last/will"), will.Topic())
+			assert.Equal(t, []byte("gone"), will.Payload())
+			assert.Equal(t, message.QosAtLeastOnce, will.Qos())
+		case <-time.After(100 * time.Millisecond):
+			assert.False(t, c.published, "the will should be published")
+		}
+		assert.Nil(t, service.session.takeWill(), "the will is published once")
+	}
+}
+
+func TestServiceTopicAlias(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version5)
+	defer client.Close()
+	sub := &chanSub{frames: make(chan []byte, 1)}
+	service.topics.Register("#", "c2", message.QosAtMostOnce, sub)
+
+	msg := message.NewPublishMessage()
+	msg.SetProtocolVersion(message.Version5)
+	msg.Properties().SetInt(message.PropTopicAlias, 1)
+	msg.SetPayload([]byte("x"))
+	err := service.processMsg(msg)
+	assert.Equal(t, message.ReasonTopicAliasInvalid, err, "no topic alias is allowed")
+
+	go service.disconnect(err)
+	disconnect := readTestMessage(t, reader, message.Version5).(*message.DisconnectMessage)
+	assert.Equal(t, message.ReasonTopicAliasInvalid, disconnect.ReasonCode())
+	assert.Len(t, sub.frames, 0, "the message should not be forwarded")
+}
+
+func TestServicePing(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version311)
+	defer client.Close()
+
+	go func() {
+		assert.NoError(t, service.processMsg(message.NewPingReqMessage()))
+	}()
+	_, ok := readTestMessage(t, reader, message.Version311).(*message.PingRespMessage)
+	assert.True(t, ok, "should reply PINGRESP")
+}
+
+func TestServiceKeepAliveTimeout(t *testing.T) {
+	assert.Equal(t, 15*time.Second, keepAliveTimeout(10))
+	assert.Equal(t, time.Duration(0), keepAliveTimeout(0), "keepalive 0 turns off the timeout")
+
+	service, _, client := newTestService("c1", message.Version311)
+	defer client.Close()
+	service.readTimeout = 50 * time.Millisecond
+	service.Start()
+
+	select {
+	case <-service.done:
+	case <-time.After(time.Second):
+		t.Fatal("the service should be closed after the keepalive timeout")
+	}
+}
+
+func TestServiceDisconnect(t *testing.T) {
+	service, _, client := newTestService("c1", message.Version311)
+	defer client.Close()
+	service.session.setExpiry(0)
+	service.topics.Register("sport/#", service.cid(), message.QosAtMostOnce, service.session)
+	service.Start()
+
+	_, err := message.EncodeTo(message.NewDisconnectMessage(), client)
+	assert.NoError(t, err)
+	select {
+	case <-service.done:
+	case <-time.After(time.Second):
+		t.Fatal("DISCONNECT should close the service")
+	}
+	assert.Nil(t, service.session.current(), "service should be detached")
+	assert.Equal(t, 0, len(service.topics.Find("sport/tennis")), "subscriptions of the clean session should be removed")
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err, "the connection should be closed")
+}
+
+func TestServiceDisconnectSessionExpiry(t *testing.T) {
+	service, _, client := newTestService("c1", message.Version5)
+	defer client.Close()
+	service.maxSessionExpiry = time.Minute
+	service.session.setExpiry(10 * time.Second)
+
+	msg := message.NewDisconnectMessage()
+	msg.Properties().SetInt(message.PropSessionExpiryInterval, 3600)
+	assert.NoError(t, service.processMsg(msg))
+	assert.Equal(t, time.Minute, service.session.expiry, "expiry should be limited by the server")
+
+	service, _, client = newTestService("c2", message.Version5)
+	defer client.Close()
+	service.session.setExpiry(0)
+	msg = message.NewDisconnectMessage()
+	msg.Properties().SetInt(message.PropSessionExpiryInterval, 10)
+	assert.Equal(t, message.ReasonProtocolError, service.processMsg(msg), "expiry can not be set after 0")
+}
+
+func TestServiceRetained(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version5)
+	defer client.Close()
+	service.retained = NewMemoryRetainedStore()
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(message.QosExactlyOnce)
+	msg.SetRetain(true)
+	msg.SetPayload([]byte("score"))
+	assert.NoError(t, service.forward(msg))
+	assert.Equal(t, 1, service.retained.Len(), "the retained message should be stored")
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(5)
+	sub.AddTopic([]byte("sport/#"), message.QosAtLeastOnce)
+	sub.AddTopicOptions([]byte("sport/+"), message.QosAtLeastOnce|0x20)
+	go func() {
+		assert.NoError(t, service.processMsg(sub))
+	}()
+
+	_, ok := readTestMessage(t, reader, message.Version5).(*message.SubAckMessage)
+	assert.True(t, ok, "SUBACK should be sent first")
+	pub := readTestMessage(t, reader, message.Version5).(*message.PublishMessage)
+	assert.True(t, pub.IsRetain(), "retained message should have RETAIN set")
+	assert.Equal(t, message.QosAtLeastOnce, pub.Qos(), "qos should be the minimum")
+	assert.Equal(t, []byte("score"), pub.Payload())
+	assert.Equal(t, 1, service.session.inflightLen(), "retain handling 2 should not send the message again")
+
+	assert.True(t, wantRetained(message.Version5, 0x10, false))
+	assert.False(t, wantRetained(message.Version5, 0x10, true), "retain handling 1 only sends for a new subscription")
+	assert.True(t, wantRetained(message.Version311, 0x20, true))
+
+	// the client subscribes to the topic, it gets the message too
+	msg.SetPayload(nil)
+	go func() {
+		assert.NoError(t, service.forward(msg))
+	}()
+	pub = readTestMessage(t, reader, message.Version5).(*message.PublishMessage)
+	assert.False(t, pub.IsRetain(), "the established subscription gets RETAIN 0")
+	assert.Equal(t, 0, service.retained.Len(), "empty payload should remove the retained message")
+}
+
+func TestServiceSharedReroute(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version311)
+	defer client.Close()
+
+	other := &chanSub{frames: make(chan []byte, 1)}
+	service.topics.Register("$share/g/sport/#", "c1", message.QosExactlyOnce, service.session)
+	service.topics.Register("$share/g/sport/#", "c2", message.QosAtLeastOnce, other)
+
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+	go func() {
+		assert.NoError(t, service.session.publish(frame, "$share/g/sport/#"))
+	}()
+	readTestMessage(t, reader, message.Version311)
+	assert.Equal(t, 1, service.session.inflightLen())
+
+	// the member goes away before PUBACK
+	service.Close()
+	select {
+	case buf := <-other.frames:
+		msg := message.NewPublishMessage()
+		_, err := msg.Decode(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("sport/tennis"), msg.Topic())
+		assert.Equal(t, message.QosAtLeastOnce, msg.Qos())
+		assert.Equal(t, []byte("send me home"), msg.Payload())
+	case <-time.After(100 * time.Millisecond):
+		t.Error("the message should be delivered to the other member")
+	}
+	assert.Equal(t, 0, service.session.inflightLen(), "the message should be removed from the session")
+}
+
+func TestServiceAuthorize(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version5)
+	defer client.Close()
+	acl, err := ParseACL(strings.NewReader("allow all sport/#\ndeny all sport/secret"))
+	assert.NoError(t, err)
+	service.authz = acl
+	service.stats = NewStats()
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(5)
+	sub.AddTopic([]byte("sport/+"), message.QosAtLeastOnce)
+	sub.AddTopic([]byte("finance"), message.QosAtLeastOnce)
+	sub.AddTopic([]byte("$share/g/sport/tennis"), message.QosAtLeastOnce)
+	go func() {
+		assert.NoError(t, service.processMsg(sub))
+	}()
+	ack := readTestMessage(t, reader, message.Version5).(*message.SubAckMessage)
+	assert.Equal(t, []byte{byte(message.ReasonNotAuthorized), byte(message.ReasonNotAuthorized), message.QosAtLeastOnce},
+		ack.ReturnCodes(), "sport/+ overlaps the denied topic")
+	assert.Equal(t, map[string]byte{"$share/g/sport/tennis": 1}, service.topics.Subscriptions("c1"))
+
+	other := &chanSub{frames: make(chan []byte, 2)}
+	service.topics.Register("#", "c2", message.QosAtLeastOnce, other)
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("sport/secret"))
+	pub.SetQos(message.QosAtLeastOnce)
+	pub.SetPacketID(7)
+	pub.SetPayload([]byte("x"))
+	go func() {
+		assert.NoError(t, service.processMsg(pub))
+	}()
+	puback := readTestMessage(t, reader, message.Version5).(*message.PubAckMessage)
+	assert.Equal(t, message.ReasonNotAuthorized, puback.ReasonCode())
+	assert.Equal(t, uint64(1), service.stats.PublishDenied(), "denied publish should be counted")
+
+	pub.SetTopic([]byte("sport/news"))
+	go func() {
+		assert.NoError(t, service.processMsg(pub))
+	}()
+	puback = readTestMessage(t, reader, message.Version5).(*message.PubAckMessage)
+	assert.Equal(t, message.ReasonSuccess, puback.ReasonCode())
+
+	select {
+	case buf := <-other.frames:
+		msg := message.NewPublishMessage()
+		_, err := msg.Decode(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("sport/news"), msg.Topic(), "only the allowed message is forwarded")
+	case <-time.After(100 * time.Millisecond):
+		t.Error("the allowed message should be forwarded")
+	}
+}
+
+func TestServicePublishOrder(t *testing.T) {
+	publisher, _, pubClient := newTestService("c1", message.Version311)
+	defer pubClient.Close()
+	go io.Copy(io.Discard, pubClient)
+
+	subscriber, subReader, subClient := newTestService("c2", message.Version311)
+	defer subClient.Close()
+	publisher.topics.Register("sport/#", subscriber.cid(), message.QosAtLeastOnce, subscriber.session)
+
+	const n = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			msg := message.NewPublishMessage()
+			msg.SetTopic([]byte("sport/tennis"))
+			msg.SetQos(byte(i % 2))
+			msg.SetPacketID(uint16(i + 1))
+			msg.SetPayload([]byte(strconv.Itoa(i)))
+			assert.NoError(t, publisher.processMsg(msg))
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		out := readTestMessage(t, subReader, message.Version311).(*message.PublishMessage)
+		assert.Equal(t, strconv.Itoa(i), string(out.Payload()), "messages should arrive in order")
+		if out.Qos() == message.QosAtLeastOnce {
+			ack := message.NewPubAckMessage()
+			ack.SetPacketID(out.PacketID())
+			assert.NoError(t, subscriber.processMsg(ack))
+		}
+	}
+	<-done
+}
+
+func TestServiceSlowSubscriber(t *testing.T) {
+	publisher, _, pubClient := newTestService("c1", message.Version311)
+	defer pubClient.Close()
+	go io.Copy(io.Discard, pubClient)
+
+	subscriber, _, subClient := newTestService("c2", message.Version311)
+	defer subClient.Close()
+	publisher.topics.Register("sport/#", subscriber.cid(), message.QosAtLeastOnce, subscriber.session)
+
+	// the subscriber is not reading, the QoS 0 messages beyond the queue are dropped
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < cap(subscriber.outChan)+10; i++ {
+			msg := message.NewPublishMessage()
+			msg.SetTopic([]byte("sport/tennis"))
+			msg.SetPayload([]byte(strconv.Itoa(i)))
+			assert.NoError(t, publisher.processMsg(msg))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the publisher should not wait for the subscriber")
+	}
+	select {
+	case <-subscriber.quit:
+		t.Fatal("the subscriber should not be closed for the QoS 0 messages")
+	default:
+	}
+
+	// the QoS 1 message does not fit, it is kept in flight and the connection is closed
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(message.QosAtLeastOnce)
+	msg.SetPacketID(1)
+	assert.NoError(t, publisher.processMsg(msg))
+	select {
+	case <-subscriber.quit:
+	case <-time.After(time.Second):
+		t.Fatal("the subscriber should be closed when the queue is full")
+	}
+	assert.Equal(t, 1, subscriber.session.inflightLen())
+}
+
+func TestServiceSubscribeNoLocalShared(t *testing.T) {
+	service, _, client := newTestService("c1", message.Version5)
+	defer client.Close()
+
+	msg := message.NewSubscribeMessage()
+	msg.SetProtocolVersion(message.Version5)
+	msg.SetPacketID(5)
+	msg.AddTopicOptions([]byte("$share/g/sport/#"), message.QosAtMostOnce|subNoLocal)
+	assert.Equal(t, message.ReasonProtocolError, service.processMsg(msg), "No Local is not allowed on a shared subscription")
+}
+
+func TestServiceMaxPacketSize(t *testing.T) {
+	service, reader, client := newTestService("c1", message.Version5)
+	defer client.Close()
+	service.maxPacketSize = 32
+
+	sub := message.NewSubscribeMessage()
+	sub.SetProtocolVersion(message.Version5)
+	sub.SetPacketID(5)
+	sub.Properties().SetInt(message.PropSubscriptionIdentifier, 1)
+	sub.AddTopic([]byte("sport/#"), message.QosAtLeastOnce)
+	assert.Equal(t, message.ReasonSubIDNotSupported, service.processMsg(sub), "the subscription identifiers are not supported")
+
+	service.topics.Register("sport/#", service.cid(), message.QosAtLeastOnce, service.session)
+	for _, payload := range []string{strings.Repeat("x", 64), "small"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte("sport/tennis"))
+		msg.SetQos(message.QosAtLeastOnce)
+		msg.SetPacketID(1)
+		msg.SetPayload([]byte(payload))
+		assert.NoError(t, deliver(service.topics, nil, msg, ""))
+	}
+
+	// the large message is discarded as if it is acknowledged
+	out := readTestMessage(t, reader, message.Version5).(*message.PublishMessage)
+	assert.Equal(t, []byte("small"), out.Payload())
+	assert.Equal(t, 1, service.session.inflightLen(), "the discarded message should not be kept in flight")
+}
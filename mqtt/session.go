@@ -1,18 +1,679 @@
 package mqtt
 
 import (
-	"github.com/surgemq/message"
+	"container/list"
+	"fmt"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 )
 
+// QueuePolicy decide which message is dropped when the queue of the session is full
+type QueuePolicy int
+
+const (
+	// DropNewest the incoming message is dropped
+	DropNewest QueuePolicy = iota
+
+	// DropOldest the oldest queued message is dropped to make room for the incoming one
+	DropOldest
+)
+
+// ParseQueuePolicy parse the policy name of the config, "drop-newest" or "drop-oldest"
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	switch name {
+	case "", "drop-newest":
+		return DropNewest, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	}
+	return DropNewest, fmt.Errorf("unknown queue policy %q", name)
+}
+
+// QueueLimit the limits of the messages queued on the session, 0 means no limit
+type QueueLimit struct {
+	Messages int
+	Bytes    int
+	Policy   QueuePolicy
+}
+
+// inflightMsg an outbound QoS 1 or QoS 2 message which is not acknowledged by the client,
+// frame is nil after PUBREC of the QoS 2 message is received, then PUBREL is sent until PUBCOMP.
+// The pending messages are kept in it too, without the packet id.
+// share is the shared subscription the message is delivered for, empty for the other subscriptions
+type inflightMsg struct {
+	packetID uint16
+	frame    *message.PublishFrame
+	sent     time.Time
+	share    string
+}
+
+// Session the state of the client kept by the server, it is accessed by the goroutines
+// of the service and the goroutines publishing to the client, so it is locked.
+// The session is the subscriber registered in TopicsManager, so the subscriptions survive
+// the connection of a persistent session, the messages are handed to the service currently attached
 type Session struct {
+	id   string
 	conn net.Conn
+
+	lock sync.Mutex
+
+	// the state of a clean session lasts as long as the connection
+	cleanSession bool
+
+	// the persistent session is discarded after the client is disconnected for expiry,
+	// a negative expiry means the session never expires
+	expiry         time.Duration
+	disconnectedAt time.Time
+
+	// the will message of the current connection, it is published when the connection
+	// is closed without DISCONNECT
+	will *message.PublishMessage
+
+	// the service of the current connection, nil when the client is disconnected
+	service *Service
+	version byte
+
+	// the last allocated packet identifier
+	packetID uint16
+
+	// the unacknowledged outbound messages in the order they are sent,
+	// the messages are redelivered in this order
+	inflight      *list.List
+	inflightIndex map[uint16]*list.Element
+
+	// the maximum number of the inflight messages, the following messages wait in pending,
+	// so a slow subscriber does not hold an unbounded number of messages in flight.
+	// The QoS 0 messages wait behind them too, so they keep the order
+	maxInflight int
+	pending     *list.List
+
+	// the pending messages are kept within the limit, it bounds the messages queued
+	// while the client of a persistent session is disconnected too
+	queueLimit   QueueLimit
+	pendingBytes int
+	dropped      uint64
+
+	// the packet identifiers of the inbound QoS 2 messages which are forwarded but not released by PUBREL
+	received map[uint16]struct{}
 }
 
-func (this *Session) Init(msg *message.ConnectMessage) error {
-	return nil
+func newSession(id string) *Session {
+	return &Session{
+		id:             id,
+		expiry:         -1,
+		disconnectedAt: time.Now(),
+		inflight:       list.New(),
+		inflightIndex:  make(map[uint16]*list.Element),
+		maxInflight:    DefaultMaxInflight,
+		pending:        list.New(),
+		received:       make(map[uint16]struct{}),
+	}
+}
+
+// Init initialize the new session from the CONNECT message
+func (this *Session) Init(msg *message.ConnMessage) error {
+	return this.Update(msg)
 }
 
-func (this *Session) Update(msg *message.ConnectMessage) error {
+// Update resume the existing session with the CONNECT message of the new connection
+func (this *Session) Update(msg *message.ConnMessage) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cleanSession = msg.IsCleanSession()
+	// MQTT 3.1 and 3.1.1 encode PUBLISH in the same way, only MQTT 5.0 adds the properties
+	if (this.version == message.Version5) != (msg.Version() == message.Version5) {
+		this.convert(this.version, msg.Version())
+	}
+	this.version = msg.Version()
+	this.will = newWill(msg)
 	return nil
 }
+
+// convert encode the stored messages again for the protocol version of the new connection,
+// the message which can not be converted is dropped. It is called with the session locked
+func (this *Session) convert(from byte, to byte) {
+	for _, l := range []*list.List{this.inflight, this.pending} {
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			msg := e.Value.(*inflightMsg)
+			if msg.frame == nil {
+				e = next
+				continue
+			}
+
+			frame, err := convertFrame(msg.frame, from, to)
+			if l == this.pending {
+				this.pendingBytes -= msg.frame.Len()
+			}
+			msg.frame.Release()
+			msg.frame = frame
+			if err != nil {
+				glog.Errorf("(%s) drop the message which can not be converted: %v", this.id, err)
+				l.Remove(e)
+				if l == this.inflight {
+					delete(this.inflightIndex, msg.packetID)
+				}
+			} else if l == this.pending {
+				this.pendingBytes += frame.Len()
+			}
+			e = next
+		}
+	}
+}
+
+// newWill create the will message of the CONNECT message, nil if the will flag is not set.
+// The will properties are sent with the message except the Will Delay Interval
+func newWill(msg *message.ConnMessage) *message.PublishMessage {
+	if !msg.IsWill() {
+		return nil
+	}
+
+	will := message.NewPublishMessage()
+	will.SetTopic(msg.WillTopic)
+	will.SetPayload(msg.WillMessage)
+	will.SetQos(msg.Qos())
+	will.SetRetain(msg.IsWillRetain())
+	for _, p := range msg.WillProperties().Items() {
+		if p.ID != message.PropWillDelayInterval {
+			will.Properties().Add(p)
+		}
+	}
+	return will
+}
+
+// takeWill return the will message and remove it from the session, so it is published once
+func (this *Session) takeWill() *message.PublishMessage {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	will := this.will
+	this.will = nil
+	return will
+}
+
+// setExpiry set the expiry interval after the client disconnects, 0 means the session ends with the connection
+// like the clean session, a negative value means it never expires.
+// In MQTT 5.0 the Session Expiry Interval decides whether the session is kept, not the Clean Start flag
+func (this *Session) setExpiry(expiry time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.expiry = expiry
+	this.cleanSession = expiry == 0
+}
+
+// expired whether the client has been disconnected longer than the expiry interval
+func (this *Session) expired(now time.Time) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.service == nil && this.expiry >= 0 && now.Sub(this.disconnectedAt) >= this.expiry
+}
+
+// IsCleanSession whether the session is discarded when the connection is closed
+func (this *Session) IsCleanSession() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.cleanSession
+}
+
+// attach the service of the new connection
+func (this *Session) attach(service *Service) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.service = service
+	this.version = service.version
+}
+
+// detach the service when its connection is closed, the session may be attached by another service already
+func (this *Session) detach(service *Service) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.service == service {
+		this.service = nil
+		this.disconnectedAt = time.Now()
+	}
+}
+
+// current the attached service, nil when the client is disconnected
+func (this *Session) current() *Service {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.service
+}
+
+func (this *Session) protocolVersion() byte {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.version
+}
+
+// publish hand the message to the service of the current connection. When the client of the persistent
+// session is disconnected, the QoS 1 and QoS 2 messages are queued and delivered in order on reconnect,
+// the QoS 0 messages are dropped
+func (this *Session) publish(frame *message.PublishFrame, share string) error {
+	this.lock.Lock()
+	service := this.service
+	if service == nil {
+		if !this.cleanSession && frame.Qos() > message.QosAtMostOnce {
+			this.enqueue(frame, share)
+		}
+		this.lock.Unlock()
+		return nil
+	}
+	this.lock.Unlock()
+
+	return service.publish(frame, share)
+}
+
+// connected whether the client of the session is connected
+func (this *Session) connected() bool {
+	return this.current() != nil
+}
+
+// clear release the messages kept by the session when it is discarded
+func (this *Session) clear() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for e := this.inflight.Front(); e != nil; e = e.Next() {
+		if msg := e.Value.(*inflightMsg); msg.frame != nil {
+			msg.frame.Release()
+		}
+	}
+	for e := this.pending.Front(); e != nil; e = e.Next() {
+		e.Value.(*inflightMsg).frame.Release()
+	}
+	this.inflight.Init()
+	this.pending.Init()
+	this.pendingBytes = 0
+	this.inflightIndex = make(map[uint16]*list.Element)
+	this.received = make(map[uint16]struct{})
+}
+
+// state the snapshot of the session saved by the session store, the subscriptions are kept by TopicsManager.
+// The connected session is saved as disconnected now, the expiry of the restored session starts from
+// the time the broker stopped, not from the previous disconnection
+func (this *Session) state(subs map[string]byte) *SessionState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	state := &SessionState{
+		ID:             this.id,
+		Version:        this.version,
+		Expiry:         this.expiry,
+		DisconnectedAt: this.disconnectedAt,
+		Subscriptions:  subs,
+	}
+	if this.service != nil {
+		state.DisconnectedAt = time.Now()
+	}
+	for e := this.inflight.Front(); e != nil; e = e.Next() {
+		msg := e.Value.(*inflightMsg)
+		stored := StoredMessage{PacketID: msg.packetID, Share: msg.share}
+		if msg.frame != nil {
+			stored.Data = append([]byte(nil), msg.frame.Bytes()...)
+		}
+		state.Inflight = append(state.Inflight, stored)
+	}
+	for e := this.pending.Front(); e != nil; e = e.Next() {
+		msg := e.Value.(*inflightMsg)
+		state.Pending = append(state.Pending, StoredMessage{
+			Data:  append([]byte(nil), msg.frame.Bytes()...),
+			Share: msg.share,
+		})
+	}
+	for id := range this.received {
+		state.Received = append(state.Received, id)
+	}
+	return state
+}
+
+// restoreSession create the disconnected session from the state saved by the session store
+func restoreSession(state *SessionState) (*Session, error) {
+	sess := newSession(state.ID)
+	sess.version = state.Version
+	sess.expiry = state.Expiry
+	if !state.DisconnectedAt.IsZero() {
+		sess.disconnectedAt = state.DisconnectedAt
+	}
+
+	for _, stored := range state.Inflight {
+		msg := &inflightMsg{packetID: stored.PacketID, share: stored.Share}
+		if stored.Data != nil {
+			frame, err := message.LoadPublishFrame(stored.Data)
+			if err != nil {
+				sess.clear()
+				return nil, err
+			}
+			msg.frame = frame
+		}
+		sess.inflightIndex[msg.packetID] = sess.inflight.PushBack(msg)
+		sess.packetID = msg.packetID
+	}
+	for _, stored := range state.Pending {
+		frame, err := message.LoadPublishFrame(stored.Data)
+		if err != nil {
+			sess.clear()
+			return nil, err
+		}
+		sess.pending.PushBack(&inflightMsg{frame: frame, share: stored.Share})
+		sess.pendingBytes += frame.Len()
+	}
+	for _, id := range state.Received {
+		sess.received[id] = struct{}{}
+	}
+	return sess, nil
+}
+
+// setMaxInflight set the inflight window, it is at least 1 and at most 65535 as the packet identifier is 16 bits
+func (this *Session) setMaxInflight(n int) {
+	if n < 1 {
+		n = 1
+	} else if n > 65535 {
+		n = 65535
+	}
+
+	this.lock.Lock()
+	this.maxInflight = n
+	this.lock.Unlock()
+}
+
+// nextPacketID allocate the packet identifier of the outbound message, 0 is not allowed, the identifiers
+// still in flight are skipped [MQTT-2.3.1-2]. The window is smaller than 65535, so there is always a free one
+func (this *Session) nextPacketID() uint16 {
+	for {
+		this.packetID++
+		if this.packetID == 0 {
+			this.packetID = 1
+		}
+		if _, ok := this.inflightIndex[this.packetID]; !ok {
+			return this.packetID
+		}
+	}
+}
+
+// track allocate the packet identifier and keep the frame until it is acknowledged.
+// If the inflight window is full, or other messages are waiting, the frame is queued and 0 is returned,
+// it is sent by the service after an acknowledgement frees the window
+func (this *Session) track(frame *message.PublishFrame, share string) uint16 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.pending.Len() > 0 || this.inflight.Len() >= this.maxInflight {
+		this.enqueue(frame, share)
+		return 0
+	}
+	frame.Retain()
+	return this.addInflight(&inflightMsg{frame: frame, share: share})
+}
+
+// enqueue append the frame to the pending queue, the message is dropped according to the policy
+// if the queue is full. It is called with the session locked
+func (this *Session) enqueue(frame *message.PublishFrame, share string) {
+	limit := this.queueLimit
+	full := func() bool {
+		return (limit.Messages > 0 && this.pending.Len() >= limit.Messages) ||
+			(limit.Bytes > 0 && this.pendingBytes+frame.Len() > limit.Bytes)
+	}
+
+	for full() {
+		e := this.pending.Front()
+		if limit.Policy == DropNewest || e == nil {
+			this.dropped++
+			return
+		}
+		this.pending.Remove(e)
+		old := e.Value.(*inflightMsg).frame
+		this.pendingBytes -= old.Len()
+		old.Release()
+		this.dropped++
+	}
+
+	frame.Retain()
+	this.pending.PushBack(&inflightMsg{frame: frame, share: share})
+	this.pendingBytes += frame.Len()
+}
+
+// SetQueueLimit set the limits of the queued messages, the queue is not trimmed until the next message
+func (this *Session) SetQueueLimit(limit QueueLimit) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.queueLimit = limit
+}
+
+// Dropped the number of messages dropped because the queue is full
+func (this *Session) Dropped() uint64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.dropped
+}
+
+// addInflight allocate the packet id of the message and keep it in flight, it is called with the session locked
+func (this *Session) addInflight(msg *inflightMsg) uint16 {
+	msg.packetID = this.nextPacketID()
+	msg.sent = time.Now()
+	this.inflightIndex[msg.packetID] = this.inflight.PushBack(msg)
+	return msg.packetID
+}
+
+// follow queue the QoS 0 message behind the pending messages, so it does not overtake them,
+// return false if no message is pending, then it is sent at once
+func (this *Session) follow(frame *message.PublishFrame, share string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.pending.Len() == 0 {
+		return false
+	}
+	this.enqueue(frame, share)
+	return true
+}
+
+// dequeue move the next pending message into the inflight window if it is not full,
+// the QoS 0 message is sent without the window. The frame is retained until fn returns
+func (this *Session) dequeue(fn func(packetID uint16, frame *message.PublishFrame)) bool {
+	this.lock.Lock()
+	e := this.pending.Front()
+	if e == nil {
+		this.lock.Unlock()
+		return false
+	}
+	msg := e.Value.(*inflightMsg)
+	frame := msg.frame
+	qos := frame.Qos()
+	if qos > message.QosAtMostOnce && this.inflight.Len() >= this.maxInflight {
+		this.lock.Unlock()
+		return false
+	}
+	this.pending.Remove(e)
+	this.pendingBytes -= frame.Len()
+	var id uint16
+	if qos > message.QosAtMostOnce {
+		id = this.addInflight(msg)
+	}
+	frame.Retain()
+	this.lock.Unlock()
+
+	fn(id, frame)
+	frame.Release()
+	return true
+}
+
+// takeShared hand the messages of the shared subscriptions over to fn, the QoS 1 messages not acknowledged
+// and the pending messages, fn returns true if the message is delivered to another member, then it is
+// removed from the session. The QoS 2 messages in flight are kept, they must be completed by this client
+func (this *Session) takeShared(fn func(share string, frame *message.PublishFrame) bool) int {
+	this.lock.Lock()
+	var msgs []*inflightMsg
+	for _, l := range []*list.List{this.inflight, this.pending} {
+		for e := l.Front(); e != nil; e = e.Next() {
+			msg := e.Value.(*inflightMsg)
+			if msg.share != "" && msg.frame != nil && (l == this.pending || msg.frame.Qos() == message.QosAtLeastOnce) {
+				msg.frame.Retain()
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	this.lock.Unlock()
+
+	// fn publishes to the other sessions, so it is not called with this session locked
+	taken := make(map[*inflightMsg]bool)
+	for _, msg := range msgs {
+		if fn(msg.share, msg.frame) {
+			taken[msg] = true
+		}
+		msg.frame.Release()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, l := range []*list.List{this.inflight, this.pending} {
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			if msg := e.Value.(*inflightMsg); taken[msg] {
+				l.Remove(e)
+				if l == this.inflight {
+					delete(this.inflightIndex, msg.packetID)
+				} else {
+					this.pendingBytes -= msg.frame.Len()
+				}
+				msg.frame.Release()
+			}
+			e = next
+		}
+	}
+	return len(taken)
+}
+
+// pendingLen the number of messages waiting for the inflight window
+func (this *Session) pendingLen() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.pending.Len()
+}
+
+// acknowledge remove the message acknowledged by PUBACK, PUBCOMP, or PUBREC with a failure reason code.
+// Return false if it is unknown or the acknowledgement does not match the flow of the message: PUBACK ends
+// the QoS 1 message, PUBREC the QoS 2 message not received yet, and PUBCOMP the one released after PUBREC
+func (this *Session) acknowledge(packetID uint16, ack byte) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.inflightIndex[packetID]
+	if !ok {
+		return false
+	}
+	msg := e.Value.(*inflightMsg)
+	switch ack {
+	case message.PUBACK:
+		ok = msg.frame != nil && msg.frame.Qos() == message.QosAtLeastOnce
+	case message.PUBREC:
+		ok = msg.frame != nil && msg.frame.Qos() == message.QosExactlyOnce
+	case message.PUBCOMP:
+		ok = msg.frame == nil
+	default:
+		ok = false
+	}
+	if !ok {
+		return false
+	}
+
+	delete(this.inflightIndex, packetID)
+	this.inflight.Remove(e)
+	if msg.frame != nil {
+		msg.frame.Release()
+	}
+	return true
+}
+
+// release the QoS 2 message is received by the client (PUBREC), the message is not sent again,
+// PUBREL is sent instead until PUBCOMP is received. Return false if it is unknown or a QoS 1 message
+func (this *Session) release(packetID uint16) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.inflightIndex[packetID]
+	if !ok {
+		return false
+	}
+	msg := e.Value.(*inflightMsg)
+	if msg.frame != nil {
+		if msg.frame.Qos() != message.QosExactlyOnce {
+			return false
+		}
+		msg.frame.Release()
+		msg.frame = nil
+	}
+	msg.sent = time.Now()
+	this.inflight.MoveToBack(e)
+	return true
+}
+
+// receive record the packet identifier of the inbound QoS 2 message,
+// return false if it is a duplicate which must not be forwarded again
+func (this *Session) receive(packetID uint16) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.received[packetID]; ok {
+		return false
+	}
+	this.received[packetID] = struct{}{}
+	return true
+}
+
+// complete forget the packet identifier of the inbound QoS 2 message after PUBREL,
+// the identifier can be reused by the client for a new message. Return false if it is unknown
+func (this *Session) complete(packetID uint16) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.received[packetID]; !ok {
+		return false
+	}
+	delete(this.received, packetID)
+	return true
+}
+
+// redeliver call fn for the inflight messages which are sent before now-timeout, oldest first,
+// frame is nil for the QoS 2 messages waiting for PUBCOMP, PUBREL is sent again for them.
+// The frames are retained while fn is called, so an acknowledgement in the meantime does not release them
+func (this *Session) redeliver(timeout time.Duration, fn func(packetID uint16, frame *message.PublishFrame)) {
+	now := time.Now()
+	var msgs []inflightMsg
+
+	this.lock.Lock()
+	for e := this.inflight.Front(); e != nil; e = e.Next() {
+		msg := e.Value.(*inflightMsg)
+		if now.Sub(msg.sent) < timeout {
+			break
+		}
+		msg.sent = now
+		if msg.frame != nil {
+			msg.frame.Retain()
+		}
+		msgs = append(msgs, *msg)
+	}
+	// the redelivered messages are the newest sent now
+	for range msgs {
+		this.inflight.MoveToBack(this.inflight.Front())
+	}
+	this.lock.Unlock()
+
+	for _, msg := range msgs {
+		fn(msg.packetID, msg.frame)
+		if msg.frame != nil {
+			msg.frame.Release()
+		}
+	}
+}
+
+// inflightLen the number of unacknowledged messages
+func (this *Session) inflightLen() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.inflight.Len()
+}
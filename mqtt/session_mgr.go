@@ -1,23 +1,211 @@
 package mqtt
 
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrSessionNotFound there is no session of the client id
+var ErrSessionNotFound = errors.New("session not found")
+
+// the number of the locks which serialize the connections of the same client id
+const clientLockCount = 64
+
+// SessionManager keep the sessions by the client id, it is used by all the connection goroutines, so it is locked.
+// The owner of a session is the service attached to it
 type SessionManager struct {
 	Sessions map[string]*Session
+	lock     sync.Mutex
+
+	// the queue limit of the new sessions
+	queueLimit QueueLimit
+
+	// the persistent sessions are saved to the store, so they are restored after the broker restarts
+	store SessionStore
+
+	// the number of the expired sessions reclaimed by Reap
+	reclaimed uint64
+
+	// the connections of the same client id are established one by one, from the takeover
+	// of the previous connection until the new service is attached
+	clientLocks [clientLockCount]sync.Mutex
 }
 
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
-		Sessions: make(map[string]*Session),
+		Sessions:   make(map[string]*Session),
+		queueLimit: QueueLimit{Messages: DefaultMaxQueuedMessages},
+		store:      NewMemorySessionStore(),
 	}
 }
 
+// SetStore set the store of the persistent sessions, it is called before the sessions are restored
+func (this *SessionManager) SetStore(store SessionStore) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.store = store
+}
+
+// Save save the state of the persistent session with its subscriptions
+func (this *SessionManager) Save(sess *Session, subs map[string]byte) error {
+	return this.store.Save(sess.state(subs))
+}
+
+// Restore add the sessions saved in the store, fn is called for each of them to register its subscriptions
+func (this *SessionManager) Restore(fn func(sess *Session, subs map[string]byte)) error {
+	return this.store.Range(func(state *SessionState) error {
+		sess, err := restoreSession(state)
+		if err != nil {
+			return err
+		}
+
+		this.lock.Lock()
+		sess.queueLimit = this.queueLimit
+		this.Sessions[sess.id] = sess
+		this.lock.Unlock()
+
+		fn(sess, state.Subscriptions)
+		return nil
+	})
+}
+
+// Close close the session store
+func (this *SessionManager) Close() error {
+	return this.store.Close()
+}
+
+// SetQueueLimit set the queue limit of the sessions created after
+func (this *SessionManager) SetQueueLimit(limit QueueLimit) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.queueLimit = limit
+}
+
+// New create the session and add it, the existing session of the id is replaced
 func (this *SessionManager) New(id string) (*Session, error) {
-	return &Session{}, nil
+	sess := newSession(id)
+
+	this.lock.Lock()
+	sess.queueLimit = this.queueLimit
+	this.Sessions[id] = sess
+	this.lock.Unlock()
+	return sess, nil
 }
 
 func (this *SessionManager) Add(id string, sess *Session) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
 	this.Sessions[id] = sess
 }
 
+// Get return ErrSessionNotFound if there is no session of the id
 func (this *SessionManager) Get(id string) (*Session, error) {
-	return this.Sessions[id], nil
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	sess, ok := this.Sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+// Remove remove the session only if it is still the one kept for the id,
+// so a closing connection does not remove the session created by a new connection
+func (this *SessionManager) Remove(id string, sess *Session) bool {
+	this.lock.Lock()
+	if this.Sessions[id] != sess {
+		this.lock.Unlock()
+		return false
+	}
+	delete(this.Sessions, id)
+	this.lock.Unlock()
+
+	if err := this.store.Delete(id); err != nil {
+		glog.Errorf("(%s) failed to delete the session from the store: %v", id, err)
+	}
+	return true
+}
+
+// List return all the sessions
+func (this *SessionManager) List() []*Session {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	sessions := make([]*Session, 0, len(this.Sessions))
+	for _, sess := range this.Sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// Len the number of the sessions
+func (this *SessionManager) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.Sessions)
+}
+
+// LockClient serialize the establishment of the connections of the client id, call the returned function to unlock
+func (this *SessionManager) LockClient(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	l := &this.clientLocks[h.Sum32()%clientLockCount]
+	l.Lock()
+	return l.Unlock
+}
+
+// Owner return the service which owns the session of the client id, nil if the client is not connected
+func (this *SessionManager) Owner(id string) *Service {
+	sess, err := this.Get(id)
+	if err != nil {
+		return nil
+	}
+	return sess.current()
+}
+
+// Takeover close the connection which owns the session of the client id [MQTT-3.1.4-2],
+// it returns after the old service is closed. It is called with the client locked
+func (this *SessionManager) Takeover(id string) bool {
+	owner := this.Owner(id)
+	if owner == nil {
+		return false
+	}
+	owner.takeover()
+	return true
+}
+
+// Reap remove the sessions whose client has been disconnected longer than the expiry interval,
+// fn is called for each of them to remove its subscriptions. It returns the number of the sessions removed
+func (this *SessionManager) Reap(now time.Time, fn func(id string, sess *Session)) int {
+	this.lock.Lock()
+	candidates := make(map[string]*Session)
+	for id, sess := range this.Sessions {
+		if sess.expired(now) {
+			candidates[id] = sess
+		}
+	}
+	this.lock.Unlock()
+
+	n := 0
+	for id, sess := range candidates {
+		// the client may be reconnecting, check again with the client locked
+		unlock := this.LockClient(id)
+		if sess.expired(now) && this.Remove(id, sess) {
+			fn(id, sess)
+			n++
+		}
+		unlock()
+	}
+
+	atomic.AddUint64(&this.reclaimed, uint64(n))
+	return n
+}
+
+// Reclaimed the number of the expired sessions removed by Reap
+func (this *SessionManager) Reclaimed() uint64 {
+	return atomic.LoadUint64(&this.reclaimed)
 }
@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"sync"
+	"time"
+)
+
+// StoredMessage an outbound message of the session, Data is the encoded PUBLISH packet,
+// it is nil when PUBREC of the QoS 2 message is received and PUBREL is waiting for PUBCOMP.
+// Share is the shared subscription the message is delivered for
+type StoredMessage struct {
+	PacketID uint16
+	Data     []byte
+	Share    string
+}
+
+// SessionState the state of a persistent session saved by the session store,
+// so the session is restored after the broker restarts
+type SessionState struct {
+	ID             string
+	Version        byte
+	Expiry         time.Duration
+	DisconnectedAt time.Time
+
+	// the topic filters with the granted qos and the MQTT 5.0 subscription options
+	Subscriptions map[string]byte
+
+	// the unacknowledged messages in the order they are sent, and the messages waiting for the inflight window
+	Inflight []StoredMessage
+	Pending  []StoredMessage
+
+	// the packet identifiers of the inbound QoS 2 messages not released by PUBREL
+	Received []uint16
+}
+
+// SessionStore save the persistent sessions, the saved state replaces the previous state of the session.
+// The state must not be modified after it is saved or returned by the store.
+// The session is saved on SUBSCRIBE and UNSUBSCRIBE, when its connection is closed and when the broker
+// is closed, not for every message, as the whole state is saved each time. So if the broker crashes,
+// the messages queued since the last save are lost, and the ones acknowledged since are redelivered
+type SessionStore interface {
+	Save(state *SessionState) error
+
+	// Load return ErrSessionNotFound if the session is not saved
+	Load(id string) (*SessionState, error)
+
+	Delete(id string) error
+
+	// Range call fn for each saved session until fn returns an error
+	Range(fn func(state *SessionState) error) error
+
+	Close() error
+}
+
+// MemorySessionStore keep the sessions in memory, they are lost when the broker exits
+type MemorySessionStore struct {
+	states map[string]*SessionState
+	lock   sync.RWMutex
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		states: make(map[string]*SessionState),
+	}
+}
+
+func (store *MemorySessionStore) Save(state *SessionState) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.states[state.ID] = state
+	return nil
+}
+
+func (store *MemorySessionStore) Load(id string) (*SessionState, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	state, ok := store.states[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return state, nil
+}
+
+func (store *MemorySessionStore) Delete(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.states, id)
+	return nil
+}
+
+func (store *MemorySessionStore) Range(fn func(state *SessionState) error) error {
+	store.lock.RLock()
+	states := make([]*SessionState, 0, len(store.states))
+	for _, state := range store.states {
+		states = append(states, state)
+	}
+	store.lock.RUnlock()
+
+	for _, state := range states {
+		if err := fn(state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *MemorySessionStore) Close() error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// FileSessionStore keep the sessions in an append-only file, the file is rewritten
+// with the latest state of each session when it is opened
+type FileSessionStore struct {
+	log  *appendLog
+	lock sync.Mutex
+}
+
+// NewFileSessionStore open the store of the file, the file is created if it does not exist
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	log, err := openAppendLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{log: log}, nil
+}
+
+func (store *FileSessionStore) Save(state *SessionState) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.log.put(state.ID, state)
+}
+
+func (store *FileSessionStore) Load(id string) (*SessionState, error) {
+	store.lock.Lock()
+	data, ok := store.log.records[id]
+	store.lock.Unlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	var state SessionState
+	if err := decodeValue(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (store *FileSessionStore) Delete(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.log.delete(id)
+}
+
+func (store *FileSessionStore) Range(fn func(state *SessionState) error) error {
+	store.lock.Lock()
+	records := store.log.list()
+	store.lock.Unlock()
+
+	for _, data := range records {
+		var state SessionState
+		if err := decodeValue(data, &state); err != nil {
+			return err
+		}
+		if err := fn(&state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *FileSessionStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.log.close()
+}
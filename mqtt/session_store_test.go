@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	state := &SessionState{
+		ID:             "c1",
+		Version:        4,
+		Expiry:         time.Minute,
+		DisconnectedAt: time.Unix(1000, 0),
+		Subscriptions:  map[string]byte{"sport/#": 1},
+		Inflight:       []StoredMessage{{PacketID: 1, Data: []byte{0x32, 0}}, {PacketID: 2}},
+		Pending:        []StoredMessage{{Data: []byte{0x32, 0}, Share: "$share/g/a"}},
+		Received:       []uint16{3},
+	}
+	assert.NoError(t, store.Save(state))
+	assert.NoError(t, store.Save(&SessionState{ID: "c2"}))
+
+	loaded, err := store.Load("c1")
+	assert.NoError(t, err)
+	assert.Equal(t, state.Subscriptions, loaded.Subscriptions)
+	assert.Equal(t, state.Inflight, loaded.Inflight)
+	assert.True(t, state.DisconnectedAt.Equal(loaded.DisconnectedAt))
+
+	assert.NoError(t, store.Delete("c2"))
+	assert.NoError(t, store.Delete("c3"), "deleting a missing session is not an error")
+	_, err = store.Load("c2")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	var ids []string
+	store.Range(func(state *SessionState) error {
+		ids = append(ids, state.ID)
+		return nil
+	})
+	assert.Equal(t, []string{"c1"}, ids)
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+}
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.db")
+
+	store, err := NewFileSessionStore(path)
+	assert.NoError(t, err)
+	testSessionStore(t, store)
+	assert.NoError(t, store.Close())
+	assert.Equal(t, ErrStoreClosed, store.Save(&SessionState{ID: "c2"}))
+
+	// a record partly written by a crash is discarded
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	store, err = NewFileSessionStore(path)
+	assert.NoError(t, err, "the broken record should be discarded")
+	state, err := store.Load("c1")
+	assert.NoError(t, err, "the session should be kept after reopening")
+	assert.Equal(t, map[string]byte{"sport/#": 1}, state.Subscriptions)
+	_, err = store.Load("c2")
+	assert.Equal(t, ErrSessionNotFound, err, "the deleted session should not be restored")
+
+	// the record partly written by a failed put is cut off, so the following ones are kept
+	store.log.file.Write([]byte{0, 0, 0, 100, 1, 2})
+	store.log.undo()
+	assert.NoError(t, store.Save(&SessionState{ID: "c3"}))
+	store.Close()
+	store, err = NewFileSessionStore(path)
+	assert.NoError(t, err)
+	_, err = store.Load("c3")
+	assert.NoError(t, err, "the record after the failed put should be kept")
+
+	for i := 0; i <= compactMinGarbage; i++ {
+		store.Save(state)
+	}
+	assert.Equal(t, 0, store.log.garbage, "the replaced records should be compacted")
+	store.Close()
+
+	store, err = NewFileSessionStore(path)
+	assert.NoError(t, err)
+	_, err = store.Load("c1")
+	assert.NoError(t, err)
+
+	// the store fails if the partial record can not be cut off
+	store.log.file.Close()
+	assert.Error(t, store.Save(state))
+	assert.Error(t, store.log.err)
+	assert.Equal(t, store.log.err, store.Save(state))
+}
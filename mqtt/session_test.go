@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFrame(t *testing.T, qos byte) *message.PublishFrame {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("sport/tennis"))
+	msg.SetQos(qos)
+	msg.SetPacketID(1)
+	msg.SetPayload([]byte("send me home"))
+	frame, err := message.NewPublishFrame(msg)
+	assert.NoError(t, err, "should not have error in encoding")
+	return frame
+}
+
+func TestSessionInflight(t *testing.T) {
+	session := newSession("c1")
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+
+	id1 := session.track(frame, "")
+	id2 := session.track(frame, "")
+	assert.NotEqual(t, id1, id2, "packet ids should be different")
+	assert.Equal(t, 2, session.inflightLen())
+
+	var redelivered []uint16
+	session.redeliver(time.Hour, func(id uint16, frame *message.PublishFrame) {
+		redelivered = append(redelivered, id)
+	})
+	assert.Empty(t, redelivered, "messages should not be redelivered before timeout")
+
+	session.redeliver(0, func(id uint16, frame *message.PublishFrame) {
+		redelivered = append(redelivered, id)
+	})
+	assert.Equal(t, []uint16{id1, id2}, redelivered, "messages should be redelivered in order")
+
+	assert.False(t, session.acknowledge(id1, message.PUBCOMP), "PUBCOMP of a QoS 1 message")
+	assert.False(t, session.release(id1), "PUBREC of a QoS 1 message")
+	assert.True(t, session.acknowledge(id1, message.PUBACK))
+	assert.False(t, session.acknowledge(id1, message.PUBACK), "message should be acknowledged once")
+	assert.Equal(t, 1, session.inflightLen())
+	assert.True(t, session.acknowledge(id2, message.PUBACK))
+	assert.NotNil(t, frame.Bytes(), "frame should be kept by the creator")
+}
+
+func TestSessionPacketID(t *testing.T) {
+	session := newSession("c1")
+	session.packetID = 0xffff
+	assert.Equal(t, uint16(1), session.nextPacketID(), "packet id 0 should be skipped")
+}
+
+func TestSessionQos2(t *testing.T) {
+	session := newSession("c1")
+	frame := newTestFrame(t, message.QosExactlyOnce)
+	defer frame.Release()
+
+	id := session.track(frame, "")
+	assert.False(t, session.acknowledge(id, message.PUBACK), "PUBACK of a QoS 2 message")
+	assert.False(t, session.acknowledge(id, message.PUBCOMP), "PUBCOMP before PUBREC")
+	assert.Equal(t, 1, session.inflightLen())
+	assert.True(t, session.release(id), "PUBREC of the inflight message")
+
+	var frames []*message.PublishFrame
+	session.redeliver(0, func(packetID uint16, frame *message.PublishFrame) {
+		assert.Equal(t, id, packetID)
+		frames = append(frames, frame)
+	})
+	assert.Equal(t, []*message.PublishFrame{nil}, frames, "PUBREL should be sent again after PUBREC")
+
+	assert.True(t, session.acknowledge(id, message.PUBCOMP), "PUBCOMP of the released message")
+	assert.Equal(t, 0, session.inflightLen())
+	assert.False(t, session.release(id))
+
+	assert.True(t, session.receive(7), "first inbound message should be forwarded")
+	assert.False(t, session.receive(7), "duplicate should not be forwarded")
+	assert.True(t, session.complete(7))
+	assert.False(t, session.complete(7))
+	assert.True(t, session.receive(7), "packet id can be reused after PUBREL")
+}
+
+func TestSessionInflightWindow(t *testing.T) {
+	session := newSession("c1")
+	session.setMaxInflight(2)
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+
+	id1 := session.track(frame, "")
+	id2 := session.track(frame, "")
+	assert.Equal(t, uint16(0), session.track(frame, ""), "message should be queued when the window is full")
+	assert.Equal(t, 2, session.inflightLen())
+	assert.Equal(t, 1, session.pendingLen())
+
+	send := func(id uint16, frame *message.PublishFrame) {}
+	assert.False(t, session.dequeue(send), "window is still full")
+
+	session.acknowledge(id1, message.PUBACK)
+	var id3 uint16
+	assert.True(t, session.dequeue(func(id uint16, frame *message.PublishFrame) { id3 = id }))
+	assert.NotEqual(t, id2, id3, "packet id in flight should not be reused")
+	assert.Equal(t, 0, session.pendingLen())
+	assert.Equal(t, 2, session.inflightLen())
+
+	// the packet ids in flight are skipped after wrapping
+	session.packetID = id2 - 1
+	session.acknowledge(id3, message.PUBACK)
+	id4 := session.track(frame, "")
+	assert.NotEqual(t, id2, id4, "packet id in flight should not be reused")
+}
+
+func TestSessionOfflineQueue(t *testing.T) {
+	session := newSession("c1")
+	session.SetQueueLimit(QueueLimit{Messages: 2, Policy: DropNewest})
+
+	var frames []*message.PublishFrame
+	for i := 0; i < 3; i++ {
+		frame := newTestFrame(t, message.QosAtLeastOnce)
+		defer frame.Release()
+		frames = append(frames, frame)
+		session.publish(frame, "")
+	}
+	qos0 := newTestFrame(t, message.QosAtMostOnce)
+	defer qos0.Release()
+	session.publish(qos0, "")
+
+	assert.Equal(t, 2, session.pendingLen(), "messages should be queued while offline")
+	assert.Equal(t, uint64(1), session.Dropped(), "the newest message should be dropped")
+
+	var sent []*message.PublishFrame
+	for session.dequeue(func(id uint16, frame *message.PublishFrame) { sent = append(sent, frame) }) {
+	}
+	assert.Equal(t, frames[:2], sent, "queued messages should be delivered in order")
+}
+
+func TestSessionQueueDropOldest(t *testing.T) {
+	session := newSession("c1")
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+	session.SetQueueLimit(QueueLimit{Bytes: 2 * frame.Len(), Policy: DropOldest})
+
+	var frames []*message.PublishFrame
+	for i := 0; i < 3; i++ {
+		frame := newTestFrame(t, message.QosExactlyOnce)
+		defer frame.Release()
+		frames = append(frames, frame)
+		session.publish(frame, "")
+	}
+	assert.Equal(t, 2, session.pendingLen(), "queue should be limited by bytes")
+	assert.Equal(t, uint64(1), session.Dropped())
+
+	var sent []*message.PublishFrame
+	for session.dequeue(func(id uint16, frame *message.PublishFrame) { sent = append(sent, frame) }) {
+	}
+	assert.Equal(t, frames[1:], sent, "the oldest message should be dropped")
+
+	session.cleanSession = true
+	session.publish(frame, "")
+	assert.Equal(t, 0, session.pendingLen(), "clean session does not queue messages")
+}
+
+func TestSessionExpiry(t *testing.T) {
+	session := newSession("c1")
+	session.setExpiry(time.Minute)
+	assert.False(t, session.IsCleanSession())
+	assert.False(t, session.expired(time.Now()), "session is not expired before it is detached")
+
+	session.detach(nil)
+	now := session.disconnectedAt
+	assert.False(t, session.expired(now.Add(time.Second)))
+	assert.True(t, session.expired(now.Add(time.Minute)), "session should expire after the interval")
+
+	session.setExpiry(-1)
+	assert.False(t, session.expired(now.Add(time.Hour)), "session should never expire")
+
+	session.setExpiry(0)
+	assert.True(t, session.IsCleanSession(), "zero expiry ends the session with the connection")
+}
+
+func TestSessionStateConnected(t *testing.T) {
+	session := newSession("c1")
+	session.setExpiry(time.Minute)
+	session.disconnectedAt = time.Now().Add(-time.Hour)
+	session.attach(&Service{version: message.Version311})
+
+	state := session.state(nil)
+	assert.WithinDuration(t, time.Now(), state.DisconnectedAt, time.Second,
+		"the connected session should be saved as disconnected now")
+
+	restored, err := restoreSession(state)
+	assert.NoError(t, err)
+	assert.False(t, restored.expired(time.Now()), "the restored session should not expire at once")
+}
+
+func TestSessionConvertVersion(t *testing.T) {
+	session := newSession("c1")
+	session.Init(newTestConnMessage("c1", false))
+	session.setMaxInflight(1)
+	frame := newTestFrame(t, message.QosAtLeastOnce)
+	defer frame.Release()
+	id := session.track(frame, "")
+	session.track(frame, "")
+	assert.Equal(t, 1, session.pendingLen())
+
+	// the persistent session reconnects with MQTT 5.0
+	req := newTestConnMessage("c1", false)
+	req.SetVersion(message.Version5)
+	session.Update(req)
+
+	var frames [][]byte
+	session.redeliver(0, func(packetID uint16, f *message.PublishFrame) {
+		assert.Equal(t, id, packetID)
+		frames = append(frames, append([]byte(nil), f.Bytes()...))
+	})
+	session.acknowledge(id, message.PUBACK)
+	session.dequeue(func(packetID uint16, f *message.PublishFrame) {
+		frames = append(frames, append([]byte(nil), f.Bytes()...))
+	})
+	assert.Len(t, frames, 2)
+	for _, buf := range frames {
+		msg, err := message.NewVersionMessage(buf, message.Version5)
+		if assert.NoError(t, err, "the stored message should be encoded for MQTT 5.0") {
+			assert.Equal(t, []byte("send me home"), msg.(*message.PublishMessage).Payload())
+		}
+	}
+}
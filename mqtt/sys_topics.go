@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+)
+
+// the prefix of the status topics of the broker, the names follow mosquitto,
+// so the dashboards reading them work against the broker too
+const sysBrokerPrefix = "$SYS/broker/"
+
+// Stats the traffic counters of the broker, a message is one MQTT packet of any type
+type Stats struct {
+	start time.Time
+
+	messagesReceived uint64
+	messagesSent     uint64
+	bytesReceived    uint64
+	bytesSent        uint64
+
+	// the PUBLISH messages dropped because the client is not authorized
+	publishDenied uint64
+}
+
+func NewStats() *Stats {
+	return &Stats{start: time.Now()}
+}
+
+// Uptime the time since the broker is started
+func (stats *Stats) Uptime(now time.Time) time.Duration {
+	return now.Sub(stats.start)
+}
+
+func (stats *Stats) MessagesReceived() uint64 {
+	return atomic.LoadUint64(&stats.messagesReceived)
+}
+
+func (stats *Stats) MessagesSent() uint64 {
+	return atomic.LoadUint64(&stats.messagesSent)
+}
+
+func (stats *Stats) BytesReceived() uint64 {
+	return atomic.LoadUint64(&stats.bytesReceived)
+}
+
+func (stats *Stats) BytesSent() uint64 {
+	return atomic.LoadUint64(&stats.bytesSent)
+}
+
+func (stats *Stats) PublishDenied() uint64 {
+	return atomic.LoadUint64(&stats.publishDenied)
+}
+
+// received count one packet read from a client
+func (stats *Stats) received() {
+	atomic.AddUint64(&stats.messagesReceived, 1)
+}
+
+// denied count one PUBLISH dropped by the authorizer
+func (stats *Stats) denied() {
+	atomic.AddUint64(&stats.publishDenied, 1)
+}
+
+// conn count the bytes of the connection, every packet is written in one call, so each write is one message
+func (stats *Stats) conn(conn net.Conn) net.Conn {
+	return &statsConn{Conn: conn, stats: stats}
+}
+
+type statsConn struct {
+	net.Conn
+	stats *Stats
+}
+
+func (conn *statsConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddUint64(&conn.stats.bytesReceived, uint64(n))
+	return n, err
+}
+
+func (conn *statsConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddUint64(&conn.stats.bytesSent, uint64(n))
+	if err == nil {
+		atomic.AddUint64(&conn.stats.messagesSent, 1)
+	}
+	return n, err
+}
+
+// sysTopic one status topic with its value
+type sysTopic struct {
+	topic string
+	value string
+}
+
+// sysTopics collect the status of the broker
+func (serv *Server) sysTopics(now time.Time) []sysTopic {
+	sessions := serv.sessMgr.List()
+	connected, inflight := 0, 0
+	for _, sess := range sessions {
+		if sess.connected() {
+			connected++
+		}
+		inflight += sess.inflightLen()
+	}
+
+	retained := 0
+	if serv.retained != nil {
+		retained = serv.retained.Len()
+	}
+
+	count := func(n uint64) string {
+		return strconv.FormatUint(n, 10)
+	}
+	return []sysTopic{
+		{"version", "scalemqtt version " + Version},
+		{"uptime", fmt.Sprintf("%d seconds", int64(serv.stats.Uptime(now)/time.Second))},
+		{"clients/connected", strconv.Itoa(connected)},
+		{"clients/disconnected", strconv.Itoa(len(sessions) - connected)},
+		{"clients/total", strconv.Itoa(len(sessions))},
+		{"clients/expired", count(serv.sessMgr.Reclaimed())},
+		{"messages/received", count(serv.stats.MessagesReceived())},
+		{"messages/sent", count(serv.stats.MessagesSent())},
+		{"messages/inflight", strconv.Itoa(inflight)},
+		{"bytes/received", count(serv.stats.BytesReceived())},
+		{"bytes/sent", count(serv.stats.BytesSent())},
+		{"publish/messages/denied", count(serv.stats.PublishDenied())},
+		{"subscriptions/count", strconv.Itoa(serv.topicMgr.Count())},
+		{"retained messages/count", strconv.Itoa(retained)},
+	}
+}
+
+// publishSysTopics publish the status of the broker as retained QoS 0 messages,
+// so a new subscriber gets the latest values at once
+func (serv *Server) publishSysTopics(now time.Time) {
+	for _, t := range serv.sysTopics(now) {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(sysBrokerPrefix + t.topic))
+		msg.SetPayload([]byte(t.value))
+		msg.SetRetain(true)
+		if err := deliver(serv.topicMgr, serv.retained, msg, ""); err != nil {
+			glog.Errorf("failed to publish %s: %v", msg.Topic(), err)
+		}
+	}
+}
+
+// loopSysTopics publish the status of the broker until done is closed
+func (serv *Server) loopSysTopics(c <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-c:
+			serv.publishSysTopics(now)
+		}
+	}
+}
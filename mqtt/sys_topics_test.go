@@ -0,0 +1,65 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func sysValue(t *testing.T, serv *Server, topic string) string {
+	msgs := serv.retained.Match(sysBrokerPrefix + topic)
+	if !assert.Len(t, msgs, 1, "%s should be retained", topic) {
+		return ""
+	}
+	return string(msgs[0].Payload)
+}
+
+func TestServerSysTopics(t *testing.T) {
+	serv, err := NewServer(&ServerConfig{Timeout: 1})
+	assert.NoError(t, err)
+
+	client, _, ack := connectTestClient(t, serv, newTestConnMessage("c1", false))
+	defer client.Close()
+	assert.Equal(t, message.ConnAccepted, ack.ReturnCode())
+	owner := waitOwner(serv, "c1", nil)
+	assert.NotNil(t, owner)
+
+	serv.topicMgr.Register("sport/#", "c1", message.QosAtMostOnce, owner.session)
+	serv.topicMgr.Register("finance", "c1", message.QosAtMostOnce, owner.session)
+	sub := &chanSub{frames: make(chan []byte, 20)}
+	serv.topicMgr.Register("$SYS/broker/clients/+", "c2", message.QosAtMostOnce, sub)
+
+	serv.publishSysTopics(serv.stats.start.Add(90 * time.Second))
+	assert.Equal(t, "90 seconds", sysValue(t, serv, "uptime"))
+	assert.Equal(t, "scalemqtt version "+Version, sysValue(t, serv, "version"))
+	assert.Equal(t, "1", sysValue(t, serv, "clients/connected"))
+	assert.Equal(t, "0", sysValue(t, serv, "clients/disconnected"))
+	assert.Equal(t, "1", sysValue(t, serv, "clients/total"))
+	assert.Equal(t, "3", sysValue(t, serv, "subscriptions/count"))
+	assert.Equal(t, "1", sysValue(t, serv, "messages/received"), "CONNECT should be counted")
+	assert.Equal(t, "1", sysValue(t, serv, "messages/sent"), "CONNACK should be counted")
+	assert.Equal(t, "4", sysValue(t, serv, "bytes/sent"))
+	assert.Equal(t, "0", sysValue(t, serv, "messages/inflight"))
+
+	// the retained status topics are counted on the next update
+	assert.Equal(t, "0", sysValue(t, serv, "retained messages/count"))
+	serv.publishSysTopics(time.Now())
+	assert.Equal(t, "14", sysValue(t, serv, "retained messages/count"))
+	assert.Len(t, serv.retained.Match("#"), 0, "the $SYS topics should not match #")
+
+	// the subscribers get the updates
+	for i := 0; i < 8; i++ {
+		select {
+		case buf := <-sub.frames:
+			msg := message.NewPublishMessage()
+			_, err := msg.Decode(buf)
+			assert.NoError(t, err)
+			assert.Contains(t, string(msg.Topic()), "$SYS/broker/clients/")
+			assert.False(t, msg.IsRetain(), "the retain flag is 0 for the established subscription")
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("the status should be published to the subscribers")
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package mqtt
 
 import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 
-	"github.com/surgemq/message"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 )
 
 // The topic level separator is used to introduce structure into the Topic Name. If present,
@@ -62,72 +66,503 @@ const (
 	_WC = "#+"
 )
 
+// ShareStrategy decide which member of a shared subscription receives the message
+type ShareStrategy int
+
+const (
+	// ShareRoundRobin the members receive the messages in turn
+	ShareRoundRobin ShareStrategy = iota
+
+	// ShareRandom a random member receives the message
+	ShareRandom
+
+	// ShareSticky the messages of the same publisher go to the same member while the members do not change
+	ShareSticky
+
+	// ShareLeastInflight the member with the fewest unacknowledged messages receives the message
+	ShareLeastInflight
+)
+
+// ParseShareStrategy parse the strategy name of the config, "round-robin", "random", "sticky" or "least-inflight"
+func ParseShareStrategy(name string) (ShareStrategy, error) {
+	switch name {
+	case "", "round-robin":
+		return ShareRoundRobin, nil
+	case "random":
+		return ShareRandom, nil
+	case "sticky":
+		return ShareSticky, nil
+	case "least-inflight":
+		return ShareLeastInflight, nil
+	}
+	return ShareRoundRobin, fmt.Errorf("unknown share strategy %q", name)
+}
+
+// shareMember the state of the subscriber used to choose the member of a shared subscription,
+// the subscribers not implementing it are treated as connected with nothing in flight
+type shareMember interface {
+	connected() bool
+	inflightLen() int
+}
+
+// shareGroup the members of the shared subscription "$share/{ShareName}/{filter}",
+// each message matching the filter is delivered to one of them
+type shareGroup struct {
+	topic   string
+	ids     []string
+	members map[string]Subscriber
+
+	// the counter of the round robin strategy
+	next uint32
+}
+
+func newShareGroup(topic string) *shareGroup {
+	return &shareGroup{topic: topic, members: make(map[string]Subscriber)}
+}
+
+func (group *shareGroup) add(sessionId string, sub Subscriber) {
+	if _, ok := group.members[sessionId]; !ok {
+		group.ids = append(group.ids, sessionId)
+	}
+	group.members[sessionId] = sub
+}
+
+func (group *shareGroup) remove(sessionId string) bool {
+	if _, ok := group.members[sessionId]; !ok {
+		return false
+	}
+	delete(group.members, sessionId)
+	for i, id := range group.ids {
+		if id == sessionId {
+			group.ids = append(group.ids[:i], group.ids[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// pick choose the member except the excluded session, the connected members are preferred,
+// the message goes to a disconnected persistent session only if no member is connected
+func (group *shareGroup) pick(strategy ShareStrategy, publisher string, exclude string) (Subscriber, bool) {
+	candidates := make([]Subscriber, 0, len(group.ids))
+	for _, connected := range []bool{true, false} {
+		for _, id := range group.ids {
+			sub := group.members[id]
+			if id == exclude {
+				continue
+			}
+			if m, ok := sub.Sub.(shareMember); !connected || !ok || m.connected() {
+				candidates = append(candidates, sub)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return Subscriber{}, false
+	}
+
+	var i int
+	switch strategy {
+	case ShareRandom:
+		i = rand.Intn(len(candidates))
+	case ShareSticky:
+		h := fnv.New32a()
+		h.Write([]byte(publisher))
+		i = int(h.Sum32() % uint32(len(candidates)))
+	case ShareLeastInflight:
+		least := -1
+		for j, sub := range candidates {
+			n := 0
+			if m, ok := sub.Sub.(shareMember); ok {
+				n = m.inflightLen()
+			}
+			if least < 0 || n < least {
+				i, least = j, n
+			}
+		}
+	default:
+		i = int((atomic.AddUint32(&group.next, 1) - 1) % uint32(len(candidates)))
+	}
+
+	sub := candidates[i]
+	sub.Share = group.topic
+	return sub, true
+}
+
+// Node one level of the topic filter tree, the subscribers whose filter ends at this level
+// are kept in subs, keyed by the session id, and the shared subscriptions in shared, keyed by the share name
 type Node struct {
 	name     string
 	parent   *Node
-	children []*Node
+	children map[string]*Node
+	subs     map[string]Subscriber
+	shared   map[string]*shareGroup
+}
+
+func newNode(name string, parent *Node) *Node {
+	return &Node{
+		name:     name,
+		parent:   parent,
+		children: make(map[string]*Node),
+		subs:     make(map[string]Subscriber),
+		shared:   make(map[string]*shareGroup),
+	}
+}
+
+func (node *Node) empty() bool {
+	return len(node.children) == 0 && len(node.subs) == 0 && len(node.shared) == 0
 }
 
+// splitShared return the share name and the topic filter of the subscription, the name is empty if it is not shared
+func splitShared(topic string) (string, string) {
+	if name, filter, ok := message.SplitShared([]byte(topic)); ok {
+		return string(name), string(filter)
+	}
+	return "", topic
+}
+
+// Tree the topic filter tree, a topic name is matched level by level,
+// so the cost depends on the depth of the topic, not on the number of subscriptions
 type Tree struct {
-	nodes []*Node
+	root *Node
+}
+
+func newTree() *Tree {
+	return &Tree{root: newNode("", nil)}
+}
+
+// insert the subscription, the shared subscription is added to the group of the filter
+func (tree *Tree) insert(topic string, sessionId string, sub Subscriber) {
+	name, filter := splitShared(topic)
+	node := tree.root
+	for _, level := range strings.Split(filter, SEP) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newNode(level, node)
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	if name == "" {
+		node.subs[sessionId] = sub
+		return
+	}
+	group, ok := node.shared[name]
+	if !ok {
+		group = newShareGroup(topic)
+		node.shared[name] = group
+	}
+	group.add(sessionId, sub)
+}
+
+// find the node of the topic filter, nil if there is no subscription of it
+func (tree *Tree) find(filter string) *Node {
+	node := tree.root
+	for _, level := range strings.Split(filter, SEP) {
+		child, ok := node.children[level]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// remove the subscription, the levels which are not used any more are removed too
+func (tree *Tree) remove(topic string, sessionId string) bool {
+	name, filter := splitShared(topic)
+	node := tree.find(filter)
+	if node == nil {
+		return false
+	}
+
+	if name == "" {
+		if _, ok := node.subs[sessionId]; !ok {
+			return false
+		}
+		delete(node.subs, sessionId)
+	} else {
+		group, ok := node.shared[name]
+		if !ok || !group.remove(sessionId) {
+			return false
+		}
+		if len(group.members) == 0 {
+			delete(node.shared, name)
+		}
+	}
+
+	for node.parent != nil && node.empty() {
+		delete(node.parent.children, node.name)
+		node = node.parent
+	}
+	return true
+}
+
+// matchResult the subscriptions matching a topic name, a session with several matching
+// subscriptions is kept once with the maximum qos of them, the No Local subscriptions
+// of the publisher are not matched
+type matchResult struct {
+	subs      map[string]Subscriber
+	groups    []*shareGroup
+	publisher string
+}
+
+// match collect the subscriptions matching the topic name published by the client
+func (tree *Tree) match(topic string, publisher string) *matchResult {
+	levels := strings.Split(topic, SEP)
+	res := &matchResult{subs: make(map[string]Subscriber), publisher: publisher}
+
+	// The Server MUST NOT match Topic Filters starting with a wildcard character (# or +)
+	// with Topic Names beginning with a $ character [MQTT-4.7.2-1]
+	sys := strings.HasPrefix(topic, SYS)
+	tree.root.match(levels, 0, sys, res)
+	return res
+}
+
+func (node *Node) match(levels []string, i int, sys bool, res *matchResult) {
+	wildcard := i > 0 || !sys
+
+	if i == len(levels) {
+		node.visit(res)
+		// “sport/#” also matches the singular “sport”, since # includes the parent level
+		if child, ok := node.children[MWC]; ok {
+			child.visit(res)
+		}
+		return
+	}
+
+	if wildcard {
+		if child, ok := node.children[MWC]; ok {
+			child.visit(res)
+		}
+		if child, ok := node.children[SWC]; ok {
+			child.match(levels, i+1, sys, res)
+		}
+	}
+	if child, ok := node.children[levels[i]]; ok {
+		child.match(levels, i+1, sys, res)
+	}
 }
 
+func (node *Node) visit(res *matchResult) {
+	for id, sub := range node.subs {
+		if sub.NoLocal && id == res.publisher {
+			continue
+		}
+		old, ok := res.subs[id]
+		if !ok {
+			res.subs[id] = sub
+			continue
+		}
+		// the retain flag is kept if any of the subscriptions asks for it
+		if old.Qos < sub.Qos {
+			old.Qos = sub.Qos
+		}
+		old.RetainAsPublished = old.RetainAsPublished || sub.RetainAsPublished
+		res.subs[id] = old
+	}
+	for _, group := range node.shared {
+		res.groups = append(res.groups, group)
+	}
+}
+
+// Sub the subscriber of the topics, the encoded PUBLISH frame is shared by the subscribers
+// with the same protocol version, publish must not keep the frame after it returns.
+// share is the shared subscription the message is delivered for, empty for the other subscriptions
 type Sub interface {
-	publish(*message.PublishMessage) error
+	protocolVersion() byte
+	publish(frame *message.PublishFrame, share string) error
 }
 
+// the bits of the MQTT 5.0 subscription options kept with the granted qos
+const (
+	subNoLocal           byte = 0x04
+	subRetainAsPublished byte = 0x08
+	subOptions                = 0x03 | subNoLocal | subRetainAsPublished
+)
+
+// Subscriber the subscriber and the maximum qos granted by its subscription,
+// Share is the shared subscription when it is chosen as the member of the group.
+// NoLocal and RetainAsPublished are the MQTT 5.0 subscription options
+type Subscriber struct {
+	Sub   Sub
+	Qos   byte
+	Share string
+
+	NoLocal           bool
+	RetainAsPublished bool
+}
+
+// TopicsManager manage the subscriptions of all the sessions
 type TopicsManager struct {
-	topicToSession map[string][]string
-	sessionToSub   map[string]Sub
-	lock           sync.Mutex
+	tree *Tree
+
+	// the topic filters and the granted qos with the options of each session, used by Deregister
+	sessionTopics map[string]map[string]byte
+	lock          sync.RWMutex
+
+	// how the member of the shared subscriptions is chosen
+	strategy ShareStrategy
 }
 
 func NewTopicManager() *TopicsManager {
 	return &TopicsManager{
-		topicToSession: make(map[string][]string),
-		sessionToSub:   make(map[string]Sub),
+		tree:          newTree(),
+		sessionTopics: make(map[string]map[string]byte),
 	}
 }
 
-func (manager *TopicsManager) Register(topic string, sessionId string, sub Sub) error {
+// Register subscribe the topic filter, subscribing the same filter again replaces the subscription.
+// options is the granted qos, with the No Local and Retain As Published bits of MQTT 5.0
+func (manager *TopicsManager) Register(topic string, sessionId string, options byte, sub Sub) error {
 	manager.lock.Lock()
-	go manager.lock.Unlock()
+	defer manager.lock.Unlock()
 
-	if sessions, ok := manager.topicToSession[topic]; ok {
-		manager.topicToSession[topic] = append(sessions, sessionId)
-	} else {
-		manager.topicToSession[topic] = append(make([]string, 0, 10), sessionId)
-	}
+	options &= subOptions
+	manager.tree.insert(topic, sessionId, Subscriber{
+		Sub:               sub,
+		Qos:               options & 0x03,
+		NoLocal:           options&subNoLocal != 0,
+		RetainAsPublished: options&subRetainAsPublished != 0,
+	})
 
-	manager.sessionToSub[sessionId] = sub
+	topics, ok := manager.sessionTopics[sessionId]
+	if !ok {
+		topics = make(map[string]byte)
+		manager.sessionTopics[sessionId] = topics
+	}
+	topics[topic] = options
 	return nil
 }
 
+// Unregister remove one subscription of the session, return false if it does not exist
+func (manager *TopicsManager) Unregister(topic string, sessionId string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	topics, ok := manager.sessionTopics[sessionId]
+	if !ok {
+		return false
+	}
+	if _, ok := topics[topic]; !ok {
+		return false
+	}
+
+	delete(topics, topic)
+	if len(topics) == 0 {
+		delete(manager.sessionTopics, sessionId)
+	}
+	return manager.tree.remove(topic, sessionId)
+}
+
+// Deregister remove all the subscriptions of the session
 func (manager *TopicsManager) Deregister(sessionId string) {
 	manager.lock.Lock()
-	go manager.lock.Unlock()
+	defer manager.lock.Unlock()
 
+	for topic := range manager.sessionTopics[sessionId] {
+		manager.tree.remove(topic, sessionId)
+	}
+	delete(manager.sessionTopics, sessionId)
 }
 
-func (manager *TopicsManager) Find(topic string) []Sub {
+// SetShareStrategy set how the member of the shared subscriptions is chosen
+func (manager *TopicsManager) SetShareStrategy(strategy ShareStrategy) {
 	manager.lock.Lock()
-	go manager.lock.Unlock()
+	defer manager.lock.Unlock()
+	manager.strategy = strategy
+}
 
-	subs := make([]Sub, 0, 16)
-	for k, vs := range manager.topicToSession {
-		if manager.Match(topic, k) {
-			for _, v := range vs {
-				subs = append(subs, manager.sessionToSub[v])
-			}
+// Subscriptions return the topic filters of the session with the granted qos and the options, as Register takes them
+func (manager *TopicsManager) Subscriptions(sessionId string) map[string]byte {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	subs := make(map[string]byte, len(manager.sessionTopics[sessionId]))
+	for topic, qos := range manager.sessionTopics[sessionId] {
+		subs[topic] = qos
+	}
+	return subs
+}
+
+// Count the number of the subscriptions of all the sessions
+func (manager *TopicsManager) Count() int {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	n := 0
+	for _, topics := range manager.sessionTopics {
+		n += len(topics)
+	}
+	return n
+}
+
+// Find return the subscribers of the topic name, a session with several matching
+// subscriptions is returned once with the maximum qos of them
+func (manager *TopicsManager) Find(topic string) []Subscriber {
+	return manager.Route(topic, "")
+}
+
+// Route return the subscribers of the message published by the client, one member is chosen
+// for each matching shared subscription, so a session may be returned again for them.
+// The No Local subscriptions of the publisher are skipped [MQTT-3.8.3-3]
+func (manager *TopicsManager) Route(topic string, publisher string) []Subscriber {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
+
+	res := manager.tree.match(topic, publisher)
+	subs := make([]Subscriber, 0, len(res.subs)+len(res.groups))
+	for _, sub := range res.subs {
+		subs = append(subs, sub)
+	}
+	for _, group := range res.groups {
+		if sub, ok := group.pick(manager.strategy, publisher, ""); ok {
+			subs = append(subs, sub)
 		}
 	}
 	return subs
 }
 
-func (manager *TopicsManager) Match(topic string, sub string) bool {
+// PickShared choose another member of the shared subscription for the message of the excluded
+// session, it is used when the member is disconnected before the message is acknowledged
+func (manager *TopicsManager) PickShared(share string, exclude string) (Subscriber, bool) {
+	manager.lock.RLock()
+	defer manager.lock.RUnlock()
 
-	if strings.Compare(topic, sub) == 0 {
-		return true
+	name, filter := splitShared(share)
+	node := manager.tree.find(filter)
+	if name == "" || node == nil {
+		return Subscriber{}, false
+	}
+	group, ok := node.shared[name]
+	if !ok {
+		return Subscriber{}, false
+	}
+	return group.pick(manager.strategy, "", exclude)
+}
+
+// Match whether the topic name matches the topic filter
+func (manager *TopicsManager) Match(topic string, filter string) bool {
+	return matchTopic(strings.Split(topic, SEP), strings.Split(filter, SEP), strings.HasPrefix(topic, SYS))
+}
+
+func matchTopic(topic []string, filter []string, sys bool) bool {
+	for i, level := range filter {
+		if sys && i == 0 && (level == MWC || level == SWC) {
+			return false
+		}
+		if level == MWC {
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if level != SWC && level != topic[i] {
+			return false
+		}
 	}
-	return false
+	return len(topic) == len(filter)
 }
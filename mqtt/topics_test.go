@@ -0,0 +1,210 @@
+package mqtt
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSub struct {
+	id string
+}
+
+func (sub *testSub) protocolVersion() byte {
+	return message.Version311
+}
+
+func (sub *testSub) publish(frame *message.PublishFrame, share string) error {
+	return nil
+}
+
+func findIds(manager *TopicsManager, topic string) []string {
+	ids := make([]string, 0)
+	for _, sub := range manager.Find(topic) {
+		ids = append(ids, sub.Sub.(*testSub).id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestTopicsMatch(t *testing.T) {
+	manager := NewTopicManager()
+
+	cases := []struct {
+		topic  string
+		filter string
+		match  bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1/#", true},
+		{"sport/tennis/player1/ranking", "sport/tennis/player1/#", true},
+		{"sport/tennis/player1/score/wimbledon", "sport/tennis/player1/#", true},
+		{"sport", "sport/#", true},
+		{"sport/", "sport/#", true},
+		{"sport", "#", true},
+		{"sport/tennis/player1", "sport/tennis/+", true},
+		{"sport/tennis/player1/ranking", "sport/tennis/+", false},
+		{"sport/tennis", "sport/tennis/+", false},
+		{"sport/", "sport/+", true},
+		{"/finance", "+/+", true},
+		{"/finance", "/+", true},
+		{"/finance", "+", false},
+		{"sport/tennis", "sport/tennis", true},
+		{"sport/tennis", "sport/Tennis", false},
+		{"$SYS/monitor/Clients", "#", false},
+		{"$SYS/monitor/Clients", "+/monitor/Clients", false},
+		{"$SYS/monitor/Clients", "$SYS/#", true},
+		{"$SYS/monitor/Clients", "$SYS/monitor/+", true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.match, manager.Match(c.topic, c.filter), "match %v with %v", c.topic, c.filter)
+
+		m := NewTopicManager()
+		m.Register(c.filter, "c1", message.QosAtMostOnce, &testSub{id: "c1"})
+		assert.Equal(t, c.match, len(m.Find(c.topic)) == 1, "find %v with %v", c.topic, c.filter)
+	}
+}
+
+func TestTopicsManager(t *testing.T) {
+	manager := NewTopicManager()
+	manager.Register("sport/#", "c1", message.QosAtMostOnce, &testSub{id: "c1"})
+	manager.Register("sport/tennis/+", "c1", message.QosAtLeastOnce, &testSub{id: "c1"})
+	manager.Register("sport/tennis/player1", "c2", message.QosAtMostOnce, &testSub{id: "c2"})
+	manager.Register("#", "c3", message.QosAtMostOnce, &testSub{id: "c3"})
+
+	assert.Equal(t, []string{"c1", "c2", "c3"}, findIds(manager, "sport/tennis/player1"))
+	assert.Equal(t, []string{"c1", "c3"}, findIds(manager, "sport"))
+	assert.Equal(t, []string{"c3"}, findIds(manager, "finance"))
+
+	for _, sub := range manager.Find("sport/tennis/player1") {
+		if sub.Sub.(*testSub).id == "c1" {
+			assert.Equal(t, message.QosAtLeastOnce, sub.Qos, "maximum qos of the matching subscriptions")
+		}
+	}
+
+	manager.Deregister("c1")
+	assert.Equal(t, []string{"c2", "c3"}, findIds(manager, "sport/tennis/player1"))
+
+	manager.Deregister("c3")
+	assert.Equal(t, []string{}, findIds(manager, "finance"))
+
+	manager.Deregister("c2")
+	assert.True(t, manager.tree.root.empty(), "unused levels should be removed")
+}
+
+func TestTopicsUnregister(t *testing.T) {
+	manager := NewTopicManager()
+	manager.Register("sport/#", "c1", message.QosAtMostOnce, &testSub{id: "c1"})
+	manager.Register("sport/tennis", "c1", message.QosAtMostOnce, &testSub{id: "c1"})
+
+	assert.True(t, manager.Unregister("sport/#", "c1"))
+	assert.False(t, manager.Unregister("sport/#", "c1"), "subscription should be removed already")
+	assert.False(t, manager.Unregister("sport/tennis", "c2"))
+	assert.Equal(t, []string{"c1"}, findIds(manager, "sport/tennis"))
+	assert.Equal(t, []string{}, findIds(manager, "sport"))
+}
+
+func TestTopicsSubscriptions(t *testing.T) {
+	manager := NewTopicManager()
+	manager.Register("sport/#", "c1", message.QosAtMostOnce, &testSub{id: "c1"})
+	manager.Register("sport/tennis", "c1", message.QosExactlyOnce, &testSub{id: "c1"})
+	manager.Register("finance", "c2", message.QosAtLeastOnce, &testSub{id: "c2"})
+
+	assert.Equal(t, map[string]byte{"sport/#": 0, "sport/tennis": 2}, manager.Subscriptions("c1"))
+	manager.Unregister("sport/#", "c1")
+	assert.Equal(t, map[string]byte{"sport/tennis": 2}, manager.Subscriptions("c1"))
+	assert.Empty(t, manager.Subscriptions("c3"))
+}
+
+// memberSub a subscriber reporting its state to the shared subscriptions
+type memberSub struct {
+	testSub
+	offline  bool
+	inflight int
+}
+
+func (sub *memberSub) connected() bool {
+	return !sub.offline
+}
+
+func (sub *memberSub) inflightLen() int {
+	return sub.inflight
+}
+
+func TestTopicsShared(t *testing.T) {
+	manager := NewTopicManager()
+	manager.Register("$share/g1/sport/#", "c1", message.QosAtLeastOnce, &testSub{id: "c1"})
+	manager.Register("$share/g1/sport/#", "c2", message.QosAtLeastOnce, &testSub{id: "c2"})
+	manager.Register("$share/g2/sport/tennis", "c3", message.QosAtMostOnce, &testSub{id: "c3"})
+	manager.Register("sport/tennis", "c4", message.QosAtMostOnce, &testSub{id: "c4"})
+
+	// one member of each group receives the message, the members of g1 take turns
+	assert.Equal(t, []string{"c1", "c3", "c4"}, findIds(manager, "sport/tennis"))
+	assert.Equal(t, []string{"c2", "c3", "c4"}, findIds(manager, "sport/tennis"))
+	assert.Equal(t, []string{"c1"}, findIds(manager, "sport"))
+
+	for _, sub := range manager.Find("sport/tennis") {
+		switch sub.Sub.(*testSub).id {
+		case "c3":
+			assert.Equal(t, "$share/g2/sport/tennis", sub.Share)
+		case "c4":
+			assert.Equal(t, "", sub.Share, "the normal subscription is not shared")
+		}
+	}
+
+	sub, ok := manager.PickShared("$share/g1/sport/#", "c1")
+	assert.True(t, ok)
+	assert.Equal(t, "c2", sub.Sub.(*testSub).id, "the excluded member should not be picked")
+	_, ok = manager.PickShared("$share/g2/sport/tennis", "c3")
+	assert.False(t, ok, "no other member in the group")
+
+	assert.True(t, manager.Unregister("$share/g1/sport/#", "c1"))
+	assert.Equal(t, []string{"c2"}, findIds(manager, "sport"))
+	manager.Deregister("c2")
+	manager.Deregister("c3")
+	manager.Deregister("c4")
+	assert.True(t, manager.tree.root.empty(), "unused groups should be removed")
+}
+
+func TestTopicsShareStrategy(t *testing.T) {
+	members := []*memberSub{
+		{testSub: testSub{id: "c1"}, inflight: 3},
+		{testSub: testSub{id: "c2"}, inflight: 1},
+		{testSub: testSub{id: "c3"}, inflight: 0, offline: true},
+	}
+	manager := NewTopicManager()
+	for _, m := range members {
+		manager.Register("$share/g/a", m.id, message.QosAtLeastOnce, m)
+	}
+	pick := func(publisher string) string {
+		subs := manager.Route("a", publisher)
+		assert.Len(t, subs, 1)
+		return subs[0].Sub.(*memberSub).id
+	}
+
+	manager.SetShareStrategy(ShareLeastInflight)
+	assert.Equal(t, "c2", pick(""), "the disconnected member should not be picked")
+
+	manager.SetShareStrategy(ShareSticky)
+	first := pick("p1")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, pick("p1"), "the same publisher should go to the same member")
+	}
+
+	manager.SetShareStrategy(ShareRandom)
+	for i := 0; i < 5; i++ {
+		assert.NotEqual(t, "c3", pick(""))
+	}
+
+	manager.SetShareStrategy(ShareLeastInflight)
+	members[0].offline = true
+	members[1].offline = true
+	assert.Equal(t, "c3", pick(""), "a disconnected member is picked if none is connected")
+
+	_, err := ParseShareStrategy("least-inflight")
+	assert.NoError(t, err)
+	_, err = ParseShareStrategy("fastest")
+	assert.Error(t, err)
+}
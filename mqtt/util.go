@@ -1,12 +1,11 @@
 package mqtt
 
 import (
-	"encoding/binary"
 	"io"
 	"net"
 	"time"
 
-	"github.com/surgemq/message"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 )
 
 type netReader interface {
@@ -19,13 +18,32 @@ type timeoutReader struct {
 	conn netReader
 }
 
+// Read set the read deadline before every read, zero duration means no deadline
 func (r timeoutReader) Read(b []byte) (int, error) {
-	if err := r.conn.SetReadDeadline(time.Now().Add(r.d)); err != nil {
+	var deadline time.Time
+	if r.d > 0 {
+		deadline = time.Now().Add(r.d)
+	}
+	if err := r.conn.SetReadDeadline(deadline); err != nil {
 		return 0, err
 	}
 	return r.conn.Read(b)
 }
 
+// timeoutConn set the write deadline before every write, so a client which is not reading
+// does not block its writer, or the goroutines writing the acknowledgements, forever
+type timeoutConn struct {
+	net.Conn
+	d time.Duration
+}
+
+func (conn timeoutConn) Write(b []byte) (int, error) {
+	if err := conn.Conn.SetWriteDeadline(time.Now().Add(conn.d)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(b)
+}
+
 func WriteMessageWithTimeout(msg message.Message, conn net.Conn, timeout time.Duration) (int, error) {
 
 	// set timeout for writing message
@@ -37,44 +55,10 @@ func WriteMessageWithTimeout(msg message.Message, conn net.Conn, timeout time.Du
 	return WriteMessage(msg, conn)
 }
 
+// WriteMessage encode the message into a pooled buffer and write it in one call,
+// io.Writer returns an error on a short write, so there is no need to loop
 func WriteMessage(msg message.Message, writer io.Writer) (int, error) {
-
-	length := msg.Len()
-	buf := make([]byte, length)
-
-	msgLen, err := msg.Encode(buf[:])
-	if err != nil {
-		return 0, nil
-	}
-
-	if msgLen != length {
-		return 0, ErrMsgSize
-	}
-
-	var totalLen = 0
-	for {
-		n, err := writer.Write(buf[totalLen:])
-		if err != nil {
-
-			// judge whether this is network temporary error
-			// if netError, ok := err.(net.Error); ok && netError.Temporary() {
-			//	continue
-			//}
-			// can not use this, because timeout is also temporary error
-			// TODO, how to return the totalLen
-			return totalLen, err
-		}
-
-		//TODO,need investigate this condition
-		if n == 0 {
-			continue
-		}
-
-		totalLen += n
-		if totalLen >= len(buf) {
-			return totalLen, nil
-		}
-	}
+	return message.EncodeTo(msg, writer)
 }
 
 //this is wrong, because timeout is in the range
@@ -101,6 +85,8 @@ func ReadMessageWithTimeout(conn net.Conn, timeout time.Duration) ([]byte, error
 	return ReadMessage(reader)
 }
 
+// ReadMessage read one message from the reader without buffering, it is used when the reader is
+// not owned by a FrameReader, the connections served by the server use FrameReader
 func ReadMessage(conn io.Reader) ([]byte, error) {
 	// the message buffer
 	var buf []byte
@@ -145,8 +131,11 @@ func ReadMessage(conn io.Reader) ([]byte, error) {
 
 	}
 
-	// Get the remaining length of the message
-	remlen, _ := binary.Uvarint(buf[1:])
+	// Get the remaining length of the message, it is the MQTT variable byte integer
+	remlen, _, err := message.ReadVint(buf[1:])
+	if err != nil {
+		return nil, err
+	}
 	buf = append(buf, make([]byte, remlen)...)
 
 	// read the remaining message
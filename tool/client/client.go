@@ -3,12 +3,13 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"github.com/liuzz1983/scalemqtt/mqtt"
-	"github.com/surgemq/message"
 	"io"
 	"net"
 	"sync/atomic"
 	"time"
+
+	"github.com/liuzz1983/scalemqtt/mqtt"
+	"github.com/liuzz1983/scalemqtt/mqtt/message"
 )
 
 func SendMsg(conn io.Writer, msg message.Message) error {
@@ -51,18 +52,17 @@ func (client *Client) buildConnection() error {
 	}()
 
 	// Create a new CONNECT message
-	msg := message.NewConnectMessage()
+	msg := message.NewConnMessage()
 
 	// Set the appropriate parameters
-	msg.SetWillQos(1)
-	msg.SetVersion(4)
+	msg.SetWill(true)
+	msg.SetQos(1)
 	msg.SetCleanSession(true)
-	msg.SetClientId([]byte("surgemq"))
-	msg.SetKeepAlive(10)
-	msg.SetWillTopic([]byte("will"))
-	msg.SetWillMessage([]byte("send me home"))
-	msg.SetUsername([]byte("surgemq"))
-	msg.SetPassword([]byte("verysecret"))
+	msg.SetClientID([]byte("surgemq"))
+	msg.KeepAlive = 10
+	msg.WillTopic = []byte("will")
+	msg.WillMessage = []byte("send me home")
+	msg.SetUser([]byte("surgemq"), []byte("verysecret"))
 
 	// Encode the message and get the io.Reader
 	buf := make([]byte, msg.Len())
@@ -82,10 +82,10 @@ func (client *Client) buildConnection() error {
 
 	value, err := mqtt.ReadMessage(client.conn)
 	if err != nil {
-		fmt.Printf("error in read value\n", err)
+		fmt.Printf("error in read value %v\n", err)
 		return err
 	}
-	ackMsg := message.NewConnackMessage()
+	ackMsg := message.NewConnAckMessage()
 
 	_, err = ackMsg.Decode(value)
 	if err != nil {